@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/your-org/p2p-network/pkg/gateway"
 	"github.com/your-org/p2p-network/pkg/node"
 	"github.com/your-org/p2p-network/pkg/utils"
 )
@@ -26,6 +27,7 @@ func main() {
 
 	// 创建默认配置
 	cfg := node.DefaultConfig()
+	gatewayAddr := ""
 
 	// 可选的命令行参数覆盖
 	if len(os.Args) > 1 {
@@ -41,6 +43,11 @@ func main() {
 					cfg.BootstrapPeers = parsePeers(os.Args[i+1])
 					i++
 				}
+			case "--gateway":
+				if i+1 < len(os.Args) {
+					gatewayAddr = os.Args[i+1]
+					i++
+				}
 			case "--enable-relay":
 				cfg.EnableRelay = true
 			case "--verbose", "-v":
@@ -49,8 +56,21 @@ func main() {
 		}
 	}
 
+	// 创建指标收集器
+	metrics, err := utils.NewMetrics("p2p-node")
+	if err != nil {
+		logger.Warn("Failed to create metrics", "error", err)
+	} else {
+		logger.Info("Metrics enabled", "port", "9090")
+		go metrics.Start(ctx, 9090)
+	}
+
 	// 创建节点
-	n, err := node.NewNode(cfg, node.WithLogger(logger))
+	opts := []node.Option{node.WithLogger(logger)}
+	if metrics != nil {
+		opts = append(opts, node.WithMetrics(metrics))
+	}
+	n, err := node.NewNode(cfg, opts...)
 	if err != nil {
 		logger.Error("Failed to create node", "error", err)
 		os.Exit(1)
@@ -67,13 +87,18 @@ func main() {
 		"listenAddrs", n.Addrs(),
 	)
 
-	// 创建指标收集器
-	metrics, err := utils.NewMetrics("p2p-node")
-	if err != nil {
-		logger.Warn("Failed to create metrics", "error", err)
-	} else {
-		logger.Info("Metrics enabled", "port", "9090")
-		go metrics.Start(ctx, 9090)
+	// 启动 OpenAI 兼容网关
+	var gw *gateway.Gateway
+	if gatewayAddr != "" {
+		network := gateway.NewNodeNetwork(n)
+
+		gwCfg := gateway.DefaultConfig()
+		gwCfg.ListenAddr = gatewayAddr
+		gw = gateway.New(network, gwCfg, gateway.WithLogger(logger))
+		if err := gw.Start(ctx); err != nil {
+			logger.Error("Failed to start gateway", "error", err)
+			os.Exit(1)
+		}
 	}
 
 	// 等待信号以优雅关闭
@@ -86,7 +111,13 @@ func main() {
 	case <-ctx.Done():
 	}
 
-	// 停止节点
+	// 停止网关和节点
+	if gw != nil {
+		if err := gw.Stop(ctx); err != nil {
+			logger.Error("Error stopping gateway", "error", err)
+		}
+	}
+
 	if err := n.Stop(ctx); err != nil {
 		logger.Error("Error stopping node", "error", err)
 	}
@@ -0,0 +1,133 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/your-org/p2p-network/pkg/protocol"
+)
+
+const (
+	TypeOpenAI = "openai"
+	TypeOllama = "ollama"
+)
+
+var ErrUnsupportedMethod = errors.New("method not supported by backend")
+
+// Config describes the inference server that serves one model.
+type Config struct {
+	Model          string
+	Type           string
+	URL            string
+	UpstreamModel  string
+	APIKey         string
+	MaxConcurrency int
+	// QueueDepth bounds the requests waiting for one of MaxConcurrency
+	// slots; 0 uses DefaultQueueDepth and a negative value disables
+	// queueing. QueueTimeout bounds how long a request may wait.
+	QueueDepth   int
+	QueueTimeout time.Duration
+	Timeout      time.Duration
+	// Price is advertised to requesters, per 1K tokens.
+	Price float64
+}
+
+func (c Config) upstreamModel() string {
+	if c.UpstreamModel != "" {
+		return c.UpstreamModel
+	}
+	return c.Model
+}
+
+// Backend runs a protocol.Request against a local inference engine and
+// returns an OpenAI-compatible result body for the request's method.
+type Backend interface {
+	Generate(ctx context.Context, req *protocol.Request) (json.RawMessage, error)
+	Health(ctx context.Context) error
+}
+
+// StreamingBackend is a Backend that can also pass on results while they
+// are generated, as OpenAI stream chunk objects (chat.completion.chunk or
+// text_completion).
+type StreamingBackend interface {
+	Backend
+	GenerateStream(ctx context.Context, req *protocol.Request, emit func(chunk json.RawMessage) error) error
+}
+
+func New(cfg Config) (Backend, error) {
+	if cfg.Model == "" {
+		return nil, errors.New("backend model is required")
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("backend for %s: URL is required", cfg.Model)
+	}
+
+	client := &http.Client{Timeout: cfg.Timeout}
+
+	switch cfg.Type {
+	case TypeOpenAI, "":
+		return NewOpenAIBackend(cfg, client), nil
+	case TypeOllama:
+		return NewOllamaBackend(cfg, client), nil
+	default:
+		return nil, fmt.Errorf("backend for %s: unknown type %q", cfg.Model, cfg.Type)
+	}
+}
+
+// UpstreamError is a non-2xx answer from the inference server.
+type UpstreamError struct {
+	Status  int
+	Message string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream returned %d: %s", e.Status, e.Message)
+}
+
+// ToProtocolError translates a backend failure into the error returned to
+// the requesting peer, so clients can tell retryable conditions apart.
+func ToProtocolError(err error) *protocol.Error {
+	var protoErr *protocol.Error
+	if errors.As(err, &protoErr) {
+		return protoErr
+	}
+
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		code := protocol.ErrCodeInternal
+		switch {
+		case upstream.Status == http.StatusBadRequest || upstream.Status == http.StatusUnprocessableEntity:
+			code = protocol.ErrCodeInvalidRequest
+		case upstream.Status == http.StatusNotFound:
+			code = protocol.ErrCodeNotFound
+		case upstream.Status == http.StatusTooManyRequests:
+			code = protocol.ErrCodeBusy
+		case upstream.Status == http.StatusServiceUnavailable || upstream.Status == http.StatusBadGateway:
+			code = protocol.ErrCodeUnavailable
+		case upstream.Status == http.StatusGatewayTimeout:
+			code = protocol.ErrCodeTimeout
+		}
+		return &protocol.Error{Code: code, Message: upstream.Message}
+	}
+
+	if errors.Is(err, ErrUnsupportedMethod) {
+		return &protocol.Error{Code: protocol.ErrCodeInvalidRequest, Message: err.Error()}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &protocol.Error{Code: protocol.ErrCodeTimeout, Message: err.Error()}
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return &protocol.Error{Code: protocol.ErrCodeUnavailable, Message: err.Error()}
+	}
+
+	return &protocol.Error{Code: protocol.ErrCodeInternal, Message: err.Error()}
+}
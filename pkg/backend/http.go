@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxErrorBody  = 64 * 1024
+	maxStreamLine = 1024 * 1024
+)
+
+func endpoint(base, path string) string {
+	return strings.TrimRight(base, "/") + path
+}
+
+func doJSON(ctx context.Context, client *http.Client, method, url, apiKey string, body interface{}) ([]byte, error) {
+	resp, err := do(ctx, client, method, url, apiKey, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// doStream sends body and passes each line of the answer to line as it
+// arrives, for upstreams that stream server-sent events or NDJSON.
+func doStream(ctx context.Context, client *http.Client, url, apiKey string, body interface{}, line func([]byte) error) error {
+	resp, err := do(ctx, client, http.MethodPost, url, apiKey, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLine)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		if err := line(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// do sends a request to the upstream and turns non-2xx answers into an
+// UpstreamError. The caller closes the body of a returned response.
+func do(ctx context.Context, client *http.Client, method, url, apiKey string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("encode upstream request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return nil, &UpstreamError{Status: resp.StatusCode, Message: errorMessage(data, resp.Status)}
+	}
+
+	return resp, nil
+}
+
+// errorMessage extracts the message from an OpenAI ({"error":{"message":..}})
+// or Ollama ({"error":"..."}) error body.
+func errorMessage(data []byte, fallback string) string {
+	var body struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || len(body.Error) == 0 {
+		if len(data) > 0 {
+			return strings.TrimSpace(string(data))
+		}
+		return fallback
+	}
+
+	var message string
+	if err := json.Unmarshal(body.Error, &message); err == nil {
+		return message
+	}
+
+	var structured struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body.Error, &structured); err == nil && structured.Message != "" {
+		return structured.Message
+	}
+
+	return fallback
+}
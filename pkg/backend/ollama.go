@@ -0,0 +1,275 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/your-org/p2p-network/pkg/openai"
+	"github.com/your-org/p2p-network/pkg/protocol"
+)
+
+// OllamaBackend translates OpenAI requests to the Ollama /api/chat and
+// /api/generate endpoints and their answers back to OpenAI responses.
+type OllamaBackend struct {
+	cfg    Config
+	client *http.Client
+}
+
+func NewOllamaBackend(cfg Config, client *http.Client) *OllamaBackend {
+	return &OllamaBackend{cfg: cfg, client: client}
+}
+
+// samplingParams are the OpenAI sampling fields that have an Ollama option.
+type samplingParams struct {
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+	MaxTokens   *int            `json:"max_tokens,omitempty"`
+	Seed        *int            `json:"seed,omitempty"`
+	Stop        json.RawMessage `json:"stop,omitempty"`
+}
+
+func (p samplingParams) options() map[string]interface{} {
+	opts := make(map[string]interface{})
+	if p.Temperature != nil {
+		opts["temperature"] = *p.Temperature
+	}
+	if p.TopP != nil {
+		opts["top_p"] = *p.TopP
+	}
+	if p.MaxTokens != nil {
+		opts["num_predict"] = *p.MaxTokens
+	}
+	if p.Seed != nil {
+		opts["seed"] = *p.Seed
+	}
+	if len(p.Stop) > 0 {
+		var stop []string
+		if err := json.Unmarshal(p.Stop, &stop); err != nil {
+			var single string
+			if json.Unmarshal(p.Stop, &single) == nil {
+				stop = []string{single}
+			}
+		}
+		if len(stop) > 0 {
+			opts["stop"] = stop
+		}
+	}
+	return opts
+}
+
+type ollamaRequest struct {
+	Model    string                 `json:"model"`
+	Messages []openai.ChatMessage   `json:"messages,omitempty"`
+	Prompt   string                 `json:"prompt,omitempty"`
+	Stream   bool                   `json:"stream"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+}
+
+type ollamaResponse struct {
+	Message         *openai.ChatMessage `json:"message,omitempty"`
+	Response        string              `json:"response,omitempty"`
+	Done            bool                `json:"done"`
+	DoneReason      string              `json:"done_reason,omitempty"`
+	Error           string              `json:"error,omitempty"`
+	PromptEvalCount int                 `json:"prompt_eval_count"`
+	EvalCount       int                 `json:"eval_count"`
+}
+
+func (r *ollamaResponse) usage() *openai.Usage {
+	return &openai.Usage{
+		PromptTokens:     r.PromptEvalCount,
+		CompletionTokens: r.EvalCount,
+		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+	}
+}
+
+func (r *ollamaResponse) finishReason() *string {
+	reason := "stop"
+	if r.DoneReason == "length" {
+		reason = "length"
+	}
+	return &reason
+}
+
+func (b *OllamaBackend) Generate(ctx context.Context, req *protocol.Request) (json.RawMessage, error) {
+	path, body, err := b.translate(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.call(ctx, path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Method == protocol.MethodChatCompletions {
+		message := resp.Message
+		if message == nil {
+			message = &openai.ChatMessage{Role: "assistant"}
+		}
+
+		return json.Marshal(openai.ChatCompletionResponse{
+			ID:      req.ID,
+			Object:  "chat.completion",
+			Created: time.Now().Unix(),
+			Model:   b.cfg.Model,
+			Choices: []openai.ChatChoice{{
+				Message:      message,
+				FinishReason: resp.finishReason(),
+			}},
+			Usage: resp.usage(),
+		})
+	}
+
+	return json.Marshal(openai.CompletionResponse{
+		ID:      req.ID,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   b.cfg.Model,
+		Choices: []openai.CompletionChoice{{
+			Text:         resp.Response,
+			FinishReason: resp.finishReason(),
+		}},
+		Usage: resp.usage(),
+	})
+}
+
+// GenerateStream asks Ollama for NDJSON output and translates each line into
+// an OpenAI stream chunk. The last line carries the finish reason and usage.
+func (b *OllamaBackend) GenerateStream(ctx context.Context, req *protocol.Request, emit func(json.RawMessage) error) error {
+	path, body, err := b.translate(req)
+	if err != nil {
+		return err
+	}
+	body.Stream = true
+
+	created := time.Now().Unix()
+	return doStream(ctx, b.client, endpoint(b.cfg.URL, path), b.cfg.APIKey, body, func(line []byte) error {
+		var resp ollamaResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return fmt.Errorf("decode upstream chunk: %w", err)
+		}
+		if resp.Error != "" {
+			return &UpstreamError{Status: http.StatusBadGateway, Message: resp.Error}
+		}
+
+		var finish *string
+		var usage *openai.Usage
+		if resp.Done {
+			finish, usage = resp.finishReason(), resp.usage()
+		}
+
+		var chunk interface{}
+		if req.Method == protocol.MethodChatCompletions {
+			delta := resp.Message
+			if delta == nil {
+				delta = &openai.ChatMessage{}
+			}
+			chunk = openai.ChatCompletionResponse{
+				ID:      req.ID,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   b.cfg.Model,
+				Choices: []openai.ChatChoice{{Delta: delta, FinishReason: finish}},
+				Usage:   usage,
+			}
+		} else {
+			chunk = openai.CompletionResponse{
+				ID:      req.ID,
+				Object:  "text_completion",
+				Created: created,
+				Model:   b.cfg.Model,
+				Choices: []openai.CompletionChoice{{Text: resp.Response, FinishReason: finish}},
+				Usage:   usage,
+			}
+		}
+
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		return emit(data)
+	})
+}
+
+// translate builds the Ollama request for req and returns it with the
+// endpoint it goes to.
+func (b *OllamaBackend) translate(req *protocol.Request) (string, *ollamaRequest, error) {
+	var params samplingParams
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return "", nil, &protocol.Error{Code: protocol.ErrCodeInvalidRequest, Message: err.Error()}
+		}
+	}
+
+	switch req.Method {
+	case protocol.MethodChatCompletions:
+		var body openai.ChatCompletionRequest
+		if err := json.Unmarshal(req.Params, &body); err != nil {
+			return "", nil, &protocol.Error{Code: protocol.ErrCodeInvalidRequest, Message: err.Error()}
+		}
+
+		return "/api/chat", &ollamaRequest{
+			Model:    b.cfg.upstreamModel(),
+			Messages: body.Messages,
+			Options:  params.options(),
+		}, nil
+	case protocol.MethodCompletions:
+		var body openai.CompletionRequest
+		if err := json.Unmarshal(req.Params, &body); err != nil {
+			return "", nil, &protocol.Error{Code: protocol.ErrCodeInvalidRequest, Message: err.Error()}
+		}
+
+		prompt, err := singlePrompt(body.Prompt)
+		if err != nil {
+			return "", nil, &protocol.Error{Code: protocol.ErrCodeInvalidRequest, Message: err.Error()}
+		}
+
+		return "/api/generate", &ollamaRequest{
+			Model:   b.cfg.upstreamModel(),
+			Prompt:  prompt,
+			Options: params.options(),
+		}, nil
+	default:
+		return "", nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, req.Method)
+	}
+}
+
+func (b *OllamaBackend) call(ctx context.Context, path string, req *ollamaRequest) (*ollamaResponse, error) {
+	data, err := doJSON(ctx, b.client, http.MethodPost, endpoint(b.cfg.URL, path), b.cfg.APIKey, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp ollamaResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("decode upstream response: %w", err)
+	}
+	return &resp, nil
+}
+
+func (b *OllamaBackend) Health(ctx context.Context) error {
+	_, err := doJSON(ctx, b.client, http.MethodGet, endpoint(b.cfg.URL, "/api/tags"), b.cfg.APIKey, nil)
+	return err
+}
+
+// singlePrompt accepts the string or one-element array forms of the OpenAI
+// prompt field; Ollama generates for one prompt at a time.
+func singlePrompt(raw json.RawMessage) (string, error) {
+	var prompt string
+	if err := json.Unmarshal(raw, &prompt); err == nil {
+		return prompt, nil
+	}
+
+	var prompts []string
+	if err := json.Unmarshal(raw, &prompts); err != nil {
+		return "", fmt.Errorf("prompt must be a string or array of strings")
+	}
+	if len(prompts) != 1 {
+		return "", fmt.Errorf("ollama backend accepts exactly one prompt, got %d", len(prompts))
+	}
+	return prompts[0], nil
+}
@@ -0,0 +1,121 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/your-org/p2p-network/pkg/protocol"
+)
+
+// OpenAIBackend forwards requests to a server implementing the OpenAI API,
+// such as vLLM, llama.cpp server or LocalAI.
+type OpenAIBackend struct {
+	cfg    Config
+	client *http.Client
+}
+
+func NewOpenAIBackend(cfg Config, client *http.Client) *OpenAIBackend {
+	return &OpenAIBackend{cfg: cfg, client: client}
+}
+
+func methodPath(method string) (string, error) {
+	switch method {
+	case protocol.MethodChatCompletions:
+		return "/v1/chat/completions", nil
+	case protocol.MethodCompletions:
+		return "/v1/completions", nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedMethod, method)
+	}
+}
+
+func (b *OpenAIBackend) Generate(ctx context.Context, req *protocol.Request) (json.RawMessage, error) {
+	path, err := methodPath(req.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := rewriteModel(req.Params, b.cfg.upstreamModel())
+	if err != nil {
+		return nil, &protocol.Error{Code: protocol.ErrCodeInvalidRequest, Message: err.Error()}
+	}
+	body["stream"] = json.RawMessage("false")
+
+	data, err := doJSON(ctx, b.client, http.MethodPost, endpoint(b.cfg.URL, path), b.cfg.APIKey, body)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := rewriteModel(data, b.cfg.Model)
+	if err != nil {
+		return nil, fmt.Errorf("decode upstream response: %w", err)
+	}
+	return json.Marshal(result)
+}
+
+// GenerateStream asks the upstream for server-sent events and passes on the
+// chunk in each of them.
+func (b *OpenAIBackend) GenerateStream(ctx context.Context, req *protocol.Request, emit func(json.RawMessage) error) error {
+	path, err := methodPath(req.Method)
+	if err != nil {
+		return err
+	}
+
+	body, err := rewriteModel(req.Params, b.cfg.upstreamModel())
+	if err != nil {
+		return &protocol.Error{Code: protocol.ErrCodeInvalidRequest, Message: err.Error()}
+	}
+	body["stream"] = json.RawMessage("true")
+
+	return doStream(ctx, b.client, endpoint(b.cfg.URL, path), b.cfg.APIKey, body, func(line []byte) error {
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if !ok {
+			return nil
+		}
+		data = bytes.TrimSpace(data)
+		if string(data) == "[DONE]" {
+			return nil
+		}
+
+		chunk, err := rewriteModel(data, b.cfg.Model)
+		if err != nil {
+			return fmt.Errorf("decode upstream chunk: %w", err)
+		}
+		if _, failed := chunk["error"]; failed {
+			return &UpstreamError{Status: http.StatusBadGateway, Message: errorMessage(data, "upstream stream failed")}
+		}
+
+		encoded, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		return emit(encoded)
+	})
+}
+
+func (b *OpenAIBackend) Health(ctx context.Context) error {
+	_, err := doJSON(ctx, b.client, http.MethodGet, endpoint(b.cfg.URL, "/v1/models"), b.cfg.APIKey, nil)
+	return err
+}
+
+// rewriteModel replaces the model field of an OpenAI body while keeping
+// every other field intact.
+func rewriteModel(data json.RawMessage, model string) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+	}
+
+	encoded, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	fields["model"] = encoded
+
+	return fields, nil
+}
@@ -0,0 +1,297 @@
+package backend
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/your-org/p2p-network/pkg/protocol"
+)
+
+const (
+	DefaultQueueDepth   = 64
+	DefaultQueueTimeout = 30 * time.Second
+
+	// serviceSmoothing weights the latest request duration in the moving
+	// average used for wait estimates.
+	serviceSmoothing = 0.2
+)
+
+type waiter struct {
+	priority int
+	seq      uint64
+	index    int
+	ready    chan struct{}
+	report   func(position, depth int, wait time.Duration)
+	// updates holds the latest position not yet reported. Reports can be
+	// slow remote writes, so they run on the waiter's own goroutine and
+	// a newer position replaces one that has not gone out yet.
+	updates chan positionUpdate
+}
+
+// reportUpdates delivers position updates until stop is closed.
+func (w *waiter) reportUpdates(stop <-chan struct{}) {
+	for {
+		select {
+		case u := <-w.updates:
+			w.report(u.position, u.depth, u.wait)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *waiter) before(other *waiter) bool {
+	if w.priority != other.priority {
+		return w.priority > other.priority
+	}
+	return w.seq < other.seq
+}
+
+// waitQueue orders waiters by priority class, then arrival.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool { return q[i].before(q[j]) }
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// QueueStats describes a model's admission queue.
+type QueueStats struct {
+	InFlight int
+	Capacity int
+	Queued   int
+	MaxDepth int
+	// AvgWait is the moving average of time requests spent queued.
+	AvgWait time.Duration
+}
+
+// admissionQueue admits up to capacity concurrent requests for a model and
+// queues up to depth more, highest priority first, for at most timeout.
+type admissionQueue struct {
+	capacity int
+	depth    int
+	timeout  time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	waiting  waitQueue
+	seq      uint64
+	service  time.Duration
+	wait     time.Duration
+}
+
+func newAdmissionQueue(capacity, depth int, timeout time.Duration) *admissionQueue {
+	if depth < 0 {
+		depth = 0
+	}
+	if timeout <= 0 {
+		timeout = DefaultQueueTimeout
+	}
+
+	return &admissionQueue{
+		capacity: capacity,
+		depth:    depth,
+		timeout:  timeout,
+	}
+}
+
+// acquire admits a request, queueing it if every slot is taken. report is
+// called with the request's position when it changes while queued, from
+// another goroutine; positions that change again before report returns are
+// skipped.
+func (q *admissionQueue) acquire(ctx context.Context, priority int, report func(position, depth int, wait time.Duration)) error {
+	if q.capacity <= 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	if q.inFlight < q.capacity && len(q.waiting) == 0 {
+		q.inFlight++
+		q.mu.Unlock()
+		return nil
+	}
+
+	if len(q.waiting) >= q.depth {
+		retryAfter := q.estimateLocked(len(q.waiting) + 1)
+		q.mu.Unlock()
+		return &protocol.Error{
+			Code:       protocol.ErrCodeBusy,
+			Message:    fmt.Sprintf("queue full (%d waiting)", q.depth),
+			RetryAfter: retryAfter,
+		}
+	}
+
+	q.seq++
+	w := &waiter{
+		priority: priority,
+		seq:      q.seq,
+		ready:    make(chan struct{}),
+		report:   report,
+	}
+	if report != nil {
+		w.updates = make(chan positionUpdate, 1)
+		stop := make(chan struct{})
+		defer close(stop)
+		go w.reportUpdates(stop)
+	}
+	heap.Push(&q.waiting, w)
+	q.notifyLocked()
+	q.mu.Unlock()
+
+	enqueued := time.Now()
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		q.recordWait(time.Since(enqueued))
+		return nil
+	case <-timer.C:
+		return q.abandon(w, &protocol.Error{
+			Code:       protocol.ErrCodeBusy,
+			Message:    fmt.Sprintf("queued for longer than %s", q.timeout),
+			RetryAfter: q.estimate(q.Stats().Queued),
+		})
+	case <-ctx.Done():
+		return q.abandon(w, ctx.Err())
+	}
+}
+
+// abandon removes w from the queue, unless it was admitted concurrently, in
+// which case the slot it was handed is released.
+func (q *admissionQueue) abandon(w *waiter, err error) error {
+	q.mu.Lock()
+	if w.index < 0 {
+		q.mu.Unlock()
+		q.release(0)
+		return err
+	}
+
+	heap.Remove(&q.waiting, w.index)
+	q.notifyLocked()
+	q.mu.Unlock()
+	return err
+}
+
+// release frees the slot of a request that ran for served and hands it to
+// the next waiter, if any.
+func (q *admissionQueue) release(served time.Duration) {
+	if q.capacity <= 0 {
+		return
+	}
+
+	q.mu.Lock()
+	if served > 0 {
+		q.service = smooth(q.service, served)
+	}
+
+	if len(q.waiting) == 0 {
+		q.inFlight--
+		q.mu.Unlock()
+		return
+	}
+
+	next := heap.Pop(&q.waiting).(*waiter)
+	close(next.ready)
+	q.notifyLocked()
+	q.mu.Unlock()
+}
+
+type positionUpdate struct {
+	position int
+	depth    int
+	wait     time.Duration
+}
+
+// notifyLocked queues every waiter's current 1-based position for
+// reporting without waiting for earlier reports to finish.
+func (q *admissionQueue) notifyLocked() {
+	ordered := make([]*waiter, len(q.waiting))
+	copy(ordered, q.waiting)
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].before(ordered[j])
+	})
+
+	for i, w := range ordered {
+		if w.updates == nil {
+			continue
+		}
+
+		u := positionUpdate{
+			position: i + 1,
+			depth:    len(ordered),
+			wait:     q.estimateLocked(i + 1),
+		}
+		select {
+		case <-w.updates:
+		default:
+		}
+		w.updates <- u
+	}
+}
+
+func (q *admissionQueue) estimate(position int) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.estimateLocked(position)
+}
+
+// estimateLocked guesses how long the request at position will wait: every
+// request ahead of it, spread over the model's slots, at the average
+// service time.
+func (q *admissionQueue) estimateLocked(position int) time.Duration {
+	if q.service == 0 || q.capacity <= 0 {
+		return 0
+	}
+	return time.Duration(float64(q.service) * float64(position) / float64(q.capacity))
+}
+
+func (q *admissionQueue) recordWait(d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.wait = smooth(q.wait, d)
+}
+
+func smooth(avg, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return time.Duration(serviceSmoothing*float64(sample) + (1-serviceSmoothing)*float64(avg))
+}
+
+func (q *admissionQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return QueueStats{
+		InFlight: q.inFlight,
+		Capacity: q.capacity,
+		Queued:   len(q.waiting),
+		MaxDepth: q.depth,
+		AvgWait:  q.wait,
+	}
+}
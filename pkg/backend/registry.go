@@ -0,0 +1,266 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/your-org/p2p-network/pkg/protocol"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+type modelBackend struct {
+	cfg     Config
+	backend Backend
+	queue   *admissionQueue
+
+	mu        sync.RWMutex
+	healthy   bool
+	lastError error
+	checkedAt time.Time
+}
+
+type Status struct {
+	Model     string
+	Healthy   bool
+	InFlight  int
+	Capacity  int
+	Queued    int
+	MaxQueue  int
+	AvgWait   time.Duration
+	Price     float64
+	LastError string
+	CheckedAt time.Time
+}
+
+// Registry serves protocol requests from the backends configured for each
+// model, queueing requests beyond a model's concurrency limit and refusing
+// work for backends that fail their health check.
+type Registry struct {
+	models         map[string]*modelBackend
+	healthInterval time.Duration
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewRegistry(configs []Config, healthInterval time.Duration) (*Registry, error) {
+	r := &Registry{
+		models:         make(map[string]*modelBackend, len(configs)),
+		healthInterval: healthInterval,
+	}
+
+	for _, cfg := range configs {
+		if _, exists := r.models[cfg.Model]; exists {
+			return nil, fmt.Errorf("duplicate backend for model %s", cfg.Model)
+		}
+
+		b, err := New(cfg)
+		if err != nil {
+			return nil, err
+		}
+		r.add(cfg, b)
+	}
+
+	return r, nil
+}
+
+// Register serves cfg.Model from an already constructed backend. It must be
+// called before Start.
+func (r *Registry) Register(cfg Config, b Backend) {
+	r.add(cfg, b)
+}
+
+func (r *Registry) add(cfg Config, b Backend) {
+	depth := cfg.QueueDepth
+	if depth == 0 {
+		depth = DefaultQueueDepth
+	}
+
+	r.models[cfg.Model] = &modelBackend{
+		cfg:     cfg,
+		backend: b,
+		queue:   newAdmissionQueue(cfg.MaxConcurrency, depth, cfg.QueueTimeout),
+		healthy: true,
+	}
+}
+
+func (r *Registry) Models() []string {
+	models := make([]string, 0, len(r.models))
+	for model := range r.models {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
+
+func (r *Registry) Status(model string) (Status, bool) {
+	m, ok := r.models[model]
+	if !ok {
+		return Status{}, false
+	}
+
+	queue := m.queue.Stats()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := Status{
+		Model:     model,
+		Healthy:   m.healthy,
+		InFlight:  queue.InFlight,
+		Capacity:  queue.Capacity,
+		Queued:    queue.Queued,
+		MaxQueue:  queue.MaxDepth,
+		AvgWait:   queue.AvgWait,
+		Price:     m.cfg.Price,
+		CheckedAt: m.checkedAt,
+	}
+	if m.lastError != nil {
+		status.LastError = m.lastError.Error()
+	}
+	return status, true
+}
+
+func (r *Registry) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	r.CheckHealth(ctx)
+	if r.healthInterval <= 0 {
+		return
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.healthInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.CheckHealth(ctx)
+			}
+		}
+	}()
+}
+
+func (r *Registry) Stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.wg.Wait()
+}
+
+// CheckHealth probes every backend once and records the result.
+func (r *Registry) CheckHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, m := range r.models {
+		wg.Add(1)
+		go func(m *modelBackend) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			err := m.backend.Health(checkCtx)
+			cancel()
+
+			m.mu.Lock()
+			m.healthy = err == nil
+			m.lastError = err
+			m.checkedAt = time.Now()
+			m.mu.Unlock()
+		}(m)
+	}
+	wg.Wait()
+}
+
+// Serve runs req on the backend for its model. Failures are reported in the
+// response's Error rather than returned, so the requester sees them.
+func (r *Registry) Serve(ctx context.Context, req *protocol.Request) *protocol.Response {
+	result, err := r.generate(ctx, req)
+	if err != nil {
+		return &protocol.Response{
+			ID:        req.ID,
+			Error:     ToProtocolError(err),
+			Timestamp: time.Now().Unix(),
+		}
+	}
+
+	return &protocol.Response{
+		ID:        req.ID,
+		Result:    result,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+func (r *Registry) generate(ctx context.Context, req *protocol.Request) ([]byte, error) {
+	m, ok := r.models[req.Model]
+	if !ok {
+		return nil, &protocol.Error{Code: protocol.ErrCodeNotFound, Message: fmt.Sprintf("model %s is not served here", req.Model)}
+	}
+
+	m.mu.RLock()
+	healthy := m.healthy
+	m.mu.RUnlock()
+	if !healthy {
+		return nil, &protocol.Error{Code: protocol.ErrCodeUnavailable, Message: fmt.Sprintf("backend for %s is unhealthy", req.Model)}
+	}
+
+	report := func(position, depth int, wait time.Duration) {
+		protocol.ReportQueueStatus(ctx, protocol.QueueStatus{
+			RequestID:     req.ID,
+			Position:      position,
+			Depth:         depth,
+			EstimatedWait: wait,
+		})
+	}
+	if err := m.queue.acquire(ctx, req.Priority, report); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	defer func() { m.queue.release(time.Since(started)) }()
+
+	if m.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.cfg.Timeout)
+		defer cancel()
+	}
+
+	// A streamed request's output goes to the requester chunk by chunk, and
+	// its response carries no result.
+	if streaming, ok := m.backend.(StreamingBackend); ok && req.Stream && protocol.CanStream(ctx) {
+		return nil, streaming.GenerateStream(ctx, req, func(chunk json.RawMessage) error {
+			return protocol.SendStreamChunk(ctx, chunk)
+		})
+	}
+
+	return m.backend.Generate(ctx, req)
+}
+
+// HandleRequest is a protocol.MessageHandler for MsgTypeRequest.
+func (r *Registry) HandleRequest(ctx context.Context, p peer.ID, msg *protocol.Message) (*protocol.Message, error) {
+	req, err := protocol.DecodeRequest(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := protocol.EncodeResponse(r.Serve(ctx, req))
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocol.Message{
+		Type:      protocol.MsgTypeResponse,
+		RequestID: msg.RequestID,
+		Payload:   payload,
+	}, nil
+}
@@ -52,6 +52,12 @@ func ProviderRecordFromPeer(p peer.AddrInfo) *ProviderRecord {
 	}
 }
 
+// ModelKey is the DHT key under which providers of model announce
+// themselves.
+func ModelKey(model string) string {
+	return "/llm-share/models/" + model
+}
+
 type NodeRecord struct {
 	PeerID    string
 	Value     []byte
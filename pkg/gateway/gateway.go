@@ -0,0 +1,397 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/your-org/p2p-network/pkg/openai"
+	"github.com/your-org/p2p-network/pkg/protocol"
+	"github.com/your-org/p2p-network/pkg/utils"
+)
+
+var ErrModelNotFound = errors.New("no providers for model")
+
+// badRequest is a request the gateway refuses without forwarding it.
+type badRequest struct {
+	message string
+}
+
+func (e *badRequest) Error() string {
+	return e.message
+}
+
+const (
+	// SessionHeader carries a conversation ID. Requests sharing one are
+	// kept on the same provider while it stays available.
+	SessionHeader = "X-Session-ID"
+	// PriorityHeader selects the request's priority class in provider
+	// queues: low, normal or high.
+	PriorityHeader = "X-Priority"
+)
+
+type Config struct {
+	ListenAddr     string
+	RequestTimeout time.Duration
+	ResolveTimeout time.Duration
+	MaxBodySize    int64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:     ":8080",
+		RequestTimeout: 5 * time.Minute,
+		ResolveTimeout: 10 * time.Second,
+		MaxBodySize:    4 * 1024 * 1024,
+	}
+}
+
+type ModelInfo struct {
+	ID        string
+	Providers int
+}
+
+// Network is the view of the P2P network the gateway needs: which models
+// are served, who serves them, and a way to send them a request. Request
+// must deliver the provider's stream chunks to the observer in ctx, as the
+// protocol client does.
+type Network interface {
+	Models(ctx context.Context) []ModelInfo
+	Providers(ctx context.Context, model string) ([]protocol.ProviderCandidate, error)
+	Request(ctx context.Context, providers []protocol.ProviderCandidate, session string, req *protocol.Request) (*protocol.Response, peer.ID, error)
+}
+
+type Option func(*Gateway)
+
+func WithLogger(logger *utils.Logger) Option {
+	return func(g *Gateway) {
+		g.logger = logger
+	}
+}
+
+// Gateway serves the OpenAI-compatible HTTP API and forwards requests to
+// providers over /llm-share.
+type Gateway struct {
+	cfg     Config
+	network Network
+	logger  *utils.Logger
+	server  *http.Server
+}
+
+func New(network Network, cfg Config, opts ...Option) *Gateway {
+	g := &Gateway{
+		cfg:     cfg,
+		network: network,
+	}
+
+	for _, opt := range opts {
+		opt(g)
+	}
+
+	g.server = &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           g.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return g
+}
+
+func (g *Gateway) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models", g.handleModels)
+	mux.HandleFunc("/v1/chat/completions", g.handleChatCompletions)
+	mux.HandleFunc("/v1/completions", g.handleCompletions)
+	return mux
+}
+
+func (g *Gateway) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", g.cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", g.cfg.ListenAddr, err)
+	}
+
+	go func() {
+		if err := g.server.Serve(ln); err != nil && err != http.ErrServerClosed && g.logger != nil {
+			g.logger.Error("Gateway server error", "error", err)
+		}
+	}()
+
+	if g.logger != nil {
+		g.logger.Info("Gateway listening", "addr", ln.Addr().String())
+	}
+	return nil
+}
+
+func (g *Gateway) Stop(ctx context.Context) error {
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return g.server.Shutdown(shutdownCtx)
+}
+
+func (g *Gateway) handleModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method not allowed")
+		return
+	}
+
+	models := g.network.Models(r.Context())
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].ID < models[j].ID
+	})
+
+	list := openai.ModelList{Object: "list", Data: make([]openai.Model, 0, len(models))}
+	for _, m := range models {
+		list.Data = append(list.Data, openai.Model{
+			ID:      m.ID,
+			Object:  "model",
+			OwnedBy: "llm-share",
+		})
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (g *Gateway) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	body, ok := g.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var req openai.ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "messages must not be empty")
+		return
+	}
+
+	if req.Stream {
+		g.forwardStream(w, r, protocol.MethodChatCompletions, req.Model, "chatcmpl", body, func(result json.RawMessage) {
+			var completion openai.ChatCompletionResponse
+			if err := json.Unmarshal(result, &completion); err != nil {
+				writeError(w, http.StatusBadGateway, "api_error", fmt.Sprintf("invalid provider response: %v", err))
+				return
+			}
+			streamChatCompletion(w, &completion)
+		})
+		return
+	}
+
+	resp, err := g.forward(r.Context(), r, protocol.MethodChatCompletions, req.Model, "chatcmpl", body, false)
+	if err != nil {
+		writeForwardError(w, err)
+		return
+	}
+	writeRawJSON(w, http.StatusOK, resp.Result)
+}
+
+func (g *Gateway) handleCompletions(w http.ResponseWriter, r *http.Request) {
+	body, ok := g.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var req openai.CompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if len(req.Prompt) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "prompt is required")
+		return
+	}
+
+	if req.Stream {
+		g.forwardStream(w, r, protocol.MethodCompletions, req.Model, "cmpl", body, func(result json.RawMessage) {
+			var completion openai.CompletionResponse
+			if err := json.Unmarshal(result, &completion); err != nil {
+				writeError(w, http.StatusBadGateway, "api_error", fmt.Sprintf("invalid provider response: %v", err))
+				return
+			}
+			streamCompletion(w, &completion)
+		})
+		return
+	}
+
+	resp, err := g.forward(r.Context(), r, protocol.MethodCompletions, req.Model, "cmpl", body, false)
+	if err != nil {
+		writeForwardError(w, err)
+		return
+	}
+	writeRawJSON(w, http.StatusOK, resp.Result)
+}
+
+func (g *Gateway) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method not allowed")
+		return nil, false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, g.cfg.MaxBodySize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", err.Error())
+		return nil, false
+	}
+	return body, true
+}
+
+// forward resolves model to providers and sends body to one of them. With
+// stream set the request asks for the provider's output in stream chunks,
+// which reach the observer in ctx.
+func (g *Gateway) forward(ctx context.Context, r *http.Request, method, model, idPrefix string, body []byte, stream bool) (*protocol.Response, error) {
+	if model == "" {
+		return nil, &badRequest{"model is required"}
+	}
+
+	priority, err := protocol.ParsePriority(r.Header.Get(PriorityHeader))
+	if err != nil {
+		return nil, &badRequest{err.Error()}
+	}
+
+	resolveCtx, cancel := context.WithTimeout(ctx, g.cfg.ResolveTimeout)
+	providers, err := g.network.Providers(resolveCtx, model)
+	cancel()
+	if err == nil && len(providers) == 0 {
+		err = ErrModelNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("model %q: %w", model, err)
+	}
+
+	ctx, cancel = context.WithTimeout(ctx, g.cfg.RequestTimeout)
+	defer cancel()
+
+	req := &protocol.Request{
+		Method:    method,
+		Model:     model,
+		Params:    body,
+		ID:        newID(idPrefix),
+		Timestamp: time.Now().Unix(),
+		Priority:  priority,
+		Stream:    stream,
+	}
+
+	resp, provider, err := g.network.Request(ctx, providers, r.Header.Get(SessionHeader), req)
+	if err != nil {
+		if g.logger != nil {
+			g.logger.Warn("Gateway request failed", "model", model, "provider", provider, "error", err)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// forwardStream forwards a request with stream set, relaying each chunk the
+// provider streams as a server-sent event as soon as it arrives. A provider
+// that answers with a whole result instead has it passed to replay.
+func (g *Gateway) forwardStream(w http.ResponseWriter, r *http.Request, method, model, idPrefix string, body []byte, replay func(result json.RawMessage)) {
+	var sse *sseWriter
+	ctx := protocol.ContextWithStreamObserver(r.Context(), func(data []byte) {
+		if sse == nil {
+			sse = newSSEWriter(w)
+		}
+		sse.raw(data)
+	})
+
+	resp, err := g.forward(ctx, r, method, model, idPrefix, body, true)
+	switch {
+	case sse == nil && err != nil:
+		writeForwardError(w, err)
+	case sse == nil:
+		replay(resp.Result)
+	case err != nil:
+		// The status line went out with the first chunk, so the failure can
+		// only be reported as an event.
+		_, errType := errorStatus(err)
+		sse.event(openai.ErrorResponse{Error: openai.APIError{Message: err.Error(), Type: errType}})
+	default:
+		sse.done()
+	}
+}
+
+// writeForwardError writes an error returned by forward as an OpenAI-style
+// error response.
+func writeForwardError(w http.ResponseWriter, err error) {
+	if wait, ok := protocol.RetryAfter(err); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	status, errType := errorStatus(err)
+	writeError(w, status, errType, err.Error())
+}
+
+// errorStatus maps network and provider errors to an HTTP status and an
+// OpenAI error type.
+func errorStatus(err error) (int, string) {
+	var protoErr *protocol.Error
+	if errors.As(err, &protoErr) {
+		switch protoErr.Code {
+		case protocol.ErrCodeInvalidRequest:
+			return http.StatusBadRequest, "invalid_request_error"
+		case protocol.ErrCodeNotFound:
+			return http.StatusNotFound, "invalid_request_error"
+		case protocol.ErrCodeBusy:
+			return http.StatusTooManyRequests, "rate_limit_error"
+		case protocol.ErrCodeUnavailable:
+			return http.StatusServiceUnavailable, "api_error"
+		case protocol.ErrCodeTimeout:
+			return http.StatusGatewayTimeout, "api_error"
+		default:
+			return http.StatusBadGateway, "api_error"
+		}
+	}
+
+	var bad *badRequest
+	switch {
+	case errors.As(err, &bad):
+		return http.StatusBadRequest, "invalid_request_error"
+	case errors.Is(err, ErrModelNotFound):
+		return http.StatusNotFound, "invalid_request_error"
+	case errors.Is(err, protocol.ErrNoProviders), errors.Is(err, protocol.ErrCircuitOpen):
+		return http.StatusServiceUnavailable, "api_error"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "api_error"
+	default:
+		return http.StatusBadGateway, "api_error"
+	}
+}
+
+func newID(prefix string) string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+	}
+	return prefix + "-" + hex.EncodeToString(buf)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeRawJSON(w http.ResponseWriter, status int, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, status int, errType, message string) {
+	writeJSON(w, status, openai.ErrorResponse{Error: openai.APIError{Message: message, Type: errType}})
+}
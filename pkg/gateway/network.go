@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/your-org/p2p-network/pkg/dht"
+	"github.com/your-org/p2p-network/pkg/node"
+	"github.com/your-org/p2p-network/pkg/protocol"
+)
+
+// NodeNetwork resolves models from the node's table of provider adverts,
+// falling back to DHT provider records, and sends requests through the
+// node's retrying client.
+type NodeNetwork struct {
+	node *node.Node
+}
+
+func NewNodeNetwork(n *node.Node) *NodeNetwork {
+	return &NodeNetwork{node: n}
+}
+
+func (nn *NodeNetwork) Models(ctx context.Context) []ModelInfo {
+	counts := nn.node.ProviderTable().Models()
+
+	models := make([]ModelInfo, 0, len(counts))
+	for model, providers := range counts {
+		models = append(models, ModelInfo{ID: model, Providers: providers})
+	}
+	return models
+}
+
+func (nn *NodeNetwork) Providers(ctx context.Context, model string) ([]protocol.ProviderCandidate, error) {
+	self := nn.node.Host().ID()
+
+	var providers []protocol.ProviderCandidate
+	for _, record := range nn.node.ProviderTable().Providers(model) {
+		if record.Peer != self {
+			providers = append(providers, protocol.ProviderCandidate{
+				Peer:       record.Peer,
+				Capacity:   record.Capacity,
+				Load:       record.Load,
+				QueueDepth: record.QueueDepth,
+			})
+		}
+	}
+
+	if len(providers) > 0 {
+		return providers, nil
+	}
+
+	infos, err := nn.node.DHT().FindProviders(ctx, dht.ModelKey(model))
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.ID != self {
+			providers = append(providers, protocol.ProviderCandidate{Peer: info.ID})
+		}
+	}
+	return providers, nil
+}
+
+func (nn *NodeNetwork) Request(ctx context.Context, providers []protocol.ProviderCandidate, session string, req *protocol.Request) (*protocol.Response, peer.ID, error) {
+	return nn.node.RequestSelect(ctx, providers, session, req)
+}
@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/your-org/p2p-network/pkg/openai"
+)
+
+// Chunks streamed by the provider are relayed as server-sent events
+// unchanged. A provider whose backend cannot stream answers with a complete
+// result, which is replayed as OpenAI-style events: one chunk carrying the
+// role and content of each choice, one carrying its finish reason, then
+// [DONE].
+
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	return &sseWriter{w: w, flusher: flusher}
+}
+
+func (s *sseWriter) event(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.raw(data)
+}
+
+func (s *sseWriter) raw(data []byte) error {
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+func (s *sseWriter) done() error {
+	return s.raw([]byte("[DONE]"))
+}
+
+func streamChatCompletion(w http.ResponseWriter, resp *openai.ChatCompletionResponse) {
+	sse := newSSEWriter(w)
+
+	chunk := func(choice openai.ChatChoice) openai.ChatCompletionResponse {
+		return openai.ChatCompletionResponse{
+			ID:      resp.ID,
+			Object:  "chat.completion.chunk",
+			Created: resp.Created,
+			Model:   resp.Model,
+			Choices: []openai.ChatChoice{choice},
+		}
+	}
+
+	for _, choice := range resp.Choices {
+		delta := &openai.ChatMessage{Role: "assistant"}
+		if choice.Message != nil {
+			delta = choice.Message
+		}
+		if err := sse.event(chunk(openai.ChatChoice{Index: choice.Index, Delta: delta})); err != nil {
+			return
+		}
+
+		if err := sse.event(chunk(openai.ChatChoice{Index: choice.Index, Delta: &openai.ChatMessage{}, FinishReason: choice.FinishReason})); err != nil {
+			return
+		}
+	}
+
+	sse.done()
+}
+
+func streamCompletion(w http.ResponseWriter, resp *openai.CompletionResponse) {
+	sse := newSSEWriter(w)
+
+	for _, choice := range resp.Choices {
+		if err := sse.event(openai.CompletionResponse{
+			ID:      resp.ID,
+			Object:  "text_completion",
+			Created: resp.Created,
+			Model:   resp.Model,
+			Choices: []openai.CompletionChoice{choice},
+		}); err != nil {
+			return
+		}
+	}
+
+	sse.done()
+}
@@ -2,6 +2,10 @@ package node
 
 import (
 	"time"
+
+	"github.com/your-org/p2p-network/pkg/backend"
+	"github.com/your-org/p2p-network/pkg/protocol"
+	"github.com/your-org/p2p-network/pkg/pubsub"
 )
 
 type Config struct {
@@ -15,6 +19,8 @@ type Config struct {
 	 KadDHTConfig
 	PubSubConfig
 	DiscoveryConfig
+	ProtocolConfig
+	ProviderConfig
 }
 
 type KadDHTConfig struct {
@@ -28,6 +34,42 @@ type PubSubConfig struct {
 	EnablePubSub      bool
 	PubSubSignMessages bool
 	PubSubValidateMessages bool
+
+	ProviderAdvertInterval time.Duration
+	ProviderAdvertTTL      time.Duration
+
+	// TopicConfigs replaces pubsub.DefaultTopicConfigs when set. The
+	// validator timeout and concurrency apply to topics that leave theirs
+	// unset.
+	TopicConfigs         map[string]*pubsub.TopicConfig
+	ValidatorTimeout     time.Duration
+	ValidatorConcurrency int
+
+	EnablePeerScoring    bool
+	ScoreThresholds      pubsub.ScoreThresholds
+	ScoreInspectInterval time.Duration
+	// TopicScoreOverrides replaces the score config of individual topics
+	// without restating the rest of their config.
+	TopicScoreOverrides map[string]*pubsub.TopicScoreConfig
+
+	// RateLimits limits local publishing and sets when peers exceeding the
+	// topic rate limits are penalised and disconnected. PeerRateLimits and
+	// TopicRateLimits replace the limits of individual topics.
+	RateLimits      pubsub.RateLimitConfig
+	PeerRateLimits  map[string]pubsub.RateLimit
+	TopicRateLimits map[string]pubsub.RateLimit
+
+	// Sync sets how topic history is exchanged with peers. With
+	// ProviderCatchUp a starting node syncs the provider adverts of the last
+	// ProviderAdvertTTL from its peers.
+	Sync            pubsub.SyncConfig
+	ProviderCatchUp bool
+
+	// SeenMessagesTTL is how long message IDs are remembered for
+	// deduplication. MessageIDs replaces the message ID function of
+	// individual topics; every node must agree on them.
+	SeenMessagesTTL time.Duration
+	MessageIDs      map[string]pubsub.MessageIDFunc
 }
 
 type DiscoveryConfig struct {
@@ -36,6 +78,63 @@ type DiscoveryConfig struct {
 	Rendezvous      string
 }
 
+type ProtocolConfig struct {
+	SignProtocolMessages bool
+	MaxClockSkew         time.Duration
+	ReplayWindow         time.Duration
+	MaxVerifyFailures    int
+
+	ChunkSize       int
+	ChunkThreshold  int
+	MaxTransferSize int64
+	TransferWindow  int
+
+	// MaxPartialTransfers, MaxPartialTransfersPerPeer and
+	// MaxPartialTransferBytes bound the transfers being received at once.
+	MaxPartialTransfers        int
+	MaxPartialTransfersPerPeer int
+	MaxPartialTransferBytes    int64
+
+	EnableCompression     bool
+	CompressionAlgorithms []string
+	CompressionMinSize    int
+	MaxDecompressedSize   int64
+
+	// EncryptPayloads seals request payloads to the provider's identity key
+	// so relays cannot read prompts; RequireEncryption refuses plaintext
+	// requests when serving.
+	EncryptPayloads   bool
+	RequireEncryption bool
+
+	HeartbeatInterval   time.Duration
+	HeartbeatTimeout    time.Duration
+	MaxMissedHeartbeats int
+
+	RetryMaxAttempts        int
+	RetryInitialBackoff     time.Duration
+	RetryMaxBackoff         time.Duration
+	RequestTimeout          time.Duration
+	BreakerFailureThreshold int
+	BreakerCooldown         time.Duration
+	SelectionStrategy       string
+	StickySessionTTL        time.Duration
+
+	MaxInFlightPerStream  int
+	MaxInFlightPerPeer    int
+	MaxConcurrentHandlers int
+	HandlerQueueTimeout   time.Duration
+	StreamReadTimeout     time.Duration
+	StreamWriteTimeout    time.Duration
+	HandlerTimeout        time.Duration
+}
+
+// ProviderConfig lists the models this node serves and the inference
+// backend behind each of them.
+type ProviderConfig struct {
+	Backends              []backend.Config
+	BackendHealthInterval time.Duration
+}
+
 func DefaultConfig() *Config {
 	return &Config{
 		ListenPort:     "0",
@@ -55,6 +154,18 @@ func DefaultConfig() *Config {
 			EnablePubSub:          true,
 			PubSubSignMessages:    true,
 			PubSubValidateMessages: true,
+
+			ProviderAdvertInterval: pubsub.DefaultAdvertInterval,
+			ProviderAdvertTTL:      pubsub.DefaultAdvertTTL,
+			ValidatorTimeout:       pubsub.DefaultValidatorTimeout,
+			ValidatorConcurrency:   pubsub.DefaultValidatorConcurrency,
+			EnablePeerScoring:      true,
+			ScoreThresholds:        pubsub.DefaultScoreThresholds(),
+			ScoreInspectInterval:   pubsub.DefaultScoreInspectInterval,
+			RateLimits:             pubsub.DefaultRateLimitConfig(),
+			Sync:                   pubsub.DefaultSyncConfig(),
+			ProviderCatchUp:        true,
+			SeenMessagesTTL:        pubsub.DefaultSeenMessagesTTL,
 		},
 
 		DiscoveryConfig: DiscoveryConfig{
@@ -62,6 +173,52 @@ func DefaultConfig() *Config {
 			MDNSServiceName: "_llm-share._tcp",
 			Rendezvous:      "llm-share-p2p",
 		},
+
+		ProtocolConfig: ProtocolConfig{
+			SignProtocolMessages: true,
+			MaxClockSkew:         30 * time.Second,
+			ReplayWindow:         5 * time.Minute,
+			MaxVerifyFailures:    5,
+
+			ChunkSize:       256 * 1024,
+			ChunkThreshold:  1024 * 1024,
+			MaxTransferSize: 512 * 1024 * 1024,
+			TransferWindow:  8,
+
+			MaxPartialTransfers:        32,
+			MaxPartialTransfersPerPeer: 4,
+			MaxPartialTransferBytes:    1024 * 1024 * 1024,
+
+			EnableCompression:     true,
+			CompressionAlgorithms: []string{"zstd", "gzip"},
+			CompressionMinSize:    1024,
+			MaxDecompressedSize:   64 * 1024 * 1024,
+
+			HeartbeatInterval:   15 * time.Second,
+			HeartbeatTimeout:    5 * time.Second,
+			MaxMissedHeartbeats: 3,
+
+			RetryMaxAttempts:        4,
+			RetryInitialBackoff:     200 * time.Millisecond,
+			RetryMaxBackoff:         5 * time.Second,
+			RequestTimeout:          60 * time.Second,
+			BreakerFailureThreshold: 5,
+			BreakerCooldown:         30 * time.Second,
+			SelectionStrategy:       protocol.StrategyPowerOfTwo,
+			StickySessionTTL:        30 * time.Minute,
+
+			MaxInFlightPerStream:  8,
+			MaxInFlightPerPeer:    32,
+			MaxConcurrentHandlers: 256,
+			HandlerQueueTimeout:   5 * time.Second,
+			StreamReadTimeout:     2 * time.Minute,
+			StreamWriteTimeout:    30 * time.Second,
+			HandlerTimeout:        2 * time.Minute,
+		},
+
+		ProviderConfig: ProviderConfig{
+			BackendHealthInterval: 30 * time.Second,
+		},
 	}
 }
 
@@ -3,6 +3,7 @@ package node
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -15,6 +16,7 @@ import (
 	dhtopts "github.com/libp2p/go-libp2p-kad-dht/opts"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 
+	"github.com/your-org/p2p-network/pkg/backend"
 	"github.com/your-org/p2p-network/pkg/dht"
 	"github.com/your-org/p2p-network/pkg/pubsub"
 	"github.com/your-org/p2p-network/pkg/protocol"
@@ -27,6 +29,15 @@ type Node struct {
 	pubsub *pubsub.PubSubManager
 	proto  *protocol.Handler
 
+	metrics  *utils.Metrics
+	liveness *protocol.LivenessService
+	client   *protocol.Client
+	backends *backend.Registry
+
+	providers *pubsub.ProviderTable
+	announcer *pubsub.Announcer
+	rpc       *pubsub.RPC
+
 	ctx    context.Context
 	cancel context.CancelFunc
 	cfg    *Config
@@ -54,14 +65,20 @@ func NewNode(cfg *Config, opts ...Option) (*Node, error) {
 		n.logger = logger
 	}
 
+	// The node context outlives NewNode: the DHT and pubsub are created
+	// under it and end with Stop.
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
 	host, err := n.createHost()
 	if err != nil {
+		n.cancel()
 		return nil, fmt.Errorf("create host: %w", err)
 	}
 	n.host = host
 
 	dhtMgr, err := n.createDHT()
 	if err != nil {
+		n.cancel()
 		host.Close()
 		return nil, fmt.Errorf("create DHT: %w", err)
 	}
@@ -69,14 +86,55 @@ func NewNode(cfg *Config, opts ...Option) (*Node, error) {
 
 	pubSubMgr, err := n.createPubSub()
 	if err != nil {
+		n.cancel()
 		host.Close()
 		return nil, fmt.Errorf("create PubSub: %w", err)
 	}
 	n.pubsub = pubSubMgr
 
-	n.proto = protocol.NewHandler(n)
+	n.proto = protocol.NewHandler(n,
+		protocol.WithSecurityConfig(n.securityConfig()),
+		protocol.WithTransferConfig(n.transferConfig()),
+		protocol.WithCompressionConfig(n.compressionConfig()),
+		protocol.WithEncryptionConfig(protocol.EncryptionConfig{
+			Enabled:  n.cfg.EncryptPayloads,
+			Required: n.cfg.RequireEncryption,
+		}),
+		protocol.WithStreamConfig(n.streamConfig()),
+		protocol.WithMetrics(n.metrics),
+	)
+	n.proto.SetHost(n.host)
+	n.rpc = pubsub.NewRPC(n.pubsub, n.proto, n.host.ID())
+	n.pubsub.EnableSync(n.proto)
 
-	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.client = protocol.NewClient(n.proto, n.retryPolicy(), protocol.NewCircuitBreakers(protocol.BreakerConfig{
+		FailureThreshold: n.cfg.BreakerFailureThreshold,
+		Cooldown:         n.cfg.BreakerCooldown,
+	}))
+
+	strategy, err := protocol.NewStrategy(n.cfg.SelectionStrategy)
+	if err != nil {
+		n.cancel()
+		host.Close()
+		return nil, err
+	}
+	n.client.SetSelector(protocol.NewSelector(strategy, n.proto.Latency(), n.cfg.StickySessionTTL))
+
+	n.liveness = protocol.NewLivenessService(n.proto, n.livenessConfig())
+
+	if len(n.cfg.Backends) > 0 {
+		backends, err := backend.NewRegistry(n.cfg.Backends, n.cfg.BackendHealthInterval)
+		if err != nil {
+			n.cancel()
+			host.Close()
+			return nil, fmt.Errorf("create backends: %w", err)
+		}
+		n.backends = backends
+		n.proto.RegisterHandler(protocol.MsgTypeRequest, backends.HandleRequest)
+		n.announcer = pubsub.NewAnnouncer(n.pubsub, n.adverts, n.cfg.ProviderAdvertInterval, n.cfg.ProviderAdvertTTL)
+	}
+
+	n.providers = pubsub.NewProviderTable(n.cfg.ProviderAdvertTTL)
 
 	return n, nil
 }
@@ -121,19 +179,171 @@ func (n *Node) createDHT() (*dht.DHTManager, error) {
 }
 
 func (n *Node) createPubSub() (*pubsub.PubSubManager, error) {
-	ps, err := pubsub.NewPubSub(n.ctx, n.host,
-		pubsub.WithMessageSigning(true),
-		pubsub.WithStrictSignatureVerification(true),
+	return pubsub.New(n.ctx, n.host,
+		pubsub.WithTopicConfigs(n.topicConfigs()),
+		pubsub.WithMessageSigning(n.cfg.PubSubSignMessages),
+		pubsub.WithValidation(n.cfg.PubSubValidateMessages),
+		pubsub.WithPeerScoring(n.cfg.EnablePeerScoring, n.cfg.ScoreThresholds),
+		pubsub.WithScoreInspectInterval(n.cfg.ScoreInspectInterval),
+		pubsub.WithRateLimits(n.cfg.RateLimits),
+		pubsub.WithSyncConfig(n.cfg.Sync),
+		pubsub.WithSeenMessagesTTL(n.cfg.SeenMessagesTTL),
+		pubsub.WithMetrics(n.metrics),
 	)
-	if err != nil {
-		return nil, err
+}
+
+func (n *Node) topicConfigs() map[string]*pubsub.TopicConfig {
+	configs := n.cfg.TopicConfigs
+	if configs == nil {
+		configs = pubsub.DefaultTopicConfigs()
 	}
 
-	return pubsub.NewManager(ps), nil
+	for topic, score := range n.cfg.TopicScoreOverrides {
+		topicConfig(configs, topic).Score = score
+	}
+	for topic, limit := range n.cfg.PeerRateLimits {
+		topicConfig(configs, topic).PeerRateLimit = limit
+	}
+	for topic, limit := range n.cfg.TopicRateLimits {
+		topicConfig(configs, topic).TopicRateLimit = limit
+	}
+	for topic, fn := range n.cfg.MessageIDs {
+		topicConfig(configs, topic).MessageID = fn
+	}
+
+	for _, cfg := range configs {
+		if cfg.ValidatorTimeout <= 0 {
+			cfg.ValidatorTimeout = n.cfg.ValidatorTimeout
+		}
+		if cfg.ValidatorConcurrency <= 0 {
+			cfg.ValidatorConcurrency = n.cfg.ValidatorConcurrency
+		}
+	}
+	return configs
 }
 
+// topicConfig returns the config of topic in configs, adding an empty one
+// if there is none.
+func topicConfig(configs map[string]*pubsub.TopicConfig, topic string) *pubsub.TopicConfig {
+	cfg, ok := configs[topic]
+	if !ok {
+		cfg = &pubsub.TopicConfig{Name: topic}
+		configs[topic] = cfg
+	}
+	return cfg
+}
+
+func (n *Node) securityConfig() protocol.SecurityConfig {
+	return protocol.SecurityConfig{
+		SignMessages:      n.cfg.SignProtocolMessages,
+		MaxClockSkew:      n.cfg.MaxClockSkew,
+		ReplayWindow:      n.cfg.ReplayWindow,
+		MaxVerifyFailures: n.cfg.MaxVerifyFailures,
+	}
+}
+
+func (n *Node) transferConfig() protocol.TransferConfig {
+	cfg := protocol.DefaultTransferConfig()
+	if n.cfg.ChunkSize > 0 {
+		cfg.ChunkSize = n.cfg.ChunkSize
+	}
+	if n.cfg.ChunkThreshold > 0 {
+		cfg.ChunkThreshold = n.cfg.ChunkThreshold
+	}
+	if n.cfg.MaxTransferSize > 0 {
+		cfg.MaxTransferSize = n.cfg.MaxTransferSize
+	}
+	if n.cfg.TransferWindow > 0 {
+		cfg.Window = n.cfg.TransferWindow
+	}
+	if n.cfg.MaxPartialTransfers > 0 {
+		cfg.MaxPartial = n.cfg.MaxPartialTransfers
+	}
+	if n.cfg.MaxPartialTransfersPerPeer > 0 {
+		cfg.MaxPartialPerPeer = n.cfg.MaxPartialTransfersPerPeer
+	}
+	if n.cfg.MaxPartialTransferBytes > 0 {
+		cfg.MaxPartialBytes = n.cfg.MaxPartialTransferBytes
+	}
+	return cfg
+}
+
+func (n *Node) livenessConfig() protocol.LivenessConfig {
+	cfg := protocol.DefaultLivenessConfig()
+	if n.cfg.HeartbeatInterval > 0 {
+		cfg.Interval = n.cfg.HeartbeatInterval
+	}
+	if n.cfg.HeartbeatTimeout > 0 {
+		cfg.Timeout = n.cfg.HeartbeatTimeout
+	}
+	if n.cfg.MaxMissedHeartbeats > 0 {
+		cfg.MaxMissed = n.cfg.MaxMissedHeartbeats
+	}
+	return cfg
+}
+
+func (n *Node) compressionConfig() protocol.CompressionConfig {
+	cfg := protocol.DefaultCompressionConfig()
+	cfg.Enabled = n.cfg.EnableCompression
+	if len(n.cfg.CompressionAlgorithms) > 0 {
+		cfg.Algorithms = n.cfg.CompressionAlgorithms
+	}
+	if n.cfg.CompressionMinSize > 0 {
+		cfg.MinSize = n.cfg.CompressionMinSize
+	}
+	if n.cfg.MaxDecompressedSize > 0 {
+		cfg.MaxDecompressedSize = n.cfg.MaxDecompressedSize
+	}
+	return cfg
+}
+
+func (n *Node) streamConfig() protocol.StreamConfig {
+	cfg := protocol.DefaultStreamConfig()
+	if n.cfg.MaxInFlightPerStream > 0 {
+		cfg.MaxInFlightPerStream = n.cfg.MaxInFlightPerStream
+	}
+	if n.cfg.MaxInFlightPerPeer > 0 {
+		cfg.MaxInFlightPerPeer = n.cfg.MaxInFlightPerPeer
+	}
+	if n.cfg.MaxConcurrentHandlers > 0 {
+		cfg.MaxConcurrentHandlers = n.cfg.MaxConcurrentHandlers
+	}
+	if n.cfg.HandlerQueueTimeout > 0 {
+		cfg.QueueTimeout = n.cfg.HandlerQueueTimeout
+	}
+	if n.cfg.StreamReadTimeout > 0 {
+		cfg.ReadTimeout = n.cfg.StreamReadTimeout
+	}
+	if n.cfg.StreamWriteTimeout > 0 {
+		cfg.WriteTimeout = n.cfg.StreamWriteTimeout
+	}
+	if n.cfg.HandlerTimeout > 0 {
+		cfg.HandlerTimeout = n.cfg.HandlerTimeout
+	}
+	return cfg
+}
+
+func (n *Node) retryPolicy() protocol.RetryPolicy {
+	policy := protocol.DefaultRetryPolicy()
+	if n.cfg.RetryMaxAttempts > 0 {
+		policy.MaxAttempts = n.cfg.RetryMaxAttempts
+	}
+	if n.cfg.RetryInitialBackoff > 0 {
+		policy.InitialBackoff = n.cfg.RetryInitialBackoff
+	}
+	if n.cfg.RetryMaxBackoff > 0 {
+		policy.MaxBackoff = n.cfg.RetryMaxBackoff
+	}
+	if n.cfg.RequestTimeout > 0 {
+		policy.AttemptTimeout = n.cfg.RequestTimeout
+	}
+	return policy
+}
+
+// Start runs the node's services under the node context, which ends with
+// Stop or once ctx is done.
 func (n *Node) Start(ctx context.Context) error {
-	n.ctx, n.cancel = context.WithCancel(ctx)
+	context.AfterFunc(ctx, n.cancel)
 
 	if err := n.dht.Bootstrap(n.ctx); err != nil {
 		return fmt.Errorf("bootstrap DHT: %w", err)
@@ -153,7 +363,29 @@ func (n *Node) Start(ctx context.Context) error {
 		n.logger.Info("Connected to bootstrap peer", "peer", pi.ID)
 	}
 
-	n.host.SetStreamHandler(protocol.ProtocolID, n.proto.HandleStream)
+	if n.backends != nil {
+		n.backends.Start(n.ctx)
+	}
+
+	n.proto.Register()
+	n.liveness.Start(n.ctx)
+
+	var providerOpts []pubsub.SubscribeOption
+	if n.cfg.ProviderCatchUp {
+		providerOpts = append(providerOpts, pubsub.WithCatchUp(n.cfg.ProviderAdvertTTL))
+	}
+	if _, err := pubsub.ProviderTopic(n.pubsub).Subscribe(n.providers.Handle, providerOpts...); err != nil {
+		return fmt.Errorf("subscribe to provider adverts: %w", err)
+	}
+	n.providers.Start(n.ctx, n.advertInterval())
+	if n.announcer != nil {
+		n.announcer.Start(n.ctx, func(err error) {
+			n.logger.Warn("Failed to announce models", "error", err)
+		})
+	}
+	if n.backends != nil {
+		go n.provideModels()
+	}
 
 	n.logger.Info("Node started", "peerID", n.ID(), "addrs", n.Addrs())
 	return nil
@@ -161,8 +393,22 @@ func (n *Node) Start(ctx context.Context) error {
 
 func (n *Node) Stop(ctx context.Context) error {
 	n.cancel()
+	if n.announcer != nil {
+		n.announcer.Stop()
+	}
+	n.providers.Stop()
+	n.liveness.Stop()
+	if n.backends != nil {
+		n.backends.Stop()
+	}
+	if n.pubsub != nil {
+		if err := n.pubsub.Close(); err != nil {
+			n.logger.Warn("Failed to close pubsub", "error", err)
+		}
+	}
 
 	if n.host != nil {
+		n.proto.Unregister()
 		n.host.Close()
 	}
 
@@ -194,6 +440,12 @@ func (n *Node) PubSub() *pubsub.PubSubManager {
 	return n.pubsub
 }
 
+// RPC sends requests over TopicRequests and serves them, replying over
+// the request-response protocol where possible.
+func (n *Node) RPC() *pubsub.RPC {
+	return n.rpc
+}
+
 func (n *Node) Context() context.Context {
 	return n.ctx
 }
@@ -207,5 +459,107 @@ func (n *Node) Disconnect(ctx context.Context, p peer.ID) error {
 }
 
 func (n *Node) OpenStream(ctx context.Context, p peer.ID) (network.Stream, error) {
-	return n.host.NewStream(ctx, p, protocol.ProtocolID)
+	return n.proto.NewStream(ctx, p)
+}
+
+func (n *Node) Protocol() *protocol.Handler {
+	return n.proto
+}
+
+func (n *Node) PeerVersion(p peer.ID) (string, bool) {
+	return n.proto.PeerVersion(p)
+}
+
+func (n *Node) Client() *protocol.Client {
+	return n.client
+}
+
+// Request sends req to one of providers, retrying and failing over according
+// to the node's retry policy, and returns the response and the provider that
+// served it.
+func (n *Node) Request(ctx context.Context, providers []peer.ID, req *protocol.Request) (*protocol.Response, peer.ID, error) {
+	return n.client.Do(ctx, providers, req)
+}
+
+// RequestSelect picks among candidates with the node's selection strategy,
+// keeping requests of the same session on one provider where possible.
+func (n *Node) RequestSelect(ctx context.Context, candidates []protocol.ProviderCandidate, session string, req *protocol.Request) (*protocol.Response, peer.ID, error) {
+	return n.client.DoSelect(ctx, candidates, session, req)
+}
+
+// ProviderTable returns the providers other peers have announced.
+func (n *Node) ProviderTable() *pubsub.ProviderTable {
+	return n.providers
+}
+
+func (n *Node) advertInterval() time.Duration {
+	if n.cfg.ProviderAdvertInterval > 0 {
+		return n.cfg.ProviderAdvertInterval
+	}
+	return pubsub.DefaultAdvertInterval
+}
+
+// modelReprovideInterval is how often served models are provided again in
+// the DHT, well within the lifetime of provider records.
+const modelReprovideInterval = 12 * time.Hour
+
+// provideModels makes the node findable under dht.ModelKey for each model
+// it serves, for peers that have not seen its adverts.
+func (n *Node) provideModels() {
+	ticker := time.NewTicker(modelReprovideInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, model := range n.backends.Models() {
+			if err := n.dht.Provide(n.ctx, dht.ModelKey(model)); err != nil && n.ctx.Err() == nil {
+				n.logger.Warn("Failed to provide model in DHT", "model", model, "error", err)
+			}
+		}
+
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// adverts describes the healthy locally served models for the announcer.
+func (n *Node) adverts() []*pubsub.ProviderMessage {
+	var adverts []*pubsub.ProviderMessage
+	for _, model := range n.backends.Models() {
+		status, ok := n.backends.Status(model)
+		if !ok || !status.Healthy {
+			continue
+		}
+
+		adverts = append(adverts, &pubsub.ProviderMessage{
+			Model:      model,
+			Protocols:  protocol.SupportedProtocolIDs(),
+			Capacity:   status.Capacity,
+			Load:       status.InFlight,
+			Price:      status.Price,
+			QueueDepth: status.Queued,
+			QueueWait:  status.AvgWait,
+		})
+	}
+	return adverts
+}
+
+// Backends returns the registry of locally served models, or nil when the
+// node serves none.
+func (n *Node) Backends() *backend.Registry {
+	return n.backends
+}
+
+func (n *Node) LatencyTable() *protocol.LatencyTable {
+	return n.proto.Latency()
+}
+
+func (n *Node) PeerLatency(p peer.ID) (protocol.PeerLatency, bool) {
+	return n.proto.Latency().Get(p)
+}
+
+func (n *Node) LivenessEvents() <-chan protocol.LivenessEvent {
+	return n.liveness.Events()
 }
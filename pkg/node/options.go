@@ -13,6 +13,12 @@ func WithLogger(logger *utils.Logger) Option {
 	}
 }
 
+func WithMetrics(metrics *utils.Metrics) Option {
+	return func(n *Node) {
+		n.metrics = metrics
+	}
+}
+
 func WithConfig(cfg *Config) Option {
 	return func(n *Node) {
 		n.cfg = cfg
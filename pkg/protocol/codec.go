@@ -0,0 +1,363 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/your-org/p2p-network/pkg/wire"
+)
+
+// Payloads are encoded with the protobuf schema in pkg/wire. Decoders also
+// accept the JSON encoding used before the schema existed, which
+// wire.EncodeJSON produces for debugging.
+
+func (r *Request) ToWire() *wire.Request {
+	return &wire.Request{
+		Method:    r.Method,
+		Model:     r.Model,
+		Params:    r.Params,
+		Id:        r.ID,
+		Timestamp: r.Timestamp,
+		Priority:  int32(r.Priority),
+		Stream:    r.Stream,
+	}
+}
+
+func RequestFromWire(pb *wire.Request) *Request {
+	return &Request{
+		Method:    pb.GetMethod(),
+		Model:     pb.GetModel(),
+		Params:    pb.GetParams(),
+		ID:        pb.GetId(),
+		Timestamp: pb.GetTimestamp(),
+		Priority:  int(pb.GetPriority()),
+		Stream:    pb.GetStream(),
+	}
+}
+
+func EncodeRequest(r *Request) ([]byte, error) {
+	return proto.Marshal(r.ToWire())
+}
+
+func DecodeRequest(data []byte) (*Request, error) {
+	var req Request
+	var pb wire.Request
+	legacy, err := wire.Decode(data, &req, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &req, nil
+	}
+	return RequestFromWire(&pb), nil
+}
+
+func (r *Response) ToWire() *wire.Response {
+	pb := &wire.Response{
+		Id:        r.ID,
+		Result:    r.Result,
+		Timestamp: r.Timestamp,
+	}
+	if r.Error != nil {
+		pb.Error = &wire.Error{
+			Code:         int32(r.Error.Code),
+			Message:      r.Error.Message,
+			RetryAfterMs: r.Error.RetryAfter.Milliseconds(),
+		}
+	}
+	return pb
+}
+
+func ResponseFromWire(pb *wire.Response) *Response {
+	resp := &Response{
+		ID:        pb.GetId(),
+		Result:    pb.GetResult(),
+		Timestamp: pb.GetTimestamp(),
+	}
+	if pb.GetError() != nil {
+		resp.Error = &Error{
+			Code:       int(pb.GetError().GetCode()),
+			Message:    pb.GetError().GetMessage(),
+			RetryAfter: time.Duration(pb.GetError().GetRetryAfterMs()) * time.Millisecond,
+		}
+	}
+	return resp
+}
+
+func EncodeResponse(r *Response) ([]byte, error) {
+	return proto.Marshal(r.ToWire())
+}
+
+func DecodeResponse(data []byte) (*Response, error) {
+	var resp Response
+	var pb wire.Response
+	legacy, err := wire.Decode(data, &resp, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &resp, nil
+	}
+	return ResponseFromWire(&pb), nil
+}
+
+func (h *Heartbeat) ToWire() *wire.Heartbeat {
+	return &wire.Heartbeat{
+		PeerId:    h.PeerID,
+		Timestamp: h.Timestamp,
+		Address:   h.Address,
+	}
+}
+
+func HeartbeatFromWire(pb *wire.Heartbeat) *Heartbeat {
+	return &Heartbeat{
+		PeerID:    pb.GetPeerId(),
+		Timestamp: pb.GetTimestamp(),
+		Address:   pb.GetAddress(),
+	}
+}
+
+func EncodeHeartbeat(h *Heartbeat) ([]byte, error) {
+	return proto.Marshal(h.ToWire())
+}
+
+func DecodeHeartbeat(data []byte) (*Heartbeat, error) {
+	var hb Heartbeat
+	var pb wire.Heartbeat
+	legacy, err := wire.Decode(data, &hb, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &hb, nil
+	}
+	return HeartbeatFromWire(&pb), nil
+}
+
+func (p *ProviderInfo) ToWire() (*wire.ProviderInfo, error) {
+	pb := &wire.ProviderInfo{
+		PeerId:      p.PeerID,
+		Model:       p.Model,
+		Address:     p.Address,
+		Protocols:   p.Protocols,
+		LastSeen:    p.LastSeen,
+		Capacity:    int32(p.Capacity),
+		Load:        int32(p.Load),
+		Price:       p.Price,
+		QueueDepth:  int32(p.QueueDepth),
+		QueueWaitMs: p.QueueWait.Milliseconds(),
+	}
+	if len(p.Metadata) > 0 {
+		metadata, err := structpb.NewStruct(p.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("encode provider metadata: %w", err)
+		}
+		pb.Metadata = metadata
+	}
+	return pb, nil
+}
+
+func ProviderInfoFromWire(pb *wire.ProviderInfo) *ProviderInfo {
+	info := &ProviderInfo{
+		PeerID:     pb.GetPeerId(),
+		Model:      pb.GetModel(),
+		Address:    pb.GetAddress(),
+		Protocols:  pb.GetProtocols(),
+		LastSeen:   pb.GetLastSeen(),
+		Capacity:   int(pb.GetCapacity()),
+		Load:       int(pb.GetLoad()),
+		Price:      pb.GetPrice(),
+		QueueDepth: int(pb.GetQueueDepth()),
+		QueueWait:  time.Duration(pb.GetQueueWaitMs()) * time.Millisecond,
+	}
+	if pb.GetMetadata() != nil {
+		info.Metadata = pb.GetMetadata().AsMap()
+	}
+	return info
+}
+
+func EncodeProviderInfo(p *ProviderInfo) ([]byte, error) {
+	pb, err := p.ToWire()
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(pb)
+}
+
+func DecodeProviderInfo(data []byte) (*ProviderInfo, error) {
+	var info ProviderInfo
+	var pb wire.ProviderInfo
+	legacy, err := wire.Decode(data, &info, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &info, nil
+	}
+	return ProviderInfoFromWire(&pb), nil
+}
+
+func EncodeVersionRequest(r *VersionRequest) ([]byte, error) {
+	return proto.Marshal(&wire.VersionRequest{
+		Protocols:   r.Protocols,
+		Compression: r.Compression,
+	})
+}
+
+func DecodeVersionRequest(data []byte) (*VersionRequest, error) {
+	var req VersionRequest
+	var pb wire.VersionRequest
+	legacy, err := wire.Decode(data, &req, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &req, nil
+	}
+	return &VersionRequest{
+		Protocols:   pb.GetProtocols(),
+		Compression: pb.GetCompression(),
+	}, nil
+}
+
+func EncodeVersionResponse(r *VersionResponse) ([]byte, error) {
+	return proto.Marshal(&wire.VersionResponse{
+		SelectedVersion: r.SelectedVersion,
+		Success:         r.Success,
+		Error:           r.Error,
+		Compression:     r.Compression,
+	})
+}
+
+func DecodeVersionResponse(data []byte) (*VersionResponse, error) {
+	var resp VersionResponse
+	var pb wire.VersionResponse
+	legacy, err := wire.Decode(data, &resp, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &resp, nil
+	}
+	return &VersionResponse{
+		SelectedVersion: pb.GetSelectedVersion(),
+		Success:         pb.GetSuccess(),
+		Error:           pb.GetError(),
+		Compression:     pb.GetCompression(),
+	}, nil
+}
+
+func EncodeTransferManifest(m *TransferManifest) ([]byte, error) {
+	return proto.Marshal(&wire.TransferManifest{
+		TransferId: m.TransferID,
+		Type:       uint32(m.Type),
+		RequestId:  m.RequestID,
+		TotalSize:  m.TotalSize,
+		ChunkSize:  int32(m.ChunkSize),
+		ChunkCount: int32(m.ChunkCount),
+		Hash:       m.Hash,
+		Flags:      uint32(m.Flags),
+	})
+}
+
+func DecodeTransferManifest(data []byte) (*TransferManifest, error) {
+	var m TransferManifest
+	var pb wire.TransferManifest
+	legacy, err := wire.Decode(data, &m, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &m, nil
+	}
+	return &TransferManifest{
+		TransferID: pb.GetTransferId(),
+		Type:       MessageType(pb.GetType()),
+		RequestID:  pb.GetRequestId(),
+		TotalSize:  pb.GetTotalSize(),
+		ChunkSize:  int(pb.GetChunkSize()),
+		ChunkCount: int(pb.GetChunkCount()),
+		Hash:       pb.GetHash(),
+		Flags:      uint8(pb.GetFlags()),
+	}, nil
+}
+
+func EncodeChunk(c *Chunk) ([]byte, error) {
+	return proto.Marshal(&wire.Chunk{
+		TransferId: c.TransferID,
+		Index:      int32(c.Index),
+		Hash:       c.Hash,
+		Data:       c.Data,
+	})
+}
+
+func DecodeChunk(data []byte) (*Chunk, error) {
+	var c Chunk
+	var pb wire.Chunk
+	legacy, err := wire.Decode(data, &c, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &c, nil
+	}
+	return &Chunk{
+		TransferID: pb.GetTransferId(),
+		Index:      int(pb.GetIndex()),
+		Hash:       pb.GetHash(),
+		Data:       pb.GetData(),
+	}, nil
+}
+
+func EncodeTransferAck(a *TransferAck) ([]byte, error) {
+	return proto.Marshal(&wire.TransferAck{
+		TransferId: a.TransferID,
+		NextChunk:  int32(a.NextChunk),
+		Complete:   a.Complete,
+		Error:      a.Error,
+	})
+}
+
+func DecodeTransferAck(data []byte) (*TransferAck, error) {
+	var a TransferAck
+	var pb wire.TransferAck
+	legacy, err := wire.Decode(data, &a, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &a, nil
+	}
+	return &TransferAck{
+		TransferID: pb.GetTransferId(),
+		NextChunk:  int(pb.GetNextChunk()),
+		Complete:   pb.GetComplete(),
+		Error:      pb.GetError(),
+	}, nil
+}
+
+func EncodeQueueStatus(q *QueueStatus) ([]byte, error) {
+	return proto.Marshal(&wire.QueueStatus{
+		RequestId:       q.RequestID,
+		Position:        int32(q.Position),
+		Depth:           int32(q.Depth),
+		EstimatedWaitMs: q.EstimatedWait.Milliseconds(),
+	})
+}
+
+func DecodeQueueStatus(data []byte) (*QueueStatus, error) {
+	var pb wire.QueueStatus
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return nil, fmt.Errorf("decode protobuf: %w", err)
+	}
+
+	return &QueueStatus{
+		RequestID:     pb.GetRequestId(),
+		Position:      int(pb.GetPosition()),
+		Depth:         int(pb.GetDepth()),
+		EstimatedWait: time.Duration(pb.GetEstimatedWaitMs()) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,217 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+const (
+	FlagCompressedGzip uint8 = 1 << iota
+	FlagCompressedZstd
+
+	flagCompressionMask = FlagCompressedGzip | FlagCompressedZstd
+)
+
+var SupportedCompression = []string{CompressionZstd, CompressionGzip}
+
+var ErrDecompressedTooLarge = errors.New("decompressed payload exceeds maximum size")
+
+// zstd encoders and decoders are expensive to create, so one encoder is
+// shared and decoders are pooled by their maximum decoded size. Both are
+// safe for concurrent use through EncodeAll and DecodeAll.
+var (
+	zstdEncoder  = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+	zstdDecoders sync.Map
+)
+
+type CompressionConfig struct {
+	Enabled             bool
+	Algorithms          []string
+	MinSize             int
+	MaxDecompressedSize int64
+}
+
+func DefaultCompressionConfig() CompressionConfig {
+	return CompressionConfig{
+		Enabled:             true,
+		Algorithms:          SupportedCompression,
+		MinSize:             1024,
+		MaxDecompressedSize: 64 * 1024 * 1024,
+	}
+}
+
+func (c CompressionConfig) supports(algorithm string) bool {
+	if !c.Enabled {
+		return false
+	}
+	for _, a := range c.Algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateCompression picks the first algorithm in the remote preference
+// list that is also enabled locally.
+func (c CompressionConfig) NegotiateCompression(remote []string) string {
+	for _, algorithm := range remote {
+		if c.supports(algorithm) {
+			return algorithm
+		}
+	}
+	return CompressionNone
+}
+
+func (c CompressionConfig) offered() []string {
+	if !c.Enabled {
+		return nil
+	}
+	return c.Algorithms
+}
+
+func compressionFlag(algorithm string) (uint8, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return FlagCompressedGzip, nil
+	case CompressionZstd:
+		return FlagCompressedZstd, nil
+	default:
+		return 0, fmt.Errorf("unsupported compression: %q", algorithm)
+	}
+}
+
+func Compress(algorithm string, data []byte) ([]byte, uint8, error) {
+	flag, err := compressionFlag(algorithm)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if flag == FlagCompressedZstd {
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, 0, err
+		}
+		return enc.EncodeAll(data, nil), flag, nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	return buf.Bytes(), flag, nil
+}
+
+func Decompress(flags uint8, data []byte, maxSize int64) ([]byte, error) {
+	var r io.Reader
+	switch flags & flagCompressionMask {
+	case 0:
+		return data, nil
+	case FlagCompressedGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case FlagCompressedZstd:
+		return decompressZstd(data, maxSize)
+	default:
+		return nil, fmt.Errorf("invalid compression flags: %#x", flags)
+	}
+
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && int64(len(out)) > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+
+	return out, nil
+}
+
+func decompressZstd(data []byte, maxSize int64) ([]byte, error) {
+	pool, _ := zstdDecoders.LoadOrStore(maxSize, &sync.Pool{})
+	dec, ok := pool.(*sync.Pool).Get().(*zstd.Decoder)
+	if !ok {
+		opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if maxSize > 0 {
+			opts = append(opts, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		}
+
+		var err error
+		dec, err = zstd.NewReader(nil, opts...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer pool.(*sync.Pool).Put(dec)
+
+	out, err := dec.DecodeAll(data, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, ErrDecompressedTooLarge
+	}
+	return out, err
+}
+
+func (h *Handler) compressMessage(p peer.ID, msg *Message) error {
+	if msg.Flags&(flagCompressionMask|FlagEncrypted) != 0 || len(msg.Payload) < h.compression.MinSize {
+		return nil
+	}
+
+	algorithm := h.versions.Compression(p)
+	if algorithm == CompressionNone || !h.compression.supports(algorithm) {
+		return nil
+	}
+
+	compressed, flag, err := Compress(algorithm, msg.Payload)
+	if err != nil {
+		return err
+	}
+	if len(compressed) >= len(msg.Payload) {
+		return nil
+	}
+
+	msg.Payload = compressed
+	msg.Flags |= flag
+	return nil
+}
+
+func (h *Handler) decompressMessage(msg *Message) error {
+	if msg.Flags&flagCompressionMask == 0 {
+		return nil
+	}
+
+	payload, err := Decompress(msg.Flags, msg.Payload, h.compression.MaxDecompressedSize)
+	if err != nil {
+		return fmt.Errorf("decompress payload: %w", err)
+	}
+
+	msg.Payload = payload
+	msg.Flags &^= flagCompressionMask
+	return nil
+}
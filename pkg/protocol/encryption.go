@@ -0,0 +1,364 @@
+package protocol
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/your-org/p2p-network/pkg/utils"
+	"github.com/your-org/p2p-network/pkg/wire"
+)
+
+// FlagEncrypted marks a payload sealed to the receiving peer. Ciphertext does
+// not compress, so encrypted payloads are never compressed.
+const FlagEncrypted uint8 = 1 << 2
+
+const (
+	sealKeySize     = 32
+	sealInfoRequest = "llm-share/e2e/v1 request"
+	sealInfoReply   = "llm-share/e2e/v1 reply"
+)
+
+var (
+	ErrUnsupportedKeyType = errors.New("key type does not support encryption")
+	ErrDecryptFailed      = errors.New("cannot decrypt payload")
+	ErrPlaintextReply     = errors.New("peer answered an encrypted request in plaintext")
+	ErrEncryptionRequired = errors.New("encrypted requests required")
+)
+
+// EncryptionConfig controls end-to-end encryption of request payloads.
+// Enabled seals outgoing requests to the provider's identity key; Required
+// makes the provider refuse requests that were not sealed.
+type EncryptionConfig struct {
+	Enabled  bool
+	Required bool
+}
+
+func DefaultEncryptionConfig() EncryptionConfig {
+	return EncryptionConfig{}
+}
+
+func WithEncryptionConfig(cfg EncryptionConfig) HandlerOption {
+	return func(h *Handler) {
+		h.encryption = cfg
+	}
+}
+
+// ReplyKey seals the reply to a sealed request. Both sides derive it from
+// the request's key exchange, so only the requester can open the reply.
+type ReplyKey struct {
+	key []byte
+}
+
+func (k *ReplyKey) Seal(payload, aad []byte) ([]byte, error) {
+	ciphertext, err := utils.Seal(k.key, payload, aad)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&wire.Sealed{Ciphertext: ciphertext})
+}
+
+func (k *ReplyKey) Open(sealed, aad []byte) ([]byte, error) {
+	var pb wire.Sealed
+	if err := proto.Unmarshal(sealed, &pb); err != nil {
+		return nil, fmt.Errorf("decode sealed payload: %w", err)
+	}
+
+	payload, err := utils.Open(k.key, pb.GetCiphertext(), aad)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return payload, nil
+}
+
+// SealPayload encrypts payload so that only the holder of recipient's
+// private key can read it: an ephemeral key is agreed with the recipient's
+// identity key, and the shared secret keys AES-GCM through HKDF.
+func SealPayload(recipient crypto.PubKey, payload, aad []byte) ([]byte, *ReplyKey, error) {
+	ephemeral, secret, err := encapsulate(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	requestKey, replyKey := sealKeys(secret, ephemeral)
+	ciphertext, err := utils.Seal(requestKey, payload, aad)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealed, err := proto.Marshal(&wire.Sealed{EphemeralKey: ephemeral, Ciphertext: ciphertext})
+	if err != nil {
+		return nil, nil, err
+	}
+	return sealed, replyKey, nil
+}
+
+// OpenPayload decrypts a payload sealed to key by SealPayload.
+func OpenPayload(key crypto.PrivKey, sealed, aad []byte) ([]byte, *ReplyKey, error) {
+	var pb wire.Sealed
+	if err := proto.Unmarshal(sealed, &pb); err != nil {
+		return nil, nil, fmt.Errorf("decode sealed payload: %w", err)
+	}
+
+	secret, err := decapsulate(key, pb.GetEphemeralKey())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	requestKey, replyKey := sealKeys(secret, pb.GetEphemeralKey())
+	payload, err := utils.Open(requestKey, pb.GetCiphertext(), aad)
+	if err != nil {
+		return nil, nil, ErrDecryptFailed
+	}
+	return payload, replyKey, nil
+}
+
+func sealKeys(secret, ephemeral []byte) ([]byte, *ReplyKey) {
+	request := utils.DeriveKey(secret, ephemeral, []byte(sealInfoRequest), sealKeySize)
+	reply := utils.DeriveKey(secret, ephemeral, []byte(sealInfoReply), sealKeySize)
+	return request, &ReplyKey{key: reply}
+}
+
+// encapsulate generates an ephemeral key on the curve of the recipient's
+// identity key and returns its public half with the shared secret.
+func encapsulate(recipient crypto.PubKey) ([]byte, []byte, error) {
+	raw, err := recipient.Raw()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch recipient.Type() {
+	case crypto.Ed25519:
+		pub, err := utils.Ed25519PublicKeyToX25519(ed25519.PublicKey(raw))
+		if err != nil {
+			return nil, nil, err
+		}
+		return ecdhEncapsulate(pub)
+
+	case crypto.ECDSA:
+		parsed, err := x509.ParsePKIXPublicKey(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		ecdsaPub, ok := parsed.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, nil, ErrUnsupportedKeyType
+		}
+		pub, err := ecdsaPub.ECDH()
+		if err != nil {
+			return nil, nil, err
+		}
+		return ecdhEncapsulate(pub)
+
+	case crypto.Secp256k1:
+		pub, err := ethcrypto.DecompressPubkey(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		ephemeral, err := ethcrypto.GenerateKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		secret, err := utils.SharedSecretSecp256k1(ephemeral, pub)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ethcrypto.FromECDSAPub(&ephemeral.PublicKey), secret, nil
+
+	default:
+		return nil, nil, ErrUnsupportedKeyType
+	}
+}
+
+func ecdhEncapsulate(pub *ecdh.PublicKey) ([]byte, []byte, error) {
+	ephemeral, err := pub.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ephemeral.PublicKey().Bytes(), secret, nil
+}
+
+// decapsulate recovers the shared secret from the sender's ephemeral key
+// using the local identity key.
+func decapsulate(key crypto.PrivKey, ephemeral []byte) ([]byte, error) {
+	raw, err := key.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.Type() {
+	case crypto.Ed25519:
+		priv, err := utils.Ed25519PrivateKeyToX25519(ed25519.PrivateKey(raw))
+		if err != nil {
+			return nil, err
+		}
+		return ecdhDecapsulate(priv, ephemeral)
+
+	case crypto.ECDSA:
+		ecdsaPriv, err := x509.ParseECPrivateKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		priv, err := ecdsaPriv.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		return ecdhDecapsulate(priv, ephemeral)
+
+	case crypto.Secp256k1:
+		priv, err := ethcrypto.ToECDSA(raw)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := ethcrypto.UnmarshalPubkey(ephemeral)
+		if err != nil {
+			return nil, fmt.Errorf("ephemeral key: %w", err)
+		}
+		return utils.SharedSecretSecp256k1(priv, pub)
+
+	default:
+		return nil, ErrUnsupportedKeyType
+	}
+}
+
+func ecdhDecapsulate(priv *ecdh.PrivateKey, ephemeral []byte) ([]byte, error) {
+	pub, err := priv.Curve().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("ephemeral key: %w", err)
+	}
+	return priv.ECDH(pub)
+}
+
+// sealAAD binds a sealed payload to the frame carrying it.
+func sealAAD(msg *Message) []byte {
+	return append([]byte{byte(msg.Type)}, msg.RequestID...)
+}
+
+// PeerPublicKey returns the identity key of p from the peerstore, falling
+// back to the key embedded in the peer ID.
+func (h *Handler) PeerPublicKey(p peer.ID) (crypto.PubKey, error) {
+	if h.host != nil {
+		if pub := h.host.Peerstore().PubKey(p); pub != nil {
+			return pub, nil
+		}
+	}
+
+	pub, err := p.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("public key for %s: %w", p, err)
+	}
+	return pub, nil
+}
+
+func (h *Handler) privateKey() (crypto.PrivKey, error) {
+	if h.host == nil {
+		return nil, fmt.Errorf("no host")
+	}
+
+	key := h.host.Peerstore().PrivKey(h.host.ID())
+	if key == nil {
+		return nil, fmt.Errorf("no private key for local peer %s", h.host.ID())
+	}
+	return key, nil
+}
+
+// sealRequest seals a request frame to p when encryption is enabled.
+func (h *Handler) sealRequest(p peer.ID, msg *Message) (*Message, *ReplyKey, error) {
+	if !h.encryption.Enabled || msg.Type != MsgTypeRequest || msg.Flags&FlagEncrypted != 0 {
+		return msg, nil, nil
+	}
+
+	pub, err := h.PeerPublicKey(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, replyKey, err := SealPayload(pub, msg.Payload, sealAAD(msg))
+	if err != nil {
+		return nil, nil, fmt.Errorf("seal request for %s: %w", p, err)
+	}
+
+	sealed := *msg
+	sealed.Payload = payload
+	sealed.Flags |= FlagEncrypted
+	return &sealed, replyKey, nil
+}
+
+// openReply decrypts the reply to a sealed request. A plaintext reply is
+// only accepted when it reports an error, such as a busy rejection issued
+// before the request was opened.
+func openReply(replyKey *ReplyKey, resp *Message) (*Message, error) {
+	if replyKey == nil {
+		return resp, nil
+	}
+
+	if resp.Flags&FlagEncrypted == 0 {
+		if decoded, err := DecodeResponse(resp.Payload); err == nil && decoded.Error != nil {
+			return resp, nil
+		}
+		return nil, ErrPlaintextReply
+	}
+
+	payload, err := replyKey.Open(resp.Payload, sealAAD(resp))
+	if err != nil {
+		return nil, err
+	}
+
+	opened := *resp
+	opened.Payload = payload
+	opened.Flags &^= FlagEncrypted
+	return &opened, nil
+}
+
+// openRequest decrypts a sealed inbound request in place and returns the key
+// for its reply, or rejects plaintext requests when encryption is required.
+func (h *Handler) openRequest(msg *Message) (*ReplyKey, error) {
+	if msg.Flags&FlagEncrypted == 0 {
+		if h.encryption.Required && msg.Type == MsgTypeRequest {
+			return nil, ErrEncryptionRequired
+		}
+		return nil, nil
+	}
+
+	key, err := h.privateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, replyKey, err := OpenPayload(key, msg.Payload, sealAAD(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Payload = payload
+	msg.Flags &^= FlagEncrypted
+	return replyKey, nil
+}
+
+func sealReply(replyKey *ReplyKey, resp *Message) error {
+	if replyKey == nil {
+		return nil
+	}
+
+	payload, err := replyKey.Seal(resp.Payload, sealAAD(resp))
+	if err != nil {
+		return err
+	}
+
+	resp.Payload = payload
+	resp.Flags |= FlagEncrypted
+	return nil
+}
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+type FanOutOptions struct {
+	Parallelism int
+	PeerTimeout time.Duration
+}
+
+func DefaultFanOutOptions() FanOutOptions {
+	return FanOutOptions{
+		Parallelism: 16,
+		PeerTimeout: 10 * time.Second,
+	}
+}
+
+type PeerResult struct {
+	Peer     peer.ID
+	Response *Message
+	Err      error
+	Latency  time.Duration
+}
+
+func (r *PeerResult) OK() bool {
+	return r.Err == nil
+}
+
+type sendFunc func(ctx context.Context, p peer.ID, msg *Message) (*Message, error)
+
+// Broadcast sends msg to every peer without waiting for replies and returns
+// the outcome for each peer.
+func (h *Handler) Broadcast(ctx context.Context, peers []peer.ID, msg *Message, opts FanOutOptions) map[peer.ID]*PeerResult {
+	return h.fanOut(ctx, peers, msg, opts, func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		return nil, h.SendMessage(ctx, p, msg)
+	}, 0)
+}
+
+// FanOut sends msg as a request to every peer and returns each peer's
+// response, error and latency.
+func (h *Handler) FanOut(ctx context.Context, peers []peer.ID, msg *Message, opts FanOutOptions) map[peer.ID]*PeerResult {
+	return h.fanOut(ctx, peers, msg, opts, h.SendRequest, 0)
+}
+
+// Quorum sends msg as a request to peers and returns as soon as n of them
+// have answered successfully, cancelling the requests still in flight.
+func (h *Handler) Quorum(ctx context.Context, peers []peer.ID, msg *Message, n int, opts FanOutOptions) ([]*PeerResult, error) {
+	if n <= 0 || n > len(peers) {
+		return nil, fmt.Errorf("quorum of %d not reachable with %d peers", n, len(peers))
+	}
+
+	results := h.fanOut(ctx, peers, msg, opts, h.SendRequest, n)
+
+	successes := make([]*PeerResult, 0, n)
+	var lastErr error
+	for _, r := range results {
+		if r.OK() {
+			successes = append(successes, r)
+		} else {
+			lastErr = r.Err
+		}
+	}
+
+	if len(successes) < n {
+		return successes, fmt.Errorf("quorum not reached: %d of %d succeeded: %w", len(successes), n, lastErr)
+	}
+
+	return successes[:n], nil
+}
+
+// fanOut runs send against peers with at most opts.Parallelism requests in
+// flight. When quorum is positive it stops launching requests and cancels
+// outstanding ones once that many have succeeded.
+func (h *Handler) fanOut(ctx context.Context, peers []peer.ID, msg *Message, opts FanOutOptions, send sendFunc, quorum int) map[peer.ID]*PeerResult {
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = len(peers)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		succeeded int
+		results   = make(map[peer.ID]*PeerResult, len(peers))
+		sem       = make(chan struct{}, opts.Parallelism)
+	)
+
+	for _, p := range peers {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			if quorum == 0 {
+				mu.Lock()
+				results[p] = &PeerResult{Peer: p, Err: ctx.Err()}
+				mu.Unlock()
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			peerCtx := ctx
+			if opts.PeerTimeout > 0 {
+				var peerCancel context.CancelFunc
+				peerCtx, peerCancel = context.WithTimeout(ctx, opts.PeerTimeout)
+				defer peerCancel()
+			}
+
+			peerMsg := *msg
+			start := time.Now()
+			resp, err := send(peerCtx, p, &peerMsg)
+			result := &PeerResult{
+				Peer:     p,
+				Response: resp,
+				Err:      err,
+				Latency:  time.Since(start),
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if quorum > 0 && succeeded >= quorum {
+				return
+			}
+			results[p] = result
+			if err == nil {
+				succeeded++
+				if quorum > 0 && succeeded >= quorum {
+					cancel()
+				}
+			}
+		}(p)
+	}
+
+	wg.Wait()
+	return results
+}
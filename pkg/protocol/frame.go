@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/your-org/p2p-network/pkg/wire"
+)
+
+// Streams of FramingVersion and later carry wire.Envelope frames, each
+// prefixed with its length. Streams of earlier versions carry Messages as
+// JSON, which is kept for those peers only.
+
+const FramingVersion = "1.2.0"
+
+// MaxFrameSize bounds a single frame. Larger messages are sent as chunked
+// transfers.
+const MaxFrameSize = 64 * 1024 * 1024
+
+type frameDecoder interface {
+	Decode(msg *Message) error
+}
+
+type frameEncoder interface {
+	Encode(msg *Message) error
+}
+
+// streamFrames returns the frame decoder and encoder for stream, whose
+// protocol ID selects the framing.
+func streamFrames(stream network.Stream) (frameDecoder, frameEncoder) {
+	version, err := ParseVersion(string(stream.Protocol()))
+	if err != nil {
+		version = MinSupportedVersion
+	}
+	return newFrames(stream, version)
+}
+
+func newFrames(rw io.ReadWriter, version string) (frameDecoder, frameEncoder) {
+	if CompareVersions(version, FramingVersion) < 0 {
+		return jsonDecoder{json.NewDecoder(rw)}, jsonEncoder{json.NewEncoder(rw)}
+	}
+	return protoDecoder{bufio.NewReader(rw)}, protoEncoder{rw}
+}
+
+type protoDecoder struct {
+	r *bufio.Reader
+}
+
+func (d protoDecoder) Decode(msg *Message) error {
+	var env wire.Envelope
+	if err := wire.ReadFrame(d.r, &env, MaxFrameSize); err != nil {
+		return err
+	}
+	*msg = *MessageFromWire(&env)
+	return nil
+}
+
+type protoEncoder struct {
+	w io.Writer
+}
+
+func (e protoEncoder) Encode(msg *Message) error {
+	return wire.WriteFrame(e.w, msg.ToWire())
+}
+
+type jsonDecoder struct {
+	d *json.Decoder
+}
+
+func (d jsonDecoder) Decode(msg *Message) error {
+	return d.d.Decode(msg)
+}
+
+type jsonEncoder struct {
+	e *json.Encoder
+}
+
+func (e jsonEncoder) Encode(msg *Message) error {
+	return e.e.Encode(msg)
+}
+
+func (m *Message) ToWire() *wire.Envelope {
+	return &wire.Envelope{
+		Type:      uint32(m.Type),
+		Flags:     uint32(m.Flags),
+		RequestId: m.RequestID,
+		Payload:   m.Payload,
+		Signature: m.Signature,
+		Timestamp: m.Timestamp,
+	}
+}
+
+func MessageFromWire(env *wire.Envelope) *Message {
+	return &Message{
+		Type:      MessageType(env.GetType()),
+		Flags:     uint8(env.GetFlags()),
+		RequestID: env.GetRequestId(),
+		Payload:   env.GetPayload(),
+		Signature: env.GetSignature(),
+		Timestamp: env.GetTimestamp(),
+	}
+}
@@ -2,15 +2,17 @@ package protocol
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"sync"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	coreprotocol "github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/your-org/p2p-network/pkg/utils"
 )
 
 type Handler struct {
@@ -18,74 +20,138 @@ type Handler struct {
 	node      interface{}
 	mu        sync.RWMutex
 	handlers  map[MessageType]MessageHandler
-	responses map[string]chan *Message
+	responses map[string]chan InboundResponse
+
+	security SecurityConfig
+	replay   *ReplayCache
+	failures *verifyFailures
+	metrics  *utils.Metrics
+	versions *PeerVersions
+
+	transfer  TransferConfig
+	transfers *transferTable
+
+	compression CompressionConfig
+	encryption  EncryptionConfig
+
+	streams StreamConfig
+	limiter *handlerLimiter
+
+	latency     *LatencyTable
+	idempotency *idempotencyCache
 }
 
+const (
+	handshakeTimeout = 10 * time.Second
+	idempotencyTTL   = 10 * time.Minute
+)
+
 type MessageHandler func(ctx context.Context, p peer.ID, msg *Message) (*Message, error)
 
-func NewHandler(node interface{}) *Handler {
+// InboundResponse is a response a peer sent in a stream of its own rather
+// than as the reply to one of ours.
+type InboundResponse struct {
+	Peer    peer.ID
+	Message *Message
+}
+
+type HandlerOption func(*Handler)
+
+func WithSecurityConfig(cfg SecurityConfig) HandlerOption {
+	return func(h *Handler) {
+		h.security = cfg
+	}
+}
+
+func WithTransferConfig(cfg TransferConfig) HandlerOption {
+	return func(h *Handler) {
+		h.transfer = cfg
+	}
+}
+
+func WithCompressionConfig(cfg CompressionConfig) HandlerOption {
+	return func(h *Handler) {
+		h.compression = cfg
+	}
+}
+
+func WithMetrics(metrics *utils.Metrics) HandlerOption {
+	return func(h *Handler) {
+		h.metrics = metrics
+	}
+}
+
+func NewHandler(node interface{}, opts ...HandlerOption) *Handler {
 	h := &Handler{
 		node:      node,
 		handlers:  make(map[MessageType]MessageHandler),
-		responses: make(map[string]chan *Message),
+		responses: make(map[string]chan InboundResponse),
+		security:  DefaultSecurityConfig(),
+		failures:  newVerifyFailures(),
+		versions:  NewPeerVersions(),
+		transfer:  DefaultTransferConfig(),
+
+		compression: DefaultCompressionConfig(),
+		encryption:  DefaultEncryptionConfig(),
+		streams:     DefaultStreamConfig(),
+		latency:     NewLatencyTable(),
+		idempotency: newIdempotencyCache(idempotencyTTL),
+	}
+
+	for _, opt := range opts {
+		opt(h)
 	}
 
+	h.replay = NewReplayCache(h.security.ReplayWindow)
+	h.transfers = newTransferTable(h.transfer)
+	h.limiter = newHandlerLimiter(h.streams)
+
 	h.registerDefaultHandlers()
 
 	return h
 }
 
 func (h *Handler) registerDefaultHandlers() {
-	h.handlers[MsgTypeRequest] = h.handleRequest
+	h.handlers[MsgTypeRequest] = h.idempotent(h.handleRequest)
 	h.handlers[MsgTypeResponse] = h.handleResponse
 	h.handlers[MsgTypeHeartbeat] = h.handleHeartbeat
 	h.handlers[MsgTypePing] = h.handlePing
 	h.handlers[MsgTypePong] = h.handlePong
+	h.handlers[MsgTypeVersionRequest] = h.handleVersionRequest
 }
 
+// HandleStream serves an inbound stream. Handlers run concurrently within
+// the limits of the stream config; malformed frames, read timeouts and
+// failed transfers reset the stream.
 func (h *Handler) HandleStream(stream network.Stream) {
+	remote := stream.Conn().RemotePeer()
+	streamVersion, err := ParseVersion(string(stream.Protocol()))
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	if _, ok := h.versions.Get(remote); !ok {
+		h.versions.Set(remote, streamVersion)
+	}
+
 	ctx, cancel := context.WithCancel(stream.Context())
 	defer cancel()
 
-	decoder := json.NewDecoder(stream)
-	encoder := json.NewEncoder(stream)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-
-		var msg Message
-		if err := decoder.Decode(&msg); err != nil {
-			if err == io.EOF {
-				return
-			}
-			continue
-		}
-
-		handler, ok := h.handlers[msg.Type]
-		if !ok {
-			continue
-		}
-
-		resp, err := handler(ctx, stream.Conn().RemotePeer(), &msg)
-		if err != nil {
-			continue
-		}
-
-		if resp != nil {
-			if err := encoder.Encode(resp); err != nil {
-				continue
-			}
-		}
+	session := h.newStreamSession(stream, streamVersion)
+	if err := session.run(ctx); err != nil {
+		cancel()
+		session.wg.Wait()
+		stream.Reset()
+		return
 	}
+
+	session.wg.Wait()
+	stream.Close()
 }
 
 func (h *Handler) handleRequest(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
-	var req Request
-	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+	req, err := DecodeRequest(msg.Payload)
+	if err != nil {
 		return nil, err
 	}
 
@@ -95,7 +161,10 @@ func (h *Handler) handleRequest(ctx context.Context, p peer.ID, msg *Message) (*
 		Timestamp: time.Now().Unix(),
 	}
 
-	respData, _ := json.Marshal(resp)
+	respData, err := EncodeResponse(resp)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Message{
 		Type:      MsgTypeResponse,
@@ -111,7 +180,7 @@ func (h *Handler) handleResponse(ctx context.Context, p peer.ID, msg *Message) (
 
 	if ok {
 		select {
-		case ch <- msg:
+		case ch <- InboundResponse{Peer: p, Message: msg}:
 		default:
 		}
 	}
@@ -119,7 +188,28 @@ func (h *Handler) handleResponse(ctx context.Context, p peer.ID, msg *Message) (
 	return nil, nil
 }
 
+// ExpectResponses routes responses for requestID that peers send
+// unprompted, such as replies to a request published over pubsub, to the
+// returned channel until done is called. Responses beyond buffer unread ones
+// are dropped.
+func (h *Handler) ExpectResponses(requestID string, buffer int) (responses <-chan InboundResponse, done func()) {
+	ch := make(chan InboundResponse, buffer)
+
+	h.mu.Lock()
+	h.responses[requestID] = ch
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		if h.responses[requestID] == ch {
+			delete(h.responses, requestID)
+		}
+		h.mu.Unlock()
+	}
+}
+
 func (h *Handler) handleHeartbeat(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+	h.latency.Touch(p, time.Now())
 	return nil, nil
 }
 
@@ -131,65 +221,351 @@ func (h *Handler) handlePing(ctx context.Context, p peer.ID, msg *Message) (*Mes
 }
 
 func (h *Handler) handlePong(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+	h.latency.Touch(p, time.Now())
 	return nil, nil
 }
 
+func (h *Handler) handleVersionRequest(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+	req, err := DecodeVersionRequest(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := NewVersionResponse("", true, "")
+	selected, err := NegotiateVersion(req.Protocols)
+	if err != nil {
+		resp.Success = false
+		resp.Error = err.Error()
+	} else {
+		resp.SelectedVersion = selected
+		resp.Compression = h.compression.NegotiateCompression(req.Compression)
+		h.versions.Set(p, selected)
+		h.versions.SetCompression(p, resp.Compression)
+		h.versions.SetNegotiated(p)
+	}
+
+	data, err := EncodeVersionResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Type:      MsgTypeVersionResponse,
+		RequestID: msg.RequestID,
+		Payload:   data,
+	}, nil
+}
+
+// Handshake negotiates the protocol version with p and records the result.
+// Peers that predate the handshake keep the version multistream selected.
+func (h *Handler) Handshake(ctx context.Context, p peer.ID) (string, error) {
+	stream, err := h.host.NewStream(ctx, p, toProtocolIDs(SupportedProtocolIDs())...)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	streamVersion, err := ParseVersion(string(stream.Protocol()))
+	if err != nil {
+		return "", err
+	}
+
+	versionReq := NewVersionRequest()
+	versionReq.Compression = h.compression.offered()
+
+	payload, err := EncodeVersionRequest(versionReq)
+	if err != nil {
+		return "", err
+	}
+
+	req := &Message{
+		Type:      MsgTypeVersionRequest,
+		RequestID: fmt.Sprintf("version-%d", time.Now().UnixNano()),
+		Payload:   payload,
+	}
+
+	stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	resp, err := h.roundTrip(ctx, stream, p, req)
+	if err != nil || resp.Type != MsgTypeVersionResponse {
+		h.versions.Set(p, streamVersion)
+		h.versions.SetNegotiated(p)
+		return streamVersion, nil
+	}
+
+	vr, err := DecodeVersionResponse(resp.Payload)
+	if err != nil {
+		return "", fmt.Errorf("decode version response: %w", err)
+	}
+	if !vr.Success {
+		return "", fmt.Errorf("version negotiation rejected by %s: %s", p, vr.Error)
+	}
+	if !IsVersionSupported(vr.SelectedVersion) {
+		return "", fmt.Errorf("peer %s selected unsupported version %s", p, vr.SelectedVersion)
+	}
+
+	if vr.Compression != CompressionNone && !h.compression.supports(vr.Compression) {
+		return "", fmt.Errorf("peer %s selected unsupported compression %s", p, vr.Compression)
+	}
+
+	h.versions.Set(p, vr.SelectedVersion)
+	h.versions.SetCompression(p, vr.Compression)
+	h.versions.SetNegotiated(p)
+	return vr.SelectedVersion, nil
+}
+
+func (h *Handler) PeerVersion(p peer.ID) (string, bool) {
+	return h.versions.Get(p)
+}
+
+// NewStream opens a stream to p on the negotiated protocol version,
+// performing the version handshake unless one has completed with p, even
+// if p has already opened streams to us.
+func (h *Handler) NewStream(ctx context.Context, p peer.ID) (network.Stream, error) {
+	version, _ := h.versions.Get(p)
+	if !h.versions.Negotiated(p) {
+		negotiated, err := h.Handshake(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		version = negotiated
+	}
+
+	return h.host.NewStream(ctx, p, coreprotocol.ID(ProtocolIDForVersion(version)))
+}
+
+func (h *Handler) roundTrip(ctx context.Context, stream network.Stream, p peer.ID, msg *Message) (*Message, error) {
+	decoder, encoder := streamFrames(stream)
+
+	if err := h.writeMessage(p, encoder, msg); err != nil {
+		return nil, err
+	}
+
+	return h.readReply(ctx, p, decoder, encoder)
+}
+
+// readReply reads the reply to a request, passing the queue status and
+// stream chunk frames that precede it to the observers in ctx and
+// reassembling chunked replies.
+func (h *Handler) readReply(ctx context.Context, p peer.ID, decoder frameDecoder, encoder frameEncoder) (*Message, error) {
+	for {
+		resp, err := h.readMessage(p, decoder)
+		if err != nil {
+			return nil, err
+		}
+
+		switch resp.Type {
+		case MsgTypeQueueStatus:
+			if err := observeQueueStatus(ctx, resp); err != nil {
+				return nil, err
+			}
+		case MsgTypeStreamChunk:
+			if err := observeStreamChunk(ctx, resp); err != nil {
+				return nil, err
+			}
+		case MsgTypeTransferStart:
+			return h.receiveTransfer(p, resp, h.reader(p, decoder), encoder)
+		default:
+			return resp, nil
+		}
+	}
+}
+
+func (h *Handler) writeMessage(p peer.ID, encoder frameEncoder, msg *Message) error {
+	if err := h.compressMessage(p, msg); err != nil {
+		return err
+	}
+
+	if err := h.signMessage(msg); err != nil {
+		return err
+	}
+
+	return encoder.Encode(msg)
+}
+
+func (h *Handler) readMessage(p peer.ID, decoder frameDecoder) (*Message, error) {
+	var msg Message
+	if err := decoder.Decode(&msg); err != nil {
+		return nil, err
+	}
+
+	if err := h.verifyMessage(p, &msg); err != nil {
+		h.recordVerifyFailure(p)
+		return nil, fmt.Errorf("verify message: %w", err)
+	}
+
+	if err := h.decompressMessage(&msg); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+func (h *Handler) writeResponse(p peer.ID, resp *Message, next frameSource, encoder frameEncoder) error {
+	if h.needsChunking(resp) {
+		transferID := fmt.Sprintf("%s-%d", resp.RequestID, time.Now().UnixNano())
+		manifest := NewTransferManifest(transferID, resp, h.transfer.ChunkSize)
+		return h.sendTransfer(p, manifest, resp.Payload, next, encoder)
+	}
+
+	return h.writeMessage(p, encoder, resp)
+}
+
+func (h *Handler) needsChunking(msg *Message) bool {
+	return h.transfer.ChunkThreshold > 0 && len(msg.Payload) > h.transfer.ChunkThreshold
+}
+
+func toProtocolIDs(ids []string) []coreprotocol.ID {
+	pids := make([]coreprotocol.ID, 0, len(ids))
+	for _, id := range ids {
+		pids = append(pids, coreprotocol.ID(id))
+	}
+	return pids
+}
+
 func (h *Handler) RegisterHandler(msgType MessageType, handler MessageHandler) {
+	if msgType == MsgTypeRequest {
+		handler = h.idempotent(handler)
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.handlers[msgType] = handler
 }
 
 func (h *Handler) SendRequest(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
-	stream, err := h.host.NewStream(ctx, p, ProtocolID)
+	msg, replyKey, err := h.sealRequest(p, msg)
 	if err != nil {
 		return nil, err
 	}
-	defer stream.Close()
 
-	if err := json.NewEncoder(stream).Encode(msg); err != nil {
+	resp, err := h.sendRequest(contextWithReplyKey(ctx, replyKey), p, msg)
+	if err != nil {
 		return nil, err
 	}
 
-	var resp Message
-	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+	return openReply(replyKey, resp)
+}
+
+func (h *Handler) sendRequest(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+	if h.needsChunking(msg) {
+		return h.SendLarge(ctx, p, msg)
+	}
+
+	stream, err := h.NewStream(ctx, p)
+	if err != nil {
 		return nil, err
 	}
+	defer stream.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
 
-	return &resp, nil
+	return h.roundTrip(ctx, stream, p, msg)
 }
 
 func (h *Handler) SendMessage(ctx context.Context, p peer.ID, msg *Message) error {
-	stream, err := h.host.NewStream(ctx, p, ProtocolID)
+	stream, err := h.NewStream(ctx, p)
 	if err != nil {
 		return err
 	}
 	defer stream.Close()
 
-	return json.NewEncoder(stream).Encode(msg)
+	decoder, encoder := streamFrames(stream)
+	return h.writeResponse(p, msg, h.reader(p, decoder), encoder)
 }
 
-func (h *Handler) Broadcast(ctx context.Context, peers []peer.ID, msg *Message) error {
-	var wg sync.WaitGroup
-	errs := make([]error, len(peers))
+func (h *Handler) SetHost(host host.Host) {
+	h.host = host
+
+	host.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if len(n.ConnsToPeer(c.RemotePeer())) == 0 {
+				h.versions.Remove(c.RemotePeer())
+				h.latency.Remove(c.RemotePeer())
+			}
+		},
+	})
+}
+
+// Register installs the stream handler for every supported protocol version.
+func (h *Handler) Register() {
+	for _, id := range SupportedProtocolIDs() {
+		h.host.SetStreamHandler(coreprotocol.ID(id), h.HandleStream)
+	}
+}
 
-	for i, p := range peers {
-		wg.AddGo(func() {
-			errs[i] = h.SendMessage(ctx, p, msg)
-		})
+func (h *Handler) Unregister() {
+	for _, id := range SupportedProtocolIDs() {
+		h.host.RemoveStreamHandler(coreprotocol.ID(id))
 	}
+}
 
-	wg.Wait()
+func (h *Handler) SetMetrics(metrics *utils.Metrics) {
+	h.metrics = metrics
+}
+
+func (h *Handler) signMessage(msg *Message) error {
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().Unix()
+	}
 
-	for _, err := range errs {
+	if !h.security.SignMessages || h.host == nil {
+		return nil
+	}
+
+	key := h.host.Peerstore().PrivKey(h.host.ID())
+	if key == nil {
+		return fmt.Errorf("no private key for local peer %s", h.host.ID())
+	}
+
+	return msg.Sign(key)
+}
+
+func (h *Handler) verifyMessage(p peer.ID, msg *Message) error {
+	if !h.security.SignMessages {
+		return nil
+	}
+
+	var pub crypto.PubKey
+	if h.host != nil {
+		pub = h.host.Peerstore().PubKey(p)
+	}
+	if pub == nil {
+		extracted, err := p.ExtractPublicKey()
 		if err != nil {
-			return err
+			return fmt.Errorf("public key for %s: %w", p, err)
 		}
+		pub = extracted
+	}
+
+	if err := msg.Verify(pub); err != nil {
+		return err
 	}
 
+	now := time.Now()
+	if err := CheckTimestamp(msg.Timestamp, now, h.security.MaxClockSkew); err != nil {
+		return err
+	}
+
+	if !h.replay.Check(p, msg, now) {
+		return ErrReplayedMessage
+	}
+
+	h.failures.reset(p)
 	return nil
 }
 
-func (h *Handler) SetHost(host host.Host) {
-	h.host = host
+func (h *Handler) recordVerifyFailure(p peer.ID) {
+	if h.metrics != nil {
+		h.metrics.IncVerificationFailures()
+	}
+
+	if !h.failures.add(p, h.security.MaxVerifyFailures) {
+		return
+	}
+
+	if h.host != nil {
+		h.host.Network().ClosePeer(p)
+	}
 }
@@ -0,0 +1,286 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const rttSmoothing = 0.2
+
+type LivenessConfig struct {
+	Interval  time.Duration
+	Timeout   time.Duration
+	MaxMissed int
+}
+
+func DefaultLivenessConfig() LivenessConfig {
+	return LivenessConfig{
+		Interval:  15 * time.Second,
+		Timeout:   5 * time.Second,
+		MaxMissed: 3,
+	}
+}
+
+type PeerLatency struct {
+	Peer     peer.ID
+	RTT      time.Duration
+	LastRTT  time.Duration
+	LastSeen time.Time
+	Missed   int
+	Healthy  bool
+}
+
+type LivenessEvent struct {
+	Peer    peer.ID
+	Healthy bool
+	RTT     time.Duration
+	At      time.Time
+}
+
+type LatencyTable struct {
+	mu    sync.RWMutex
+	peers map[peer.ID]*PeerLatency
+}
+
+func NewLatencyTable() *LatencyTable {
+	return &LatencyTable{
+		peers: make(map[peer.ID]*PeerLatency),
+	}
+}
+
+func (t *LatencyTable) Get(p peer.ID) (PeerLatency, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	entry, ok := t.peers[p]
+	if !ok {
+		return PeerLatency{}, false
+	}
+	return *entry, true
+}
+
+// Snapshot returns all tracked peers ordered by smoothed RTT, healthy peers
+// first.
+func (t *LatencyTable) Snapshot() []PeerLatency {
+	t.mu.RLock()
+	entries := make([]PeerLatency, 0, len(t.peers))
+	for _, entry := range t.peers {
+		entries = append(entries, *entry)
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Healthy != entries[j].Healthy {
+			return entries[i].Healthy
+		}
+		return entries[i].RTT < entries[j].RTT
+	})
+	return entries
+}
+
+// RecordRTT stores a successful round trip and reports whether the peer
+// transitioned to healthy.
+func (t *LatencyTable) RecordRTT(p peer.ID, rtt time.Duration, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry := t.entry(p)
+	if entry.RTT == 0 {
+		entry.RTT = rtt
+	} else {
+		entry.RTT = time.Duration(rttSmoothing*float64(rtt) + (1-rttSmoothing)*float64(entry.RTT))
+	}
+	entry.LastRTT = rtt
+	entry.LastSeen = now
+	entry.Missed = 0
+
+	changed := !entry.Healthy
+	entry.Healthy = true
+	return changed
+}
+
+// RecordMiss counts a missed heartbeat and reports whether the peer
+// transitioned to unhealthy.
+func (t *LatencyTable) RecordMiss(p peer.ID, maxMissed int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry := t.entry(p)
+	entry.Missed++
+	if entry.Healthy && entry.Missed >= maxMissed {
+		entry.Healthy = false
+		return true
+	}
+	return false
+}
+
+func (t *LatencyTable) Touch(p peer.ID, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entry(p).LastSeen = now
+}
+
+func (t *LatencyTable) Remove(p peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, p)
+}
+
+func (t *LatencyTable) entry(p peer.ID) *PeerLatency {
+	entry, ok := t.peers[p]
+	if !ok {
+		entry = &PeerLatency{Peer: p}
+		t.peers[p] = entry
+	}
+	return entry
+}
+
+// LivenessService periodically pings connected /llm-share peers, feeding
+// the handler's latency table and emitting health transitions.
+type LivenessService struct {
+	handler *Handler
+	cfg     LivenessConfig
+	events  chan LivenessEvent
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewLivenessService(h *Handler, cfg LivenessConfig) *LivenessService {
+	return &LivenessService{
+		handler: h,
+		cfg:     cfg,
+		events:  make(chan LivenessEvent, 100),
+	}
+}
+
+func (s *LivenessService) Start(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.pingAll(ctx)
+			}
+		}
+	}()
+}
+
+func (s *LivenessService) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+func (s *LivenessService) Events() <-chan LivenessEvent {
+	return s.events
+}
+
+func (s *LivenessService) pingAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range s.handler.sharePeers() {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			s.check(ctx, p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (s *LivenessService) check(ctx context.Context, p peer.ID) {
+	table := s.handler.latency
+
+	rtt, err := s.handler.Ping(ctx, p, s.cfg.Timeout)
+	now := time.Now()
+	if err != nil {
+		if table.RecordMiss(p, s.cfg.MaxMissed) {
+			s.emit(LivenessEvent{Peer: p, Healthy: false, At: now})
+		}
+		return
+	}
+
+	if table.RecordRTT(p, rtt, now) {
+		s.emit(LivenessEvent{Peer: p, Healthy: true, RTT: rtt, At: now})
+	}
+}
+
+func (s *LivenessService) emit(event LivenessEvent) {
+	select {
+	case s.events <- event:
+	default:
+	}
+}
+
+// Ping sends a ping to p and returns the measured round-trip time. Only
+// the ping and pong are timed, not opening the stream or the version
+// handshake.
+func (h *Handler) Ping(ctx context.Context, p peer.ID, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stream, err := h.NewStream(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	// Not every transport honours deadlines, so the stream is also reset
+	// once ctx ends.
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { stream.Reset() })
+	defer stop()
+
+	msg := &Message{
+		Type:      MsgTypePing,
+		RequestID: fmt.Sprintf("ping-%d", time.Now().UnixNano()),
+	}
+
+	start := time.Now()
+	resp, err := h.roundTrip(ctx, stream, p, msg)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	if resp.Type != MsgTypePong {
+		return 0, fmt.Errorf("expected pong, got message type %d", resp.Type)
+	}
+
+	return rtt, nil
+}
+
+func (h *Handler) Latency() *LatencyTable {
+	return h.latency
+}
+
+// sharePeers lists connected peers that advertise an /llm-share protocol.
+func (h *Handler) sharePeers() []peer.ID {
+	ids := toProtocolIDs(SupportedProtocolIDs())
+
+	var peers []peer.ID
+	for _, p := range h.host.Network().Peers() {
+		supported, err := h.host.Peerstore().SupportsProtocols(p, ids...)
+		if err != nil || len(supported) == 0 {
+			continue
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
@@ -2,15 +2,27 @@ package protocol
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 )
 
+// Request methods understood by providers. Params and Result carry the
+// OpenAI-compatible request and response bodies for these methods.
+const (
+	MethodChatCompletions = "chat.completions"
+	MethodCompletions     = "completions"
+)
+
 type Request struct {
 	Method    string          `json:"method"`
 	Model     string          `json:"model"`
 	Params    json.RawMessage `json:"params,omitempty"`
 	ID        string          `json:"id"`
 	Timestamp int64           `json:"timestamp"`
+	Priority  int             `json:"priority,omitempty"`
+	// Stream asks for the output in MsgTypeStreamChunk frames as it is
+	// generated. Providers that cannot stream return the whole result.
+	Stream bool `json:"stream,omitempty"`
 }
 
 type Response struct {
@@ -23,6 +35,31 @@ type Response struct {
 type Error struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	// RetryAfter is set on ErrCodeBusy when the provider can estimate when
+	// it will have room again.
+	RetryAfter time.Duration `json:"retry_after,omitempty"`
+}
+
+const (
+	ErrCodeInvalidRequest = 400
+	ErrCodeNotFound       = 404
+	ErrCodeBusy           = 429
+	ErrCodeInternal       = 500
+	ErrCodeUnavailable    = 503
+	ErrCodeTimeout        = 504
+)
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("remote error %d: %s", e.Code, e.Message)
+}
+
+func (e *Error) Retryable() bool {
+	switch e.Code {
+	case ErrCodeBusy, ErrCodeUnavailable, ErrCodeTimeout:
+		return true
+	default:
+		return false
+	}
 }
 
 func NewRequest(method, model, id string, params interface{}) (*Request, error) {
@@ -90,6 +127,11 @@ type ProviderInfo struct {
 	Protocols  []string               `json:"protocols"`
 	Metadata   map[string]interface{} `json:"metadata,omitempty"`
 	LastSeen   int64                  `json:"last_seen"`
+	Capacity   int                    `json:"capacity,omitempty"`
+	Load       int                    `json:"load,omitempty"`
+	Price      float64                `json:"price,omitempty"`
+	QueueDepth int                    `json:"queue_depth,omitempty"`
+	QueueWait  time.Duration          `json:"queue_wait,omitempty"`
 }
 
 func NewProviderInfo(peerID, model, address string) *ProviderInfo {
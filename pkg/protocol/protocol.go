@@ -3,6 +3,7 @@ package protocol
 import (
 	"encoding/binary"
 	"fmt"
+	"time"
 )
 
 const (
@@ -21,10 +22,22 @@ const (
 	MsgTypeHeartbeat
 	MsgTypePing
 	MsgTypePong
+	MsgTypeTransferStart
+	MsgTypeTransferAck
+	MsgTypeChunk
+	// MsgTypeStreamChunk carries a piece of a streamed request's output
+	// ahead of its MsgTypeResponse.
+	MsgTypeStreamChunk
+	MsgTypeQueueStatus
+	// MsgTypeSyncRequest asks for the recent messages of a pubsub topic,
+	// answered with MsgTypeSyncResponse.
+	MsgTypeSyncRequest
+	MsgTypeSyncResponse
 )
 
 type Message struct {
 	Type      MessageType
+	Flags     uint8
 	RequestID string
 	Payload   []byte
 	Signature []byte
@@ -35,6 +48,7 @@ func (m *Message) Encode() ([]byte, error) {
 	data := make([]byte, 0, 4+len(m.RequestID)+len(m.Payload)+len(m.Signature))
 
 	data = append(data, byte(m.Type))
+	data = append(data, m.Flags)
 
 	reqIDLen := uint16(len(m.RequestID))
 	data = binary.LittleEndian.AppendUint16(data, reqIDLen)
@@ -64,6 +78,12 @@ func DecodeMessage(data []byte) (*Message, error) {
 	msg.Type = MessageType(data[offset])
 	offset++
 
+	if len(data) < offset+1 {
+		return nil, fmt.Errorf("data too short for flags")
+	}
+	msg.Flags = data[offset]
+	offset++
+
 	if len(data) < offset+2 {
 		return nil, fmt.Errorf("data too short for request ID length")
 	}
@@ -113,7 +133,7 @@ func NewRequest(requestID string, payload []byte) *Message {
 		Type:      MsgTypeRequest,
 		RequestID: requestID,
 		Payload:   payload,
-		Timestamp: 0,
+		Timestamp: time.Now().Unix(),
 	}
 }
 
@@ -122,7 +142,7 @@ func NewResponse(requestID string, payload []byte) *Message {
 		Type:      MsgTypeResponse,
 		RequestID: requestID,
 		Payload:   payload,
-		Timestamp: 0,
+		Timestamp: time.Now().Unix(),
 	}
 }
 
@@ -131,6 +151,6 @@ func NewHeartbeat(peerID string) *Message {
 		Type:      MsgTypeHeartbeat,
 		RequestID: peerID,
 		Payload:   nil,
-		Timestamp: 0,
+		Timestamp: time.Now().Unix(),
 	}
 }
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Priority classes carried in Request.Priority. Higher classes are served
+// first from a provider's queue; within a class requests are FIFO.
+const (
+	PriorityLow    = -1
+	PriorityNormal = 0
+	PriorityHigh   = 1
+)
+
+func ParsePriority(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "low":
+		return PriorityLow, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return 0, fmt.Errorf("unknown priority %q", s)
+	}
+}
+
+// QueueStatus tells a requester where its request stands in a provider's
+// queue. Providers send it as MsgTypeQueueStatus frames ahead of the
+// response whenever the position changes.
+type QueueStatus struct {
+	RequestID     string
+	Position      int
+	Depth         int
+	EstimatedWait time.Duration
+}
+
+type queueReporterKey struct{}
+type queueObserverKey struct{}
+
+// QueueReporter sends a queue status frame to the requester of the request
+// being handled.
+type QueueReporter func(status QueueStatus) error
+
+func contextWithQueueReporter(ctx context.Context, reporter QueueReporter) context.Context {
+	return context.WithValue(ctx, queueReporterKey{}, reporter)
+}
+
+// ReportQueueStatus forwards status to the requester when ctx belongs to a
+// request received over a stream, and is a no-op otherwise.
+func ReportQueueStatus(ctx context.Context, status QueueStatus) error {
+	reporter, ok := ctx.Value(queueReporterKey{}).(QueueReporter)
+	if !ok {
+		return nil
+	}
+	return reporter(status)
+}
+
+// ContextWithQueueObserver makes requests sent with ctx deliver the
+// provider's queue status frames to observer.
+func ContextWithQueueObserver(ctx context.Context, observer func(QueueStatus)) context.Context {
+	return context.WithValue(ctx, queueObserverKey{}, observer)
+}
+
+func observeQueueStatus(ctx context.Context, msg *Message) error {
+	status, err := DecodeQueueStatus(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	if observer, ok := ctx.Value(queueObserverKey{}).(func(QueueStatus)); ok {
+		observer(*status)
+	}
+	return nil
+}
+
+// RetryAfter returns the delay a Busy error asks the requester to wait.
+func RetryAfter(err error) (time.Duration, bool) {
+	var protoErr *Error
+	if !errors.As(err, &protoErr) || protoErr.Code != ErrCodeBusy || protoErr.RetryAfter <= 0 {
+		return 0, false
+	}
+	return protoErr.RetryAfter, true
+}
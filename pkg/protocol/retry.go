@@ -0,0 +1,511 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	ErrNoProviders   = errors.New("no providers available")
+	ErrCircuitOpen   = errors.New("circuit breaker open")
+	ErrNotIdempotent = errors.New("request has no idempotency key")
+)
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+	AttemptTimeout time.Duration
+	Retryable      func(error) bool
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 200 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		AttemptTimeout: 60 * time.Second,
+		Retryable:      IsRetryable,
+	}
+}
+
+// Backoff returns the delay before the given retry (1 for the first retry),
+// with jitter applied symmetrically around the exponential value.
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	if retry <= 0 {
+		return 0
+	}
+
+	backoff := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(retry-1))
+	if ceiling := float64(p.MaxBackoff); p.MaxBackoff > 0 && backoff > ceiling {
+		backoff = ceiling
+	}
+	if p.Jitter > 0 {
+		backoff *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+
+	return time.Duration(backoff)
+}
+
+// IsRetryable reports whether a failed attempt may succeed on another try or
+// another provider: transport failures, timeouts and busy/unavailable errors
+// are retryable, rejected transfers and client errors are not.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var protoErr *Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Retryable()
+	}
+
+	var transferErr *TransferError
+	if errors.As(err, &transferErr) {
+		return false
+	}
+
+	return true
+}
+
+type BreakerConfig struct {
+	FailureThreshold int
+	Cooldown         time.Duration
+}
+
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureThreshold: 5,
+		Cooldown:         30 * time.Second,
+	}
+}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+type breaker struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+}
+
+// CircuitBreakers tracks one breaker per provider. A breaker opens after
+// FailureThreshold consecutive failures, lets a single probe through once
+// Cooldown has passed, and closes again on the probe's success.
+type CircuitBreakers struct {
+	mu       sync.Mutex
+	cfg      BreakerConfig
+	breakers map[peer.ID]*breaker
+}
+
+func NewCircuitBreakers(cfg BreakerConfig) *CircuitBreakers {
+	return &CircuitBreakers{
+		cfg:      cfg,
+		breakers: make(map[peer.ID]*breaker),
+	}
+}
+
+func (c *CircuitBreakers) Allow(p peer.ID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.breakers[p]
+	if !ok {
+		return true
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < c.cfg.Cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *CircuitBreakers) Success(p peer.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.breakers, p)
+}
+
+func (c *CircuitBreakers) Failure(p peer.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.breakers[p]
+	if !ok {
+		b = &breaker{}
+		c.breakers[p] = b
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || (c.cfg.FailureThreshold > 0 && b.failures >= c.cfg.FailureThreshold) {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (c *CircuitBreakers) State(p peer.ID) BreakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b, ok := c.breakers[p]; ok {
+		return b.state
+	}
+	return BreakerClosed
+}
+
+type Client struct {
+	handler  *Handler
+	policy   RetryPolicy
+	breakers *CircuitBreakers
+	selector *Selector
+}
+
+func NewClient(h *Handler, policy RetryPolicy, breakers *CircuitBreakers) *Client {
+	if policy.Retryable == nil {
+		policy.Retryable = IsRetryable
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 1
+	}
+
+	return &Client{
+		handler:  h,
+		policy:   policy,
+		breakers: breakers,
+	}
+}
+
+func (c *Client) Breakers() *CircuitBreakers {
+	return c.breakers
+}
+
+// SetSelector makes the client track outstanding requests per provider and
+// enables DoSelect. It must be called before the client is used.
+func (c *Client) SetSelector(s *Selector) {
+	c.selector = s
+}
+
+func (c *Client) Selector() *Selector {
+	return c.selector
+}
+
+// DoSelect orders candidates with the client's selector and sends req as Do
+// does. On success the provider is bound to session so later requests of
+// the same conversation go to it while it stays a candidate.
+func (c *Client) DoSelect(ctx context.Context, candidates []ProviderCandidate, session string, req *Request) (*Response, peer.ID, error) {
+	if c.selector == nil {
+		return nil, "", fmt.Errorf("client has no provider selector")
+	}
+
+	resp, p, err := c.Do(ctx, c.selector.Order(candidates, session), req)
+	if err == nil {
+		c.selector.Bind(session, p)
+	}
+	return resp, p, err
+}
+
+// Do sends req to the first available provider, retrying retryable failures
+// with backoff and failing over through the candidate list. req.ID is the
+// idempotency key: every attempt carries the same ID so providers can
+// return a cached result instead of running the request twice. An attempt
+// that has passed stream chunks to the observer in ctx is not retried, as
+// the output already delivered cannot be taken back.
+func (c *Client) Do(ctx context.Context, providers []peer.ID, req *Request) (*Response, peer.ID, error) {
+	if req.ID == "" {
+		return nil, "", ErrNotIdempotent
+	}
+	if len(providers) == 0 {
+		return nil, "", ErrNoProviders
+	}
+
+	var streamed int32
+	if observer, ok := streamObserver(ctx); ok {
+		ctx = ContextWithStreamObserver(ctx, func(data []byte) {
+			atomic.StoreInt32(&streamed, 1)
+			observer(data)
+		})
+	}
+
+	payload, err := EncodeRequest(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var lastErr error
+	var lastPeer peer.ID
+	next := 0
+	for attempt := 0; attempt < c.policy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := c.policy.Backoff(attempt)
+			if wait, ok := RetryAfter(lastErr); ok && wait > delay && !c.hasAlternative(providers, lastPeer) {
+				delay = wait
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		p, ok := c.pick(providers, &next)
+		if !ok {
+			if lastErr == nil {
+				lastErr = ErrCircuitOpen
+			}
+			break
+		}
+
+		resp, err := c.attempt(ctx, p, req.ID, attempt, payload)
+		if err == nil {
+			c.breakers.Success(p)
+			return resp, p, nil
+		}
+
+		lastErr, lastPeer = err, p
+		var protoErr *Error
+		isRemote := errors.As(err, &protoErr)
+		if !c.policy.Retryable(err) || atomic.LoadInt32(&streamed) != 0 {
+			// A remote error is an answer from a live provider, which
+			// closes a half-open breaker as a success would.
+			if isRemote {
+				c.breakers.Success(p)
+			} else {
+				c.breakers.Failure(p)
+			}
+			return nil, p, err
+		}
+		// A busy provider is healthy, just full; count it as a success so
+		// a half-open breaker doesn't stay half-open.
+		if isRemote && protoErr.Code == ErrCodeBusy {
+			c.breakers.Success(p)
+		} else {
+			c.breakers.Failure(p)
+		}
+	}
+
+	return nil, "", fmt.Errorf("request %s failed after retries: %w", req.ID, lastErr)
+}
+
+// hasAlternative reports whether a provider other than p would currently
+// accept a request.
+func (c *Client) hasAlternative(providers []peer.ID, p peer.ID) bool {
+	for _, candidate := range providers {
+		if candidate != p && c.breakers.State(candidate) != BreakerOpen {
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns the next provider, starting at *next, whose breaker admits a
+// request.
+func (c *Client) pick(providers []peer.ID, next *int) (peer.ID, bool) {
+	for i := 0; i < len(providers); i++ {
+		p := providers[(*next+i)%len(providers)]
+		if c.breakers.Allow(p) {
+			*next = (*next + i + 1) % len(providers)
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func (c *Client) attempt(ctx context.Context, p peer.ID, id string, attempt int, payload []byte) (*Response, error) {
+	if c.policy.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.policy.AttemptTimeout)
+		defer cancel()
+	}
+
+	if c.selector != nil {
+		c.selector.begin(p)
+		defer c.selector.end(p)
+	}
+
+	msg := NewRequest(fmt.Sprintf("%s#%d", id, attempt), payload)
+	reply, err := c.handler.SendRequest(ctx, p, msg)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != MsgTypeResponse {
+		return nil, fmt.Errorf("expected response, got message type %d", reply.Type)
+	}
+
+	resp, err := DecodeResponse(reply.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	return resp, nil
+}
+
+// idempotencyCache remembers recent responses by requester and Request.ID
+// so a retried request is answered without being executed again. A retry
+// that arrives while the first attempt is still running waits for it.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]idempotencyEntry
+	inFlight  map[string]*idempotentCall
+	lastPrune time.Time
+}
+
+type idempotencyEntry struct {
+	payload  []byte
+	storedAt time.Time
+}
+
+// idempotentCall is a request being executed. done is closed when it
+// finishes, whether or not its response was cached.
+type idempotentCall struct {
+	done chan struct{}
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:      ttl,
+		entries:  make(map[string]idempotencyEntry),
+		inFlight: make(map[string]*idempotentCall),
+	}
+}
+
+// begin returns the cached response for id if there is one. Otherwise it
+// returns the call executing id, and leader is true if the caller has just
+// started it and must finish it.
+func (c *idempotencyCache) begin(p peer.ID, id string) (payload []byte, call *idempotentCall, leader bool) {
+	key := transferKey(p, id)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok && time.Since(entry.storedAt) <= c.ttl {
+		return entry.payload, nil, false
+	}
+	if call, ok := c.inFlight[key]; ok {
+		return nil, call, false
+	}
+
+	call = &idempotentCall{done: make(chan struct{})}
+	c.inFlight[key] = call
+	return nil, call, true
+}
+
+// finish ends call, caching payload unless it is nil.
+func (c *idempotencyCache) finish(p peer.ID, id string, call *idempotentCall, payload []byte) {
+	key := transferKey(p, id)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.inFlight, key)
+	close(call.done)
+	if payload == nil {
+		return
+	}
+
+	if now.Sub(c.lastPrune) > c.ttl {
+		for key, entry := range c.entries {
+			if now.Sub(entry.storedAt) > c.ttl {
+				delete(c.entries, key)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	c.entries[key] = idempotencyEntry{payload: payload, storedAt: now}
+}
+
+// idempotent wraps a request handler so that successful responses are
+// cached by Request.ID and replayed for retries of the same request.
+// Concurrent retries wait for the attempt in progress and run again only
+// if it produced nothing to replay.
+func (h *Handler) idempotent(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		req, err := DecodeRequest(msg.Payload)
+		if err != nil || req.ID == "" {
+			return next(ctx, p, msg)
+		}
+
+		for {
+			payload, call, leader := h.idempotency.begin(p, req.ID)
+			if call == nil {
+				return NewResponse(msg.RequestID, payload), nil
+			}
+			if leader {
+				return h.runIdempotent(ctx, p, msg, req, call, next)
+			}
+
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+func (h *Handler) runIdempotent(ctx context.Context, p peer.ID, msg *Message, req *Request, call *idempotentCall, next MessageHandler) (*Message, error) {
+	var cached []byte
+	defer func() { h.idempotency.finish(p, req.ID, call, cached) }()
+
+	resp, err := next(ctx, p, msg)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+
+	// A streamed response leaves its output in the stream chunks sent
+	// before it, so replaying it would deliver nothing.
+	if req.Stream && CanStream(ctx) {
+		return resp, nil
+	}
+
+	result, err := DecodeResponse(resp.Payload)
+	if err == nil && (result.Error == nil || !result.Error.Retryable()) {
+		cached = resp.Payload
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing message signature")
+	ErrInvalidSignature = errors.New("invalid message signature")
+	ErrStaleMessage     = errors.New("message timestamp outside allowed skew")
+	ErrReplayedMessage  = errors.New("message already seen")
+)
+
+type SecurityConfig struct {
+	SignMessages      bool
+	MaxClockSkew      time.Duration
+	ReplayWindow      time.Duration
+	MaxVerifyFailures int
+}
+
+func DefaultSecurityConfig() SecurityConfig {
+	return SecurityConfig{
+		SignMessages:      true,
+		MaxClockSkew:      30 * time.Second,
+		ReplayWindow:      5 * time.Minute,
+		MaxVerifyFailures: 5,
+	}
+}
+
+// SigningBytes returns the canonical encoding covered by the signature: the
+// binary message encoding with the signature field left empty.
+func (m *Message) SigningBytes() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	return unsigned.Encode()
+}
+
+func (m *Message) Sign(key crypto.PrivKey) error {
+	if m.Timestamp == 0 {
+		m.Timestamp = time.Now().Unix()
+	}
+
+	data, err := m.SigningBytes()
+	if err != nil {
+		return err
+	}
+
+	sig, err := key.Sign(data)
+	if err != nil {
+		return fmt.Errorf("sign message: %w", err)
+	}
+
+	m.Signature = sig
+	return nil
+}
+
+func (m *Message) Verify(key crypto.PubKey) error {
+	if len(m.Signature) == 0 {
+		return ErrMissingSignature
+	}
+
+	data, err := m.SigningBytes()
+	if err != nil {
+		return err
+	}
+
+	ok, err := key.Verify(data, m.Signature)
+	if err != nil || !ok {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func CheckTimestamp(ts int64, now time.Time, maxSkew time.Duration) error {
+	if maxSkew <= 0 {
+		return nil
+	}
+
+	diff := now.Sub(time.Unix(ts, 0))
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > maxSkew {
+		return ErrStaleMessage
+	}
+
+	return nil
+}
+
+type ReplayCache struct {
+	mu        sync.Mutex
+	window    time.Duration
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func NewReplayCache(window time.Duration) *ReplayCache {
+	return &ReplayCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Check records the message and reports whether it has not been seen within
+// the replay window.
+func (c *ReplayCache) Check(p peer.ID, msg *Message, now time.Time) bool {
+	key := fmt.Sprintf("%s/%d/%s", p, msg.Type, msg.RequestID)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastPrune) > c.window {
+		c.prune(now)
+	}
+
+	if seenAt, ok := c.seen[key]; ok && now.Sub(seenAt) <= c.window {
+		return false
+	}
+
+	c.seen[key] = now
+	return true
+}
+
+func (c *ReplayCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.seen)
+}
+
+func (c *ReplayCache) prune(now time.Time) {
+	for key, seenAt := range c.seen {
+		if now.Sub(seenAt) > c.window {
+			delete(c.seen, key)
+		}
+	}
+	c.lastPrune = now
+}
+
+type verifyFailures struct {
+	mu     sync.Mutex
+	counts map[peer.ID]int
+}
+
+func newVerifyFailures() *verifyFailures {
+	return &verifyFailures{
+		counts: make(map[peer.ID]int),
+	}
+}
+
+// add increments the failure count for p and reports whether the threshold
+// was reached, resetting the count when it was.
+func (f *verifyFailures) add(p peer.ID, threshold int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.counts[p]++
+	if threshold > 0 && f.counts[p] >= threshold {
+		delete(f.counts, p)
+		return true
+	}
+
+	return false
+}
+
+func (f *verifyFailures) reset(p peer.ID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.counts, p)
+}
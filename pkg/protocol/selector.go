@@ -0,0 +1,340 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyLeastOutstanding = "least_outstanding"
+	StrategyLowestRTT        = "lowest_rtt"
+	StrategyWeightedCapacity = "weighted_capacity"
+	StrategyPowerOfTwo       = "p2c"
+)
+
+// ProviderCandidate is a provider of the requested model together with the
+// capacity, load and queue depth it last advertised.
+type ProviderCandidate struct {
+	Peer       peer.ID
+	Capacity   int
+	Load       int
+	QueueDepth int
+}
+
+// CandidateFromInfo builds a candidate from a provider advertisement.
+func CandidateFromInfo(info *ProviderInfo) (ProviderCandidate, error) {
+	p, err := peer.Decode(info.PeerID)
+	if err != nil {
+		return ProviderCandidate{}, fmt.Errorf("provider peer ID %q: %w", info.PeerID, err)
+	}
+
+	return ProviderCandidate{
+		Peer:       p,
+		Capacity:   info.Capacity,
+		Load:       info.Load,
+		QueueDepth: info.QueueDepth,
+	}, nil
+}
+
+// SelectionStats exposes what strategies know about providers beyond their
+// advertisements.
+type SelectionStats interface {
+	Outstanding(p peer.ID) int
+	RTT(p peer.ID) (time.Duration, bool)
+}
+
+// SelectionStrategy orders candidates by preference. The client tries them
+// in the returned order, so the tail of the list is the failover path.
+type SelectionStrategy interface {
+	Name() string
+	Order(candidates []ProviderCandidate, stats SelectionStats) []ProviderCandidate
+}
+
+func NewStrategy(name string) (SelectionStrategy, error) {
+	switch name {
+	case StrategyRoundRobin, "":
+		return &RoundRobin{}, nil
+	case StrategyLeastOutstanding:
+		return LeastOutstanding{}, nil
+	case StrategyLowestRTT:
+		return LowestRTT{}, nil
+	case StrategyWeightedCapacity:
+		return WeightedCapacity{}, nil
+	case StrategyPowerOfTwo:
+		return PowerOfTwo{}, nil
+	default:
+		return nil, fmt.Errorf("unknown selection strategy %q", name)
+	}
+}
+
+type RoundRobin struct {
+	next uint64
+}
+
+func (s *RoundRobin) Name() string { return StrategyRoundRobin }
+
+func (s *RoundRobin) Order(candidates []ProviderCandidate, stats SelectionStats) []ProviderCandidate {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	start := int(atomic.AddUint64(&s.next, 1)-1) % len(candidates)
+	ordered := make([]ProviderCandidate, 0, len(candidates))
+	ordered = append(ordered, candidates[start:]...)
+	return append(ordered, candidates[:start]...)
+}
+
+type LeastOutstanding struct{}
+
+func (LeastOutstanding) Name() string { return StrategyLeastOutstanding }
+
+func (LeastOutstanding) Order(candidates []ProviderCandidate, stats SelectionStats) []ProviderCandidate {
+	keys := make(map[peer.ID]int, len(candidates))
+	for _, c := range candidates {
+		keys[c.Peer] = stats.Outstanding(c.Peer)
+	}
+
+	ordered := shuffled(candidates)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return keys[ordered[i].Peer] < keys[ordered[j].Peer]
+	})
+	return ordered
+}
+
+// LowestRTT prefers providers with the lowest smoothed ping RTT; providers
+// that have not been measured yet come last.
+type LowestRTT struct{}
+
+func (LowestRTT) Name() string { return StrategyLowestRTT }
+
+func (LowestRTT) Order(candidates []ProviderCandidate, stats SelectionStats) []ProviderCandidate {
+	keys := make(map[peer.ID]time.Duration, len(candidates))
+	for _, c := range candidates {
+		keys[c.Peer] = rttOrMax(stats, c.Peer)
+	}
+
+	ordered := shuffled(candidates)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return keys[ordered[i].Peer] < keys[ordered[j].Peer]
+	})
+	return ordered
+}
+
+func rttOrMax(stats SelectionStats, p peer.ID) time.Duration {
+	if rtt, ok := stats.RTT(p); ok {
+		return rtt
+	}
+	return time.Duration(math.MaxInt64)
+}
+
+// WeightedCapacity orders providers randomly, weighted by the free capacity
+// they advertise, so a provider with twice the headroom is picked first
+// twice as often.
+type WeightedCapacity struct{}
+
+func (WeightedCapacity) Name() string { return StrategyWeightedCapacity }
+
+func (WeightedCapacity) Order(candidates []ProviderCandidate, stats SelectionStats) []ProviderCandidate {
+	keys := make(map[peer.ID]float64, len(candidates))
+	for _, c := range candidates {
+		keys[c.Peer] = math.Pow(rand.Float64(), 1/freeCapacity(c, stats))
+	}
+
+	ordered := append([]ProviderCandidate(nil), candidates...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return keys[ordered[i].Peer] > keys[ordered[j].Peer]
+	})
+	return ordered
+}
+
+func freeCapacity(c ProviderCandidate, stats SelectionStats) float64 {
+	capacity := c.Capacity
+	if capacity <= 0 {
+		capacity = 1
+	}
+
+	free := float64(capacity - load(c, stats))
+	if free < 0.1 {
+		free = 0.1
+	}
+	return free
+}
+
+// PowerOfTwo samples two providers at random and tries the less loaded one
+// first; the remaining providers follow ordered by outstanding requests.
+type PowerOfTwo struct{}
+
+func (PowerOfTwo) Name() string { return StrategyPowerOfTwo }
+
+func (PowerOfTwo) Order(candidates []ProviderCandidate, stats SelectionStats) []ProviderCandidate {
+	ordered := LeastOutstanding{}.Order(candidates, stats)
+	if len(candidates) < 2 {
+		return ordered
+	}
+
+	picks := rand.Perm(len(candidates))[:2]
+	a, b := candidates[picks[0]], candidates[picks[1]]
+	if load(b, stats) < load(a, stats) {
+		a = b
+	}
+
+	result := make([]ProviderCandidate, 0, len(ordered))
+	result = append(result, a)
+	for _, c := range ordered {
+		if c.Peer != a.Peer {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// load counts a provider's advertised in-flight and queued requests plus
+// the ones this client has outstanding with it.
+func load(c ProviderCandidate, stats SelectionStats) int {
+	return c.Load + c.QueueDepth + stats.Outstanding(c.Peer)
+}
+
+func shuffled(candidates []ProviderCandidate) []ProviderCandidate {
+	ordered := append([]ProviderCandidate(nil), candidates...)
+	rand.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	return ordered
+}
+
+type stickyBinding struct {
+	peer    peer.ID
+	expires time.Time
+}
+
+// Selector orders providers for the client using a strategy, tracks the
+// requests outstanding to each provider and keeps conversations on the
+// provider that served them while that provider remains a candidate.
+type Selector struct {
+	strategy  SelectionStrategy
+	latency   *LatencyTable
+	stickyTTL time.Duration
+
+	mu          sync.Mutex
+	outstanding map[peer.ID]int
+	sticky      map[string]stickyBinding
+	lastPrune   time.Time
+}
+
+func NewSelector(strategy SelectionStrategy, latency *LatencyTable, stickyTTL time.Duration) *Selector {
+	return &Selector{
+		strategy:    strategy,
+		latency:     latency,
+		stickyTTL:   stickyTTL,
+		outstanding: make(map[peer.ID]int),
+		sticky:      make(map[string]stickyBinding),
+	}
+}
+
+func (s *Selector) Strategy() SelectionStrategy {
+	return s.strategy
+}
+
+// Order returns the candidates' peers in the order they should be tried.
+// A live sticky binding for session moves its provider to the front.
+func (s *Selector) Order(candidates []ProviderCandidate, session string) []peer.ID {
+	ordered := s.strategy.Order(candidates, s)
+
+	peers := make([]peer.ID, 0, len(ordered))
+	if bound, ok := s.boundPeer(session, candidates); ok {
+		peers = append(peers, bound)
+	}
+	for _, c := range ordered {
+		if len(peers) > 0 && c.Peer == peers[0] {
+			continue
+		}
+		peers = append(peers, c.Peer)
+	}
+	return peers
+}
+
+func (s *Selector) boundPeer(session string, candidates []ProviderCandidate) (peer.ID, bool) {
+	if session == "" || s.stickyTTL <= 0 {
+		return "", false
+	}
+
+	s.mu.Lock()
+	binding, ok := s.sticky[session]
+	s.mu.Unlock()
+	if !ok || time.Now().After(binding.expires) {
+		return "", false
+	}
+
+	for _, c := range candidates {
+		if c.Peer == binding.peer {
+			return binding.peer, true
+		}
+	}
+	return "", false
+}
+
+// Bind records that session was served by p.
+func (s *Selector) Bind(session string, p peer.ID) {
+	if session == "" || s.stickyTTL <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastPrune) > s.stickyTTL {
+		for key, binding := range s.sticky {
+			if now.After(binding.expires) {
+				delete(s.sticky, key)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	s.sticky[session] = stickyBinding{peer: p, expires: now.Add(s.stickyTTL)}
+}
+
+func (s *Selector) begin(p peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outstanding[p]++
+}
+
+func (s *Selector) end(p peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.outstanding[p] <= 1 {
+		delete(s.outstanding, p)
+		return
+	}
+	s.outstanding[p]--
+}
+
+func (s *Selector) Outstanding(p peer.ID) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.outstanding[p]
+}
+
+func (s *Selector) RTT(p peer.ID) (time.Duration, bool) {
+	if s.latency == nil {
+		return 0, false
+	}
+
+	entry, ok := s.latency.Get(p)
+	if !ok || !entry.Healthy || entry.RTT == 0 {
+		return 0, false
+	}
+	return entry.RTT, true
+}
@@ -0,0 +1,479 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	ErrHandlerBusy    = errors.New("handler capacity exhausted")
+	ErrMalformedFrame = errors.New("malformed frame")
+)
+
+const (
+	rejectStream = "stream_limit"
+	rejectPeer   = "peer_limit"
+	rejectGlobal = "global_limit"
+
+	resetMalformed = "malformed"
+	resetTimeout   = "timeout"
+	resetTransfer  = "transfer"
+)
+
+type StreamConfig struct {
+	MaxInFlightPerStream  int
+	MaxInFlightPerPeer    int
+	MaxConcurrentHandlers int
+	QueueTimeout          time.Duration
+	ReadTimeout           time.Duration
+	WriteTimeout          time.Duration
+	HandlerTimeout        time.Duration
+}
+
+func DefaultStreamConfig() StreamConfig {
+	return StreamConfig{
+		MaxInFlightPerStream:  8,
+		MaxInFlightPerPeer:    32,
+		MaxConcurrentHandlers: 256,
+		QueueTimeout:          5 * time.Second,
+		ReadTimeout:           2 * time.Minute,
+		WriteTimeout:          30 * time.Second,
+		HandlerTimeout:        2 * time.Minute,
+	}
+}
+
+func WithStreamConfig(cfg StreamConfig) HandlerOption {
+	return func(h *Handler) {
+		h.streams = cfg
+	}
+}
+
+// frameSource yields the next verified and decompressed message.
+type frameSource func() (*Message, error)
+
+func (h *Handler) reader(p peer.ID, decoder frameDecoder) frameSource {
+	return func() (*Message, error) {
+		return h.readMessage(p, decoder)
+	}
+}
+
+// streamWriter serializes frames written by concurrent handlers and applies
+// the write deadline to each of them.
+type streamWriter struct {
+	mu      sync.Mutex
+	stream  network.Stream
+	encoder frameEncoder
+	timeout time.Duration
+}
+
+func (w *streamWriter) Encode(msg *Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timeout > 0 {
+		w.stream.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	return w.encoder.Encode(msg)
+}
+
+// handlerLimiter bounds handler executions per peer and across all streams.
+type handlerLimiter struct {
+	mu      sync.Mutex
+	perPeer int
+	peers   map[peer.ID]int
+	global  chan struct{}
+}
+
+func newHandlerLimiter(cfg StreamConfig) *handlerLimiter {
+	l := &handlerLimiter{
+		perPeer: cfg.MaxInFlightPerPeer,
+		peers:   make(map[peer.ID]int),
+	}
+	if cfg.MaxConcurrentHandlers > 0 {
+		l.global = make(chan struct{}, cfg.MaxConcurrentHandlers)
+	}
+	return l
+}
+
+func (l *handlerLimiter) acquirePeer(p peer.ID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perPeer > 0 && l.peers[p] >= l.perPeer {
+		return false
+	}
+	l.peers[p]++
+	return true
+}
+
+func (l *handlerLimiter) releasePeer(p peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.peers[p] <= 1 {
+		delete(l.peers, p)
+		return
+	}
+	l.peers[p]--
+}
+
+// acquire waits up to timeout for a global handler slot.
+func (l *handlerLimiter) acquire(ctx context.Context, timeout time.Duration) error {
+	if l.global == nil {
+		return nil
+	}
+	return acquireSlot(ctx, l.global, timeout)
+}
+
+func (l *handlerLimiter) release() {
+	if l.global != nil {
+		<-l.global
+	}
+}
+
+func acquireSlot(ctx context.Context, slots chan struct{}, timeout time.Duration) error {
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrHandlerBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// streamSession dispatches the messages read from one inbound stream to a
+// bounded set of handler goroutines. The read loop stops reading while the
+// stream's in-flight limit is reached, which pushes back on the sender
+// through the muxer's flow control.
+type streamSession struct {
+	h       *Handler
+	stream  network.Stream
+	remote  peer.ID
+	version string
+	decoder frameDecoder
+	writer  *streamWriter
+	slots   chan struct{}
+	acks    chan *Message
+
+	transferMu sync.Mutex
+	wg         sync.WaitGroup
+}
+
+func (h *Handler) newStreamSession(stream network.Stream, version string) *streamSession {
+	decoder, encoder := newFrames(stream, version)
+	s := &streamSession{
+		h:       h,
+		stream:  stream,
+		remote:  stream.Conn().RemotePeer(),
+		version: version,
+		decoder: decoder,
+		writer: &streamWriter{
+			stream:  stream,
+			encoder: encoder,
+			timeout: h.streams.WriteTimeout,
+		},
+		acks: make(chan *Message, 2*(h.transfer.Window+1)),
+	}
+	if h.streams.MaxInFlightPerStream > 0 {
+		s.slots = make(chan struct{}, h.streams.MaxInFlightPerStream)
+	}
+	return s
+}
+
+// run reads frames until the remote closes its side of the stream. A non-nil
+// error means the stream is unusable and must be reset.
+func (s *streamSession) run(ctx context.Context) error {
+	h := s.h
+	decoder := s.decoder
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if h.streams.ReadTimeout > 0 {
+			s.stream.SetReadDeadline(time.Now().Add(h.streams.ReadTimeout))
+		}
+
+		var msg Message
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				h.countReset(resetTimeout)
+				return err
+			}
+			h.countReset(resetMalformed)
+			return fmt.Errorf("%w: %v", ErrMalformedFrame, err)
+		}
+
+		if err := h.verifyMessage(s.remote, &msg); err != nil {
+			h.recordVerifyFailure(s.remote)
+			continue
+		}
+
+		if err := h.decompressMessage(&msg); err != nil {
+			h.countReset(resetMalformed)
+			return fmt.Errorf("%w: %v", ErrMalformedFrame, err)
+		}
+
+		switch msg.Type {
+		case MsgTypeTransferStart:
+			assembled, err := h.receiveTransfer(s.remote, &msg, h.reader(s.remote, decoder), s.writer)
+			if err != nil {
+				h.countReset(resetTransfer)
+				return err
+			}
+			msg = *assembled
+		case MsgTypeTransferAck:
+			select {
+			case s.acks <- &msg:
+			default:
+				h.countReset(resetTransfer)
+				return fmt.Errorf("%w: unexpected transfer ack", ErrMalformedFrame)
+			}
+			continue
+		}
+
+		s.dispatch(ctx, &msg)
+	}
+}
+
+func (s *streamSession) dispatch(ctx context.Context, msg *Message) {
+	h := s.h
+
+	h.mu.RLock()
+	handler, ok := h.handlers[msg.Type]
+	h.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	h.addQueueDepth(1)
+	err := s.acquireStreamSlot(ctx)
+	h.addQueueDepth(-1)
+	if err != nil {
+		s.reject(msg, rejectStream)
+		return
+	}
+
+	if !h.limiter.acquirePeer(s.remote) {
+		s.releaseStreamSlot()
+		s.reject(msg, rejectPeer)
+		return
+	}
+
+	h.addQueueDepth(1)
+	err = h.limiter.acquire(ctx, h.streams.QueueTimeout)
+	h.addQueueDepth(-1)
+	if err != nil {
+		h.limiter.releasePeer(s.remote)
+		s.releaseStreamSlot()
+		s.reject(msg, rejectGlobal)
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.releaseStreamSlot()
+		defer h.limiter.releasePeer(s.remote)
+		defer h.limiter.release()
+
+		h.addInFlight(1)
+		defer h.addInFlight(-1)
+
+		s.execute(ctx, handler, msg)
+	}()
+}
+
+func (s *streamSession) execute(ctx context.Context, handler MessageHandler, msg *Message) {
+	h := s.h
+
+	if h.streams.HandlerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.streams.HandlerTimeout)
+		defer cancel()
+	}
+
+	version, ok := h.versions.Get(s.remote)
+	if !ok {
+		version = s.version
+	}
+
+	// Status and stream chunk frames travel on the request's stream, which
+	// is what ties them to it. Each needs its own RequestID to pass the
+	// replay check.
+	started := time.Now().UnixNano()
+	var statuses int64
+	ctx = contextWithQueueReporter(ContextWithVersion(ctx, version), func(status QueueStatus) error {
+		payload, err := EncodeQueueStatus(&status)
+		if err != nil {
+			return err
+		}
+		return h.writeMessage(s.remote, s.writer, &Message{
+			Type:      MsgTypeQueueStatus,
+			RequestID: fmt.Sprintf("%s:queue:%d:%d", msg.RequestID, started, atomic.AddInt64(&statuses, 1)),
+			Payload:   payload,
+		})
+	})
+
+	replyKey, err := h.openRequest(msg)
+	if err != nil {
+		s.refuse(msg, err)
+		return
+	}
+
+	var chunks int64
+	ctx = contextWithStreamSender(ctx, func(data []byte) error {
+		chunk := &Message{
+			Type:      MsgTypeStreamChunk,
+			RequestID: fmt.Sprintf("%s:chunk:%d:%d", msg.RequestID, started, atomic.AddInt64(&chunks, 1)),
+			Payload:   data,
+		}
+		if err := sealReply(replyKey, chunk); err != nil {
+			return err
+		}
+		return h.writeMessage(s.remote, s.writer, chunk)
+	})
+
+	resp, err := handler(ctx, s.remote, msg)
+	if err != nil || resp == nil {
+		return
+	}
+
+	if err := sealReply(replyKey, resp); err != nil {
+		return
+	}
+
+	if h.needsChunking(resp) {
+		s.transferMu.Lock()
+		defer s.transferMu.Unlock()
+	}
+
+	h.writeResponse(s.remote, resp, s.ackSource(ctx), s.writer)
+}
+
+// ackSource hands transfer acks routed by the read loop to an outgoing
+// chunked response.
+func (s *streamSession) ackSource(ctx context.Context) frameSource {
+	return func() (*Message, error) {
+		timeout := s.h.streams.ReadTimeout
+		if timeout <= 0 {
+			timeout = handshakeTimeout
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case msg := <-s.acks:
+			return msg, nil
+		case <-timer.C:
+			return nil, fmt.Errorf("timed out waiting for transfer ack from %s", s.remote)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *streamSession) acquireStreamSlot(ctx context.Context) error {
+	if s.slots == nil {
+		return nil
+	}
+	return acquireSlot(ctx, s.slots, s.h.streams.QueueTimeout)
+}
+
+func (s *streamSession) releaseStreamSlot() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// reject answers a request that could not be scheduled with a busy error so
+// the caller can fail over; other message types are dropped.
+func (s *streamSession) reject(msg *Message, reason string) {
+	h := s.h
+	if h.metrics != nil {
+		h.metrics.IncStreamRejections(reason)
+	}
+
+	if msg.Type != MsgTypeRequest {
+		return
+	}
+
+	resp := &Response{
+		Error: &Error{
+			Code:    ErrCodeBusy,
+			Message: fmt.Sprintf("%v (%s)", ErrHandlerBusy, reason),
+		},
+		Timestamp: time.Now().Unix(),
+	}
+	if req, err := DecodeRequest(msg.Payload); err == nil {
+		resp.ID = req.ID
+	}
+
+	payload, err := EncodeResponse(resp)
+	if err != nil {
+		return
+	}
+	h.writeMessage(s.remote, s.writer, NewResponse(msg.RequestID, payload))
+}
+
+// refuse answers a request that could not be opened with an invalid
+// request error; other message types are dropped.
+func (s *streamSession) refuse(msg *Message, reason error) {
+	if msg.Type != MsgTypeRequest {
+		return
+	}
+
+	payload, err := EncodeResponse(&Response{
+		Error: &Error{
+			Code:    ErrCodeInvalidRequest,
+			Message: reason.Error(),
+		},
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return
+	}
+	s.h.writeMessage(s.remote, s.writer, NewResponse(msg.RequestID, payload))
+}
+
+func (h *Handler) countReset(reason string) {
+	if h.metrics != nil {
+		h.metrics.IncStreamResets(reason)
+	}
+}
+
+func (h *Handler) addQueueDepth(delta int) {
+	if h.metrics != nil {
+		h.metrics.AddHandlerQueueDepth(delta)
+	}
+}
+
+func (h *Handler) addInFlight(delta int) {
+	if h.metrics != nil {
+		h.metrics.AddHandlersInFlight(delta)
+	}
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+)
+
+// A request with Request.Stream set may be answered with MsgTypeStreamChunk
+// frames before its response. Their payload is a piece of output, opaque to
+// the protocol, and they are sealed with the reply key when the request was
+// sealed. The response still follows and ends the request.
+
+var ErrStreamingUnavailable = errors.New("request is not received over a stream")
+
+type streamSenderKey struct{}
+type streamObserverKey struct{}
+type replyKeyKey struct{}
+
+type streamSender func(data []byte) error
+
+func contextWithStreamSender(ctx context.Context, sender streamSender) context.Context {
+	return context.WithValue(ctx, streamSenderKey{}, sender)
+}
+
+// CanStream reports whether ctx belongs to a request received over a stream,
+// whose output can be sent with SendStreamChunk.
+func CanStream(ctx context.Context) bool {
+	_, ok := ctx.Value(streamSenderKey{}).(streamSender)
+	return ok
+}
+
+// SendStreamChunk sends data to the requester of the request being handled
+// in a stream chunk frame.
+func SendStreamChunk(ctx context.Context, data []byte) error {
+	sender, ok := ctx.Value(streamSenderKey{}).(streamSender)
+	if !ok {
+		return ErrStreamingUnavailable
+	}
+	return sender(data)
+}
+
+// ContextWithStreamObserver makes requests sent with ctx pass the payload of
+// each stream chunk frame to observer, in the order the provider sent them.
+func ContextWithStreamObserver(ctx context.Context, observer func(data []byte)) context.Context {
+	return context.WithValue(ctx, streamObserverKey{}, observer)
+}
+
+func streamObserver(ctx context.Context) (func(data []byte), bool) {
+	observer, ok := ctx.Value(streamObserverKey{}).(func(data []byte))
+	return observer, ok
+}
+
+// contextWithReplyKey lets the reader of a sealed request's reply open the
+// stream chunks that precede it.
+func contextWithReplyKey(ctx context.Context, replyKey *ReplyKey) context.Context {
+	if replyKey == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, replyKeyKey{}, replyKey)
+}
+
+func observeStreamChunk(ctx context.Context, msg *Message) error {
+	data := msg.Payload
+	if replyKey, ok := ctx.Value(replyKeyKey{}).(*ReplyKey); ok {
+		if msg.Flags&FlagEncrypted == 0 {
+			return ErrPlaintextReply
+		}
+		opened, err := replyKey.Open(msg.Payload, sealAAD(msg))
+		if err != nil {
+			return err
+		}
+		data = opened
+	}
+
+	if observer, ok := streamObserver(ctx); ok {
+		observer(data)
+	}
+	return nil
+}
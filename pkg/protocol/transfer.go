@@ -0,0 +1,470 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/your-org/p2p-network/pkg/utils"
+)
+
+var (
+	ErrTransferTooLarge     = errors.New("transfer exceeds maximum size")
+	ErrChunkOutOfOrder      = errors.New("chunk out of order")
+	ErrChunkHashMismatch    = errors.New("chunk hash mismatch")
+	ErrTransferHashMismatch = errors.New("transfer hash mismatch")
+	ErrTooManyTransfers     = errors.New("too many partial transfers")
+	ErrTransferBufferFull   = errors.New("partial transfer buffer full")
+)
+
+type TransferConfig struct {
+	ChunkSize       int
+	ChunkThreshold  int
+	MaxTransferSize int64
+	Window          int
+	PartialTTL      time.Duration
+	MaxResumes      int
+
+	// MaxPartialPerPeer and MaxPartial cap the transfers being received
+	// from one peer and in total, and MaxPartialBytes caps the bytes they
+	// may reserve. Zero means no limit.
+	MaxPartialPerPeer int
+	MaxPartial        int
+	MaxPartialBytes   int64
+}
+
+func DefaultTransferConfig() TransferConfig {
+	return TransferConfig{
+		ChunkSize:       256 * 1024,
+		ChunkThreshold:  1024 * 1024,
+		MaxTransferSize: 512 * 1024 * 1024,
+		Window:          8,
+		PartialTTL:      5 * time.Minute,
+		MaxResumes:      3,
+
+		MaxPartialPerPeer: 4,
+		MaxPartial:        32,
+		MaxPartialBytes:   1024 * 1024 * 1024,
+	}
+}
+
+type TransferManifest struct {
+	TransferID string      `json:"transfer_id"`
+	Type       MessageType `json:"type"`
+	RequestID  string      `json:"request_id"`
+	TotalSize  int64       `json:"total_size"`
+	ChunkSize  int         `json:"chunk_size"`
+	ChunkCount int         `json:"chunk_count"`
+	Hash       []byte      `json:"hash"`
+	Flags      uint8       `json:"flags,omitempty"`
+}
+
+type Chunk struct {
+	TransferID string `json:"transfer_id"`
+	Index      int    `json:"index"`
+	Hash       []byte `json:"hash"`
+	Data       []byte `json:"data"`
+}
+
+type TransferAck struct {
+	TransferID string `json:"transfer_id"`
+	NextChunk  int    `json:"next_chunk"`
+	Complete   bool   `json:"complete"`
+	Error      string `json:"error,omitempty"`
+}
+
+type TransferError struct {
+	TransferID string
+	Reason     string
+}
+
+func (e *TransferError) Error() string {
+	return fmt.Sprintf("transfer %s rejected: %s", e.TransferID, e.Reason)
+}
+
+func NewTransferManifest(transferID string, msg *Message, chunkSize int) *TransferManifest {
+	count := (len(msg.Payload) + chunkSize - 1) / chunkSize
+	return &TransferManifest{
+		TransferID: transferID,
+		Type:       msg.Type,
+		RequestID:  msg.RequestID,
+		TotalSize:  int64(len(msg.Payload)),
+		ChunkSize:  chunkSize,
+		ChunkCount: count,
+		Hash:       utils.ComputeHash(msg.Payload),
+		Flags:      msg.Flags &^ flagCompressionMask,
+	}
+}
+
+func (m *TransferManifest) Chunk(data []byte, index int) *Chunk {
+	start := index * m.ChunkSize
+	end := start + m.ChunkSize
+	if end > len(data) {
+		end = len(data)
+	}
+
+	return &Chunk{
+		TransferID: m.TransferID,
+		Index:      index,
+		Hash:       utils.ComputeHash(data[start:end]),
+		Data:       data[start:end],
+	}
+}
+
+func (m *TransferManifest) validate(maxSize int64) error {
+	if m.TransferID == "" {
+		return fmt.Errorf("missing transfer ID")
+	}
+	if maxSize > 0 && m.TotalSize > maxSize {
+		return ErrTransferTooLarge
+	}
+	if m.ChunkSize <= 0 || m.TotalSize < 0 {
+		return fmt.Errorf("invalid chunk layout")
+	}
+	if int64(m.ChunkCount) != (m.TotalSize+int64(m.ChunkSize)-1)/int64(m.ChunkSize) {
+		return fmt.Errorf("chunk count does not match total size")
+	}
+	return nil
+}
+
+func (m *TransferManifest) sameObject(other *TransferManifest) bool {
+	return m.TotalSize == other.TotalSize &&
+		m.ChunkSize == other.ChunkSize &&
+		string(m.Hash) == string(other.Hash)
+}
+
+type transferState struct {
+	peer      peer.ID
+	manifest  *TransferManifest
+	buf       []byte
+	next      int
+	updatedAt time.Time
+}
+
+func (s *transferState) apply(c *Chunk) error {
+	if c.Index != s.next {
+		return ErrChunkOutOfOrder
+	}
+	if !utils.VerifyHash(c.Data, c.Hash) {
+		return ErrChunkHashMismatch
+	}
+
+	expected := s.manifest.ChunkSize
+	if c.Index == s.manifest.ChunkCount-1 {
+		expected = int(s.manifest.TotalSize) - c.Index*s.manifest.ChunkSize
+	}
+	if len(c.Data) != expected {
+		return fmt.Errorf("chunk %d has %d bytes, expected %d", c.Index, len(c.Data), expected)
+	}
+
+	s.buf = append(s.buf, c.Data...)
+	s.next++
+	s.updatedAt = time.Now()
+	return nil
+}
+
+func (s *transferState) done() bool {
+	return s.next >= s.manifest.ChunkCount
+}
+
+func (s *transferState) verify() error {
+	if !utils.VerifyHash(s.buf, s.manifest.Hash) {
+		return ErrTransferHashMismatch
+	}
+	return nil
+}
+
+// transferTable keeps partially received transfers so a sender can resume
+// after a stream reset instead of starting over. Each partial transfer
+// reserves its total size against the configured limits until it completes,
+// fails or expires.
+type transferTable struct {
+	mu       sync.Mutex
+	cfg      TransferConfig
+	states   map[string]*transferState
+	perPeer  map[peer.ID]int
+	reserved int64
+}
+
+func newTransferTable(cfg TransferConfig) *transferTable {
+	return &transferTable{
+		cfg:     cfg,
+		states:  make(map[string]*transferState),
+		perPeer: make(map[peer.ID]int),
+	}
+}
+
+func (t *transferTable) begin(p peer.ID, m *TransferManifest, maxSize int64) (*transferState, error) {
+	if err := m.validate(maxSize); err != nil {
+		return nil, err
+	}
+
+	key := transferKey(p, m.TransferID)
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(now)
+
+	if state, ok := t.states[key]; ok {
+		if state.manifest.sameObject(m) {
+			state.updatedAt = now
+			return state, nil
+		}
+		t.release(key, state)
+	}
+
+	if t.cfg.MaxPartialPerPeer > 0 && t.perPeer[p] >= t.cfg.MaxPartialPerPeer {
+		return nil, ErrTooManyTransfers
+	}
+	if t.cfg.MaxPartial > 0 && len(t.states) >= t.cfg.MaxPartial {
+		return nil, ErrTooManyTransfers
+	}
+	if t.cfg.MaxPartialBytes > 0 && t.reserved+m.TotalSize > t.cfg.MaxPartialBytes {
+		return nil, ErrTransferBufferFull
+	}
+
+	state := &transferState{
+		peer:      p,
+		manifest:  m,
+		buf:       make([]byte, 0, m.ChunkSize),
+		updatedAt: now,
+	}
+	t.states[key] = state
+	t.perPeer[p]++
+	t.reserved += m.TotalSize
+	return state, nil
+}
+
+func (t *transferTable) remove(p peer.ID, transferID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := transferKey(p, transferID)
+	if state, ok := t.states[key]; ok {
+		t.release(key, state)
+	}
+}
+
+func (t *transferTable) prune(now time.Time) {
+	for key, state := range t.states {
+		if now.Sub(state.updatedAt) > t.cfg.PartialTTL {
+			t.release(key, state)
+		}
+	}
+}
+
+func (t *transferTable) release(key string, state *transferState) {
+	delete(t.states, key)
+	t.reserved -= state.manifest.TotalSize
+	if t.perPeer[state.peer]--; t.perPeer[state.peer] <= 0 {
+		delete(t.perPeer, state.peer)
+	}
+}
+
+func transferKey(p peer.ID, transferID string) string {
+	return fmt.Sprintf("%s/%s", p, transferID)
+}
+
+// SendLarge sends msg as a chunked transfer, resuming from the last
+// acknowledged chunk if the stream is reset, and returns the reply.
+func (h *Handler) SendLarge(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+	transferID := fmt.Sprintf("%s-%d", msg.RequestID, time.Now().UnixNano())
+	manifest := NewTransferManifest(transferID, msg, h.transfer.ChunkSize)
+
+	var lastErr error
+	for attempt := 0; attempt <= h.transfer.MaxResumes; attempt++ {
+		resp, err := h.sendLargeAttempt(ctx, p, manifest, msg.Payload)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+
+		var rejected *TransferError
+		if errors.As(err, &rejected) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+func (h *Handler) sendLargeAttempt(ctx context.Context, p peer.ID, manifest *TransferManifest, data []byte) (*Message, error) {
+	stream, err := h.NewStream(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	decoder, encoder := streamFrames(stream)
+
+	if err := h.sendTransfer(p, manifest, data, h.reader(p, decoder), encoder); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+
+	return h.readReply(ctx, p, decoder, encoder)
+}
+
+func (h *Handler) sendTransfer(p peer.ID, manifest *TransferManifest, data []byte, next frameSource, encoder frameEncoder) error {
+	payload, err := EncodeTransferManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	start := &Message{
+		Type:      MsgTypeTransferStart,
+		RequestID: fmt.Sprintf("%s:start:%d", manifest.TransferID, time.Now().UnixNano()),
+		Payload:   payload,
+	}
+	if err := h.writeMessage(p, encoder, start); err != nil {
+		return err
+	}
+
+	ack, err := h.readAck(next)
+	if err != nil {
+		return err
+	}
+	if ack.Complete {
+		return nil
+	}
+
+	attempt := time.Now().UnixNano()
+	acked := ack.NextChunk
+	sent := acked
+
+	for {
+		for sent < manifest.ChunkCount && sent-acked < h.transfer.Window {
+			chunkData, err := EncodeChunk(manifest.Chunk(data, sent))
+			if err != nil {
+				return err
+			}
+
+			chunk := &Message{
+				Type:      MsgTypeChunk,
+				Flags:     manifest.Flags & FlagEncrypted,
+				RequestID: fmt.Sprintf("%s:%d:%d", manifest.TransferID, attempt, sent),
+				Payload:   chunkData,
+			}
+			if err := h.writeMessage(p, encoder, chunk); err != nil {
+				return err
+			}
+			sent++
+		}
+
+		ack, err := h.readAck(next)
+		if err != nil {
+			return err
+		}
+		if ack.Complete {
+			return nil
+		}
+		acked = ack.NextChunk
+	}
+}
+
+func (h *Handler) readAck(next frameSource) (*TransferAck, error) {
+	msg, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != MsgTypeTransferAck {
+		return nil, fmt.Errorf("expected transfer ack, got message type %d", msg.Type)
+	}
+
+	ack, err := DecodeTransferAck(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if ack.Error != "" {
+		return nil, &TransferError{TransferID: ack.TransferID, Reason: ack.Error}
+	}
+
+	return ack, nil
+}
+
+// receiveTransfer reassembles a chunked transfer announced by start and
+// returns the original message. Each chunk is acknowledged only after it is
+// verified and buffered, which bounds what the sender can have in flight.
+func (h *Handler) receiveTransfer(p peer.ID, start *Message, next frameSource, encoder frameEncoder) (*Message, error) {
+	manifest, err := DecodeTransferManifest(start.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := h.transfers.begin(p, manifest, h.transfer.MaxTransferSize)
+	if err != nil {
+		h.writeAck(p, encoder, &TransferAck{TransferID: manifest.TransferID, Error: err.Error()})
+		return nil, err
+	}
+
+	ack := &TransferAck{TransferID: manifest.TransferID, NextChunk: state.next}
+	for {
+		if state.done() {
+			if err := state.verify(); err != nil {
+				h.transfers.remove(p, manifest.TransferID)
+				h.writeAck(p, encoder, &TransferAck{TransferID: manifest.TransferID, Error: err.Error()})
+				return nil, err
+			}
+			ack.Complete = true
+		}
+
+		if err := h.writeAck(p, encoder, ack); err != nil {
+			return nil, err
+		}
+		if ack.Complete {
+			break
+		}
+
+		msg, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if msg.Type != MsgTypeChunk {
+			return nil, fmt.Errorf("expected chunk, got message type %d", msg.Type)
+		}
+
+		chunk, err := DecodeChunk(msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if chunk.Index < state.next {
+			continue
+		}
+		if err := state.apply(chunk); err != nil {
+			h.transfers.remove(p, manifest.TransferID)
+			h.writeAck(p, encoder, &TransferAck{TransferID: manifest.TransferID, Error: err.Error()})
+			return nil, err
+		}
+
+		ack = &TransferAck{TransferID: manifest.TransferID, NextChunk: state.next}
+	}
+
+	h.transfers.remove(p, manifest.TransferID)
+
+	return &Message{
+		Type:      manifest.Type,
+		Flags:     manifest.Flags,
+		RequestID: manifest.RequestID,
+		Payload:   state.buf,
+		Timestamp: start.Timestamp,
+	}, nil
+}
+
+func (h *Handler) writeAck(p peer.ID, encoder frameEncoder, ack *TransferAck) error {
+	payload, err := EncodeTransferAck(ack)
+	if err != nil {
+		return err
+	}
+
+	return h.writeMessage(p, encoder, &Message{
+		Type:      MsgTypeTransferAck,
+		RequestID: fmt.Sprintf("%s:ack:%d:%d", ack.TransferID, ack.NextChunk, time.Now().UnixNano()),
+		Payload:   payload,
+	})
+}
@@ -1,17 +1,22 @@
 package protocol
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
 )
 
 const (
 	MinSupportedVersion = "1.0.0"
 	MaxSupportedVersion = "1.9.9"
-	CurrentVersion      = "1.1.0"
+	CurrentVersion      = "1.2.0"
 )
 
-var SupportedVersions = []string{"1.0.0", "1.1.0"}
+var SupportedVersions = []string{"1.0.0", "1.1.0", "1.2.0"}
 
 type VersionInfo struct {
 	Version   string   `json:"version"`
@@ -26,7 +31,7 @@ func NewVersionInfo() *VersionInfo {
 }
 
 func (v *VersionInfo) ProtocolID() string {
-	return fmt.Sprintf("/llm-share/%s", v.Version)
+	return ProtocolIDForVersion(v.Version)
 }
 
 func ParseVersion(protocolID string) (string, error) {
@@ -50,11 +55,38 @@ func IsVersionSupported(version string) bool {
 	return false
 }
 
+func ProtocolIDForVersion(version string) string {
+	return fmt.Sprintf("/llm-share/%s", version)
+}
+
+// SupportedProtocolIDs returns the protocol IDs of all supported versions,
+// highest version first, in the order they should be offered to multistream.
+func SupportedProtocolIDs() []string {
+	versions := make([]string, len(SupportedVersions))
+	copy(versions, SupportedVersions)
+	sort.Slice(versions, func(i, j int) bool {
+		return CompareVersions(versions[i], versions[j]) > 0
+	})
+
+	ids := make([]string, 0, len(versions))
+	for _, v := range versions {
+		ids = append(ids, ProtocolIDForVersion(v))
+	}
+	return ids
+}
+
 func NegotiateVersion(remoteVersions []string) (string, error) {
+	var best string
 	for _, remote := range remoteVersions {
-		if IsVersionSupported(remote) {
-			return remote, nil
+		if !IsVersionSupported(remote) {
+			continue
 		}
+		if best == "" || CompareVersions(remote, best) > 0 {
+			best = remote
+		}
+	}
+	if best != "" {
+		return best, nil
 	}
 	return "", fmt.Errorf("no compatible version found (remote: %v, supported: %v)", remoteVersions, SupportedVersions)
 }
@@ -62,7 +94,7 @@ func NegotiateVersion(remoteVersions []string) (string, error) {
 func CompareVersions(v1, v2 string) int {
 	parts1 := strings.Split(v1, ".")
 	parts2 := strings.Split(v2, ".")
-	
+
 	for i := 0; i < 3; i++ {
 		var n1, n2 int
 		if i < len(parts1) {
@@ -119,13 +151,15 @@ const (
 )
 
 type VersionRequest struct {
-	Protocols []string `json:"protocols"`
+	Protocols   []string `json:"protocols"`
+	Compression []string `json:"compression,omitempty"`
 }
 
 type VersionResponse struct {
 	SelectedVersion string `json:"selected_version"`
 	Success         bool   `json:"success"`
 	Error           string `json:"error,omitempty"`
+	Compression     string `json:"compression,omitempty"`
 }
 
 func NewVersionRequest() *VersionRequest {
@@ -141,3 +175,80 @@ func NewVersionResponse(selected string, success bool, errMsg string) *VersionRe
 		Error:           errMsg,
 	}
 }
+
+type versionContextKey struct{}
+
+func ContextWithVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, versionContextKey{}, version)
+}
+
+// VersionFromContext returns the protocol version negotiated with the remote
+// peer of the stream a message handler is running for.
+func VersionFromContext(ctx context.Context) string {
+	version, _ := ctx.Value(versionContextKey{}).(string)
+	return version
+}
+
+// PeerVersions records each peer's protocol version and compression. A
+// version is known as soon as the peer opens a stream to us, but only a
+// handshake settles compression, so peers are also marked once one has
+// completed in either direction.
+type PeerVersions struct {
+	mu          sync.RWMutex
+	versions    map[peer.ID]string
+	compression map[peer.ID]string
+	negotiated  map[peer.ID]bool
+}
+
+func NewPeerVersions() *PeerVersions {
+	return &PeerVersions{
+		versions:    make(map[peer.ID]string),
+		compression: make(map[peer.ID]string),
+		negotiated:  make(map[peer.ID]bool),
+	}
+}
+
+func (v *PeerVersions) Get(p peer.ID) (string, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	version, ok := v.versions[p]
+	return version, ok
+}
+
+func (v *PeerVersions) Set(p peer.ID, version string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.versions[p] = version
+}
+
+func (v *PeerVersions) Negotiated(p peer.ID) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.negotiated[p]
+}
+
+func (v *PeerVersions) SetNegotiated(p peer.ID) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.negotiated[p] = true
+}
+
+func (v *PeerVersions) Compression(p peer.ID) string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.compression[p]
+}
+
+func (v *PeerVersions) SetCompression(p peer.ID, algorithm string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.compression[p] = algorithm
+}
+
+func (v *PeerVersions) Remove(p peer.ID) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.versions, p)
+	delete(v.compression, p)
+	delete(v.negotiated, p)
+}
@@ -0,0 +1,164 @@
+package pubsub
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/your-org/p2p-network/pkg/protocol"
+	"github.com/your-org/p2p-network/pkg/wire"
+)
+
+// Topic payloads use the protobuf schema in pkg/wire. JSON is still decoded
+// for messages from peers running the pre-schema release and is otherwise
+// only produced by wire.EncodeJSON for debugging.
+
+const (
+	TypeProvider  = "provider"
+	TypeRequest   = "request"
+	TypeResponse  = "response"
+	TypeHeartbeat = "heartbeat"
+)
+
+func EncodeProviderMessage(m *ProviderMessage) ([]byte, error) {
+	info := &protocol.ProviderInfo{
+		Model:      m.Model,
+		Address:    m.Address,
+		Protocols:  m.Protocols,
+		Metadata:   m.Metadata,
+		LastSeen:   m.Timestamp,
+		Capacity:   m.Capacity,
+		Load:       m.Load,
+		Price:      m.Price,
+		QueueDepth: m.QueueDepth,
+		QueueWait:  m.QueueWait,
+	}
+	pb, err := info.ToWire()
+	if err != nil {
+		return nil, err
+	}
+	pb.Port = int32(m.Port)
+	pb.TtlSeconds = int64(m.TTL / time.Second)
+	return proto.Marshal(pb)
+}
+
+func DecodeProviderMessage(data []byte) (*ProviderMessage, error) {
+	var m ProviderMessage
+	var pb wire.ProviderInfo
+	legacy, err := wire.Decode(data, &m, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &m, nil
+	}
+
+	info := protocol.ProviderInfoFromWire(&pb)
+	return &ProviderMessage{
+		Type:       TypeProvider,
+		Model:      info.Model,
+		Address:    info.Address,
+		Port:       int(pb.GetPort()),
+		Protocols:  info.Protocols,
+		Metadata:   info.Metadata,
+		Capacity:   info.Capacity,
+		Load:       info.Load,
+		Price:      info.Price,
+		TTL:        time.Duration(pb.GetTtlSeconds()) * time.Second,
+		QueueDepth: info.QueueDepth,
+		QueueWait:  info.QueueWait,
+		Timestamp:  info.LastSeen,
+	}, nil
+}
+
+func EncodeRequestMessage(m *RequestMessage) ([]byte, error) {
+	return proto.Marshal(&wire.Request{
+		Id:        m.RequestID,
+		Model:     m.Model,
+		Params:    m.Payload,
+		Recipient: m.Recipient,
+		Encrypted: m.Encrypted,
+		ReplyTo:   m.ReplyTo,
+	})
+}
+
+func DecodeRequestMessage(data []byte) (*RequestMessage, error) {
+	var m RequestMessage
+	var pb wire.Request
+	legacy, err := wire.Decode(data, &m, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &m, nil
+	}
+
+	return &RequestMessage{
+		Type:      TypeRequest,
+		RequestID: pb.GetId(),
+		Model:     pb.GetModel(),
+		Payload:   pb.GetParams(),
+		Recipient: pb.GetRecipient(),
+		Encrypted: pb.GetEncrypted(),
+		ReplyTo:   pb.GetReplyTo(),
+	}, nil
+}
+
+func EncodeResponseMessage(m *ResponseMessage) ([]byte, error) {
+	pb := &wire.Response{
+		Id:        m.RequestID,
+		Result:    m.Payload,
+		Encrypted: m.Encrypted,
+	}
+	if m.Error != "" {
+		pb.Error = &wire.Error{Message: m.Error}
+	}
+	return proto.Marshal(pb)
+}
+
+func DecodeResponseMessage(data []byte) (*ResponseMessage, error) {
+	var m ResponseMessage
+	var pb wire.Response
+	legacy, err := wire.Decode(data, &m, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &m, nil
+	}
+
+	return &ResponseMessage{
+		Type:      TypeResponse,
+		RequestID: pb.GetId(),
+		Payload:   pb.GetResult(),
+		Error:     pb.GetError().GetMessage(),
+		Encrypted: pb.GetEncrypted(),
+	}, nil
+}
+
+func EncodeHeartbeatMessage(m *HeartbeatMessage) ([]byte, error) {
+	return proto.Marshal(&wire.Heartbeat{
+		PeerId:    m.PeerID,
+		Timestamp: m.Timestamp,
+		Address:   m.Address,
+	})
+}
+
+func DecodeHeartbeatMessage(data []byte) (*HeartbeatMessage, error) {
+	var m HeartbeatMessage
+	var pb wire.Heartbeat
+	legacy, err := wire.Decode(data, &m, &pb)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &m, nil
+	}
+
+	return &HeartbeatMessage{
+		Type:      TypeHeartbeat,
+		PeerID:    pb.GetPeerId(),
+		Timestamp: pb.GetTimestamp(),
+		Address:   pb.GetAddress(),
+	}, nil
+}
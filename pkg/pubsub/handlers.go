@@ -2,9 +2,10 @@ package pubsub
 
 import (
 	"context"
-	"encoding/json"
 	"sync"
 	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
 )
 
 type HandlerRegistry struct {
@@ -70,94 +71,88 @@ func (e *HandlerError) Error() string {
 	return e.msg
 }
 
-func NewProviderHandler() MessageHandler {
-	return func(ctx context.Context, msg *Message) error {
-		var provider ProviderMessage
-		if err := json.Unmarshal(msg.Data, &provider); err != nil {
-			return err
-		}
-
-		provider.ReceivedAt = time.Now()
-		provider.From = string(msg.From)
-
-		return nil
-	}
+func NewProviderHandler(table *ProviderTable) MessageHandler {
+	return table.Handler()
 }
 
-func NewRequestHandler() MessageHandler {
-	return func(ctx context.Context, msg *Message) error {
-		var request RequestMessage
-		if err := json.Unmarshal(msg.Data, &request); err != nil {
-			return err
-		}
-
-		request.ReceivedAt = time.Now()
-		request.From = string(msg.From)
-
-		return nil
-	}
+// NewRequestHandler decodes TopicRequests messages for handler, stamping
+// each with its sender and arrival time.
+func NewRequestHandler(handler TypedHandler[RequestMessage]) MessageHandler {
+	return NewTypedTopic(nil, TopicRequests, RequestCodec).Handler(
+		func(ctx context.Context, from peer.ID, request *RequestMessage) error {
+			request.ReceivedAt = time.Now()
+			request.From = from.String()
+			return handler(ctx, from, request)
+		})
 }
 
-func NewResponseHandler() MessageHandler {
-	return func(ctx context.Context, msg *Message) error {
-		var response ResponseMessage
-		if err := json.Unmarshal(msg.Data, &response); err != nil {
-			return err
-		}
-
-		response.ReceivedAt = time.Now()
-		response.From = string(msg.From)
-
-		return nil
-	}
+func NewResponseHandler(handler TypedHandler[ResponseMessage]) MessageHandler {
+	return NewTypedTopic(nil, TopicResponses, ResponseCodec).Handler(
+		func(ctx context.Context, from peer.ID, response *ResponseMessage) error {
+			response.ReceivedAt = time.Now()
+			response.From = from.String()
+			return handler(ctx, from, response)
+		})
 }
 
-func NewHeartbeatHandler() MessageHandler {
-	return func(ctx context.Context, msg *Message) error {
-		var hb HeartbeatMessage
-		if err := json.Unmarshal(msg.Data, &hb); err != nil {
-			return err
-		}
-
-		hb.ReceivedAt = time.Now()
-
-		return nil
-	}
+func NewHeartbeatHandler(handler TypedHandler[HeartbeatMessage]) MessageHandler {
+	return NewTypedTopic(nil, TopicHeartbeat, HeartbeatCodec).Handler(
+		func(ctx context.Context, from peer.ID, hb *HeartbeatMessage) error {
+			hb.ReceivedAt = time.Now()
+			return handler(ctx, from, hb)
+		})
 }
 
 type ProviderMessage struct {
-	Type      string    `json:"type"`
-	Model     string    `json:"model"`
-	Address   string    `json:"address"`
-	Port      int       `json:"port"`
-	Protocols []string  `json:"protocols"`
+	Type      string                 `json:"type"`
+	Model     string                 `json:"model"`
+	Address   string                 `json:"address"`
+	Port      int                    `json:"port"`
+	Protocols []string               `json:"protocols"`
 	Metadata  map[string]interface{} `json:"metadata,omitempty"`
-	From      string    `json:"-"`
+	Capacity  int                    `json:"capacity,omitempty"`
+	Load      int                    `json:"load,omitempty"`
+	Price     float64                `json:"price,omitempty"`
+	// QueueDepth and QueueWait report requests waiting for a slot and
+	// how long they have recently waited.
+	QueueDepth int           `json:"queue_depth,omitempty"`
+	QueueWait  time.Duration `json:"-"`
+	TTL        time.Duration `json:"-"`
+	// Timestamp is when the origin published the advert, in Unix seconds.
+	// Unlike the time a synced advert was received, it is signed.
+	Timestamp  int64     `json:"timestamp,omitempty"`
+	From       string    `json:"-"`
 	ReceivedAt time.Time `json:"-"`
 }
 
 type RequestMessage struct {
-	Type      string    `json:"type"`
-	RequestID string    `json:"request_id"`
-	Model     string    `json:"model"`
-	Payload   []byte    `json:"payload"`
-	From      string    `json:"-"`
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+	Model     string `json:"model"`
+	Payload   []byte `json:"payload"`
+	// Recipient is the provider an encrypted payload is sealed to.
+	Recipient string `json:"recipient,omitempty"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+	// ReplyTo is the requester, for providers that reply over a stream.
+	ReplyTo    string    `json:"reply_to,omitempty"`
+	From       string    `json:"-"`
 	ReceivedAt time.Time `json:"-"`
 }
 
 type ResponseMessage struct {
-	Type      string    `json:"type"`
-	RequestID string    `json:"request_id"`
-	Payload   []byte    `json:"payload"`
-	Error     string    `json:"error,omitempty"`
-	From      string    `json:"-"`
+	Type       string    `json:"type"`
+	RequestID  string    `json:"request_id"`
+	Payload    []byte    `json:"payload"`
+	Error      string    `json:"error,omitempty"`
+	Encrypted  bool      `json:"encrypted,omitempty"`
+	From       string    `json:"-"`
 	ReceivedAt time.Time `json:"-"`
 }
 
 type HeartbeatMessage struct {
-	Type      string    `json:"type"`
-	PeerID    string    `json:"peer_id"`
-	Timestamp int64     `json:"timestamp"`
-	Address   string    `json:"address,omitempty"`
+	Type       string    `json:"type"`
+	PeerID     string    `json:"peer_id"`
+	Timestamp  int64     `json:"timestamp"`
+	Address    string    `json:"address,omitempty"`
 	ReceivedAt time.Time `json:"-"`
 }
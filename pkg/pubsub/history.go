@@ -0,0 +1,156 @@
+package pubsub
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type historyEntry struct {
+	msg *Message
+	at  time.Time
+}
+
+// topicHistory keeps a topic's recent messages in the order they were
+// received, bounded by count and age. It also remembers which message IDs it
+// holds, so that synced messages already received are not delivered again.
+type topicHistory struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries []historyEntry
+	ids     map[string]struct{}
+}
+
+func newTopicHistory(size int, ttl time.Duration) *topicHistory {
+	return &topicHistory{
+		size: size,
+		ttl:  ttl,
+		ids:  make(map[string]struct{}),
+	}
+}
+
+// add records msg as received at at and reports whether it is new. A message
+// received again, as happens once the router has forgotten a content ID,
+// moves to the newer time. Messages without an ID, or already too old to
+// keep, are new but not recorded.
+func (h *topicHistory) add(msg *Message, at time.Time) bool {
+	if h == nil || msg.ID == "" {
+		return true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	h.prune(now)
+
+	if _, ok := h.ids[msg.ID]; ok {
+		h.refresh(msg, at)
+		return false
+	}
+	if h.ttl > 0 && now.Sub(at) >= h.ttl {
+		return true
+	}
+
+	h.insert(msg, at)
+	return true
+}
+
+// refresh moves the entry with the ID of msg to at if that is newer.
+func (h *topicHistory) refresh(msg *Message, at time.Time) {
+	for i, e := range h.entries {
+		if e.msg.ID != msg.ID {
+			continue
+		}
+		if at.After(e.at) {
+			h.entries = append(h.entries[:i], h.entries[i+1:]...)
+			h.insert(msg, at)
+		}
+		return
+	}
+}
+
+// insert adds msg in order of at, since synced messages may be older than
+// ones already received, and drops the oldest messages over the size.
+func (h *topicHistory) insert(msg *Message, at time.Time) {
+	i := sort.Search(len(h.entries), func(i int) bool {
+		return h.entries[i].at.After(at)
+	})
+	h.entries = append(h.entries, historyEntry{})
+	copy(h.entries[i+1:], h.entries[i:])
+	h.entries[i] = historyEntry{msg: msg, at: at}
+	h.ids[msg.ID] = struct{}{}
+
+	if over := len(h.entries) - h.size; over > 0 {
+		h.drop(over)
+	}
+}
+
+// since returns the messages received after t, oldest first. With a
+// positive limit only the newest limit messages are returned.
+func (h *topicHistory) since(t time.Time, limit int) []historyEntry {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.prune(time.Now())
+	i := sort.Search(len(h.entries), func(i int) bool {
+		return h.entries[i].at.After(t)
+	})
+	entries := h.entries[i:]
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return append([]historyEntry(nil), entries...)
+}
+
+func (h *topicHistory) len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.entries)
+}
+
+// prune drops the messages that have outlived the TTL.
+func (h *topicHistory) prune(now time.Time) {
+	if h.ttl <= 0 {
+		return
+	}
+	n := 0
+	for n < len(h.entries) && now.Sub(h.entries[n].at) >= h.ttl {
+		n++
+	}
+	h.drop(n)
+}
+
+// drop removes the oldest n messages.
+func (h *topicHistory) drop(n int) {
+	if n <= 0 {
+		return
+	}
+	for _, e := range h.entries[:n] {
+		delete(h.ids, e.msg.ID)
+	}
+	kept := copy(h.entries, h.entries[n:])
+	clear(h.entries[kept:])
+	h.entries = h.entries[:kept]
+}
+
+// recordHistory adds msg to the history of its topic, if the topic keeps
+// one, and reports whether the history did not hold it yet.
+func (m *PubSubManager) recordHistory(msg *Message, at time.Time) bool {
+	return m.histories[msg.Topic].add(msg, at)
+}
+
+// HistoryLen returns how many messages of topic are kept for syncing peers.
+func (m *PubSubManager) HistoryLen(topic string) int {
+	h, ok := m.histories[topic]
+	if !ok {
+		return 0
+	}
+	return h.len()
+}
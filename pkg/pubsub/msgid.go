@@ -0,0 +1,57 @@
+package pubsub
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+
+	"github.com/your-org/p2p-network/pkg/utils"
+)
+
+// DefaultSeenMessagesTTL is how long the router remembers message IDs. It is
+// shorter than DefaultAdvertInterval so that an unchanged advert published
+// each interval under ContentMessageID still refreshes provider tables.
+const DefaultSeenMessagesTTL = 20 * time.Second
+
+// MessageIDFunc computes the ID the router deduplicates messages by: a
+// message whose ID was seen within the seen-messages TTL is dropped. Every
+// node must use the same function for a topic.
+type MessageIDFunc func(msg *Message) string
+
+// DefaultMessageID is the router's default, the origin and sequence number,
+// under which every publish is a new message.
+func DefaultMessageID(msg *Message) string {
+	if len(msg.From) == 0 && len(msg.Seqno) == 0 {
+		return ""
+	}
+	return string(msg.From) + string(msg.Seqno)
+}
+
+// ContentMessageID identifies a message by its origin and a hash of its
+// data, so an origin republishing the same content is deduplicated. It suits
+// topics whose messages are idempotent.
+func ContentMessageID(msg *Message) string {
+	return string(msg.From) + string(utils.ComputeHash(msg.Data))
+}
+
+func routerMessageID(fn MessageIDFunc) pubsub.MsgIdFunction {
+	return func(pmsg *pb.Message) string {
+		return fn(&Message{
+			Data:      pmsg.GetData(),
+			From:      pmsg.GetFrom(),
+			Seqno:     pmsg.GetSeqno(),
+			Topic:     pmsg.GetTopic(),
+			Signature: pmsg.GetSignature(),
+			Key:       pmsg.GetKey(),
+		})
+	}
+}
+
+// messageID computes the ID of msg with the function of its topic.
+func (m *PubSubManager) messageID(msg *Message) string {
+	if fn, ok := m.messageIDs[msg.Topic]; ok {
+		return fn(msg)
+	}
+	return m.defaultMessageID(msg)
+}
@@ -0,0 +1,299 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	DefaultAdvertInterval = 30 * time.Second
+	DefaultAdvertTTL      = 3 * DefaultAdvertInterval
+)
+
+// ProviderRecord is the latest advertisement of one model by one peer.
+type ProviderRecord struct {
+	Peer       peer.ID
+	Model      string
+	Address    string
+	Protocols  []string
+	Metadata   map[string]interface{}
+	Capacity   int
+	Load       int
+	Price      float64
+	QueueDepth int
+	QueueWait  time.Duration
+	LastSeen   time.Time
+	ExpiresAt  time.Time
+}
+
+// ProviderTable holds the providers announced on TopicProviders. Records
+// expire after the TTL carried in the advertisement, or the table's default
+// TTL for peers that do not send one, unless refreshed by a newer advert.
+type ProviderTable struct {
+	ttl time.Duration
+
+	mu     sync.RWMutex
+	models map[string]map[peer.ID]*ProviderRecord
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewProviderTable(ttl time.Duration) *ProviderTable {
+	if ttl <= 0 {
+		ttl = DefaultAdvertTTL
+	}
+
+	return &ProviderTable{
+		ttl:    ttl,
+		models: make(map[string]map[peer.ID]*ProviderRecord),
+	}
+}
+
+// Update records msg as the current advertisement of msg.Model by from.
+func (t *ProviderTable) Update(from peer.ID, msg *ProviderMessage, now time.Time) {
+	ttl := msg.TTL
+	if ttl <= 0 {
+		ttl = t.ttl
+	}
+
+	record := &ProviderRecord{
+		Peer:       from,
+		Model:      msg.Model,
+		Address:    msg.Address,
+		Protocols:  msg.Protocols,
+		Metadata:   msg.Metadata,
+		Capacity:   msg.Capacity,
+		Load:       msg.Load,
+		Price:      msg.Price,
+		QueueDepth: msg.QueueDepth,
+		QueueWait:  msg.QueueWait,
+		LastSeen:   now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	peers, ok := t.models[msg.Model]
+	if !ok {
+		peers = make(map[peer.ID]*ProviderRecord)
+		t.models[msg.Model] = peers
+	}
+	// A synced advert may be older than the one already held.
+	if existing, ok := peers[from]; ok && existing.LastSeen.After(now) {
+		return
+	}
+	peers[from] = record
+}
+
+// Providers returns the live providers of model ordered by peer ID.
+func (t *ProviderTable) Providers(model string) []ProviderRecord {
+	now := time.Now()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	records := make([]ProviderRecord, 0, len(t.models[model]))
+	for _, record := range t.models[model] {
+		if now.Before(record.ExpiresAt) {
+			records = append(records, *record)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Peer < records[j].Peer
+	})
+	return records
+}
+
+// Models returns the number of live providers for every model that has one.
+func (t *ProviderTable) Models() map[string]int {
+	now := time.Now()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	models := make(map[string]int, len(t.models))
+	for model, peers := range t.models {
+		for _, record := range peers {
+			if now.Before(record.ExpiresAt) {
+				models[model]++
+			}
+		}
+	}
+	return models
+}
+
+// Remove drops every record announced by p.
+func (t *ProviderTable) Remove(p peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for model, peers := range t.models {
+		delete(peers, p)
+		if len(peers) == 0 {
+			delete(t.models, model)
+		}
+	}
+}
+
+// Prune drops expired records and returns how many were removed.
+func (t *ProviderTable) Prune(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pruned := 0
+	for model, peers := range t.models {
+		for p, record := range peers {
+			if !now.Before(record.ExpiresAt) {
+				delete(peers, p)
+				pruned++
+			}
+		}
+		if len(peers) == 0 {
+			delete(t.models, model)
+		}
+	}
+	return pruned
+}
+
+// Handler returns a MessageHandler for TopicProviders that feeds the table.
+func (t *ProviderTable) Handler() MessageHandler {
+	return NewTypedTopic(nil, TopicProviders, ProviderCodec).Handler(t.Handle)
+}
+
+// Handle records an advert received from a peer. Adverts synced from peers
+// are dated from when they were first received, but never more than
+// MaxAdvertSkew after the time their origin signed.
+func (t *ProviderTable) Handle(ctx context.Context, from peer.ID, provider *ProviderMessage) error {
+	if from == "" {
+		return fmt.Errorf("provider advert has no sender")
+	}
+
+	seen := time.Now()
+	if at, ok := ReceivedAtFromContext(ctx); ok {
+		seen = at
+	}
+	if provider.Timestamp > 0 {
+		if latest := time.Unix(provider.Timestamp, 0).Add(MaxAdvertSkew); seen.After(latest) {
+			seen = latest
+		}
+	}
+	t.Update(from, provider, seen)
+	return nil
+}
+
+// Start prunes expired records every interval until Stop is called.
+func (t *ProviderTable) Start(ctx context.Context, interval time.Duration) {
+	ctx, t.cancel = context.WithCancel(ctx)
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				t.Prune(now)
+			}
+		}
+	}()
+}
+
+func (t *ProviderTable) Stop() {
+	if t.cancel != nil {
+		t.cancel()
+	}
+	t.wg.Wait()
+}
+
+// AdvertSource returns the adverts describing what this node currently
+// serves, one per model.
+type AdvertSource func() []*ProviderMessage
+
+// Announcer periodically publishes this node's adverts to TopicProviders.
+type Announcer struct {
+	topic    *TypedTopic[ProviderMessage]
+	source   AdvertSource
+	interval time.Duration
+	ttl      time.Duration
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewAnnouncer(manager *PubSubManager, source AdvertSource, interval, ttl time.Duration) *Announcer {
+	if interval <= 0 {
+		interval = DefaultAdvertInterval
+	}
+	if ttl <= 0 {
+		ttl = 3 * interval
+	}
+
+	return &Announcer{
+		topic:    ProviderTopic(manager),
+		source:   source,
+		interval: interval,
+		ttl:      ttl,
+	}
+}
+
+// Announce publishes the current adverts once.
+func (a *Announcer) Announce() error {
+	for _, msg := range a.source() {
+		msg.Type = TypeProvider
+		msg.Timestamp = time.Now().Unix()
+		if msg.TTL <= 0 {
+			msg.TTL = a.ttl
+		}
+
+		if err := a.topic.Publish(context.Background(), msg); err != nil {
+			return fmt.Errorf("publish advert for %s: %w", msg.Model, err)
+		}
+	}
+	return nil
+}
+
+// Start announces immediately and then every interval until Stop is called.
+// onError, if set, receives failed announcements.
+func (a *Announcer) Start(ctx context.Context, onError func(error)) {
+	ctx, a.cancel = context.WithCancel(ctx)
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := a.Announce(); err != nil && onError != nil {
+				onError(err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (a *Announcer) Stop() {
+	if a.cancel != nil {
+		a.cancel()
+	}
+	a.wg.Wait()
+}
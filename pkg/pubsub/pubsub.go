@@ -2,188 +2,430 @@ package pubsub
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-pubsub"
-	"github.com/libp2p/go-libp2p-pubsub/pb"
+
+	"github.com/your-org/p2p-network/pkg/protocol"
+	"github.com/your-org/p2p-network/pkg/utils"
 )
 
 type MessageHandler func(ctx context.Context, msg *Message) error
 
+// PublishOption configures a single publish, for example to wait until the
+// topic has enough peers with pubsub.WithReadiness.
+type PublishOption = pubsub.PubOpt
+
+var ErrManagerClosed = errors.New("pubsub manager closed")
+
+// PubSubManager joins each topic once and publishes and subscribes through
+// the joined handle. It is safe for concurrent use.
 type PubSubManager struct {
-	pubsub     *pubsub.PubSub
-	subs       map[string]*Subscription
-	handlers   map[string]MessageHandler
+	pubsub *pubsub.PubSub
+	host   host.Host
+	self   peer.ID
+	// ctx bounds every subscription; it is the context New was given.
+	ctx context.Context
+
+	mu           sync.RWMutex
+	topics       map[string]*pubsub.Topic
+	subs         map[string]*Subscription
+	topicConfigs map[string]*TopicConfig
+	closed       bool
+
+	validationMu sync.RWMutex
+	validation   map[string]*validationCounters
+	limiters     map[string]*topicLimiters
+
+	decodeMu     sync.Mutex
+	decodeErrors map[string]*uint64
+
+	statsMu sync.Mutex
+	stats   map[string]*subscriptionCounters
+
+	rateLimits     RateLimitConfig
+	violations     *violations
+	publishLimiter *rateLimiter
+
+	// histories and messageIDs are keyed by topic and fixed once the
+	// manager is created.
+	histories        map[string]*topicHistory
+	messageIDs       map[string]MessageIDFunc
+	defaultMessageID MessageIDFunc
+	signMessages     bool
+	syncConfig       SyncConfig
+	syncMu           sync.RWMutex
+	direct           *protocol.Handler
+
+	scoresMu sync.RWMutex
+	scores   map[peer.ID]PeerScore
+	metrics  *utils.Metrics
 }
 
 func NewManager(ps *pubsub.PubSub) *PubSubManager {
 	return &PubSubManager{
-		pubsub:   ps,
-		subs:     make(map[string]*Subscription),
-		handlers: make(map[string]MessageHandler),
+		pubsub:           ps,
+		ctx:              context.Background(),
+		topics:           make(map[string]*pubsub.Topic),
+		subs:             make(map[string]*Subscription),
+		topicConfigs:     make(map[string]*TopicConfig),
+		validation:       make(map[string]*validationCounters),
+		limiters:         make(map[string]*topicLimiters),
+		decodeErrors:     make(map[string]*uint64),
+		stats:            make(map[string]*subscriptionCounters),
+		violations:       newViolations(0),
+		histories:        make(map[string]*topicHistory),
+		messageIDs:       make(map[string]MessageIDFunc),
+		defaultMessageID: DefaultMessageID,
+		syncConfig:       DefaultSyncConfig(),
+		scores:           make(map[peer.ID]PeerScore),
 	}
 }
 
-func (m *PubSubManager) Subscribe(topic string, handler MessageHandler) (*Subscription, error) {
-	if m.pubsub == nil {
-		return nil, nil
+type managerConfig struct {
+	topics          map[string]*TopicConfig
+	signMessages    bool
+	validate        bool
+	peerScoring     bool
+	thresholds      ScoreThresholds
+	inspectInterval time.Duration
+	metrics         *utils.Metrics
+	rateLimits      RateLimitConfig
+	sync            SyncConfig
+	messageID       MessageIDFunc
+	seenTTL         time.Duration
+	routerOptions   []pubsub.Option
+}
+
+type ManagerOption func(*managerConfig)
+
+// WithTopicConfigs replaces DefaultTopicConfigs as the source of validators
+// and score parameters.
+func WithTopicConfigs(configs map[string]*TopicConfig) ManagerOption {
+	return func(c *managerConfig) {
+		c.topics = configs
 	}
+}
 
-	sub, err := m.pubsub.Subscribe(topic)
-	if err != nil {
-		return nil, err
+func WithMessageSigning(enabled bool) ManagerOption {
+	return func(c *managerConfig) {
+		c.signMessages = enabled
 	}
+}
 
-	subscription := &Subscription{
-		topic:    topic,
-		sub:      sub,
-		handler:  handler,
-		messages: make(chan *Message, 100),
+func WithValidation(enabled bool) ManagerOption {
+	return func(c *managerConfig) {
+		c.validate = enabled
 	}
+}
 
-	m.subs[topic] = subscription
-	m.handlers[topic] = handler
+func WithPeerScoring(enabled bool, thresholds ScoreThresholds) ManagerOption {
+	return func(c *managerConfig) {
+		c.peerScoring = enabled
+		c.thresholds = thresholds
+	}
+}
 
-	go subscription.readLoop()
+func WithScoreInspectInterval(interval time.Duration) ManagerOption {
+	return func(c *managerConfig) {
+		c.inspectInterval = interval
+	}
+}
 
-	return subscription, nil
+func WithMetrics(metrics *utils.Metrics) ManagerOption {
+	return func(c *managerConfig) {
+		c.metrics = metrics
+	}
 }
 
-func (m *PubSubManager) Publish(topic string, data []byte) error {
-	if m.pubsub == nil {
-		return nil
+// WithRateLimits limits local publishing and sets how peers exceeding the
+// topic rate limits are penalised.
+func WithRateLimits(limits RateLimitConfig) ManagerOption {
+	return func(c *managerConfig) {
+		c.rateLimits = limits
 	}
+}
 
-	return m.pubsub.Publish(topic, data)
+// WithSyncConfig sets how topic history is synced with peers.
+func WithSyncConfig(cfg SyncConfig) ManagerOption {
+	return func(c *managerConfig) {
+		c.sync = cfg
+	}
 }
 
-func (m *PubSubManager) PublishWithOptions(topic string, data []byte, opts ...PublishOption) error {
-	if m.pubsub == nil {
-		return nil
+// WithMessageIDFunc sets the message ID function of the topics whose config
+// has none. It defaults to DefaultMessageID.
+func WithMessageIDFunc(fn MessageIDFunc) ManagerOption {
+	return func(c *managerConfig) {
+		c.messageID = fn
 	}
+}
 
-	msg := &pb.Message{
-		Data: data,
+// WithSeenMessagesTTL sets how long the router remembers the IDs of the
+// messages it has seen.
+func WithSeenMessagesTTL(ttl time.Duration) ManagerOption {
+	return func(c *managerConfig) {
+		c.seenTTL = ttl
 	}
+}
 
+// WithRouterOptions passes extra options to the gossipsub router.
+func WithRouterOptions(opts ...pubsub.Option) ManagerOption {
+	return func(c *managerConfig) {
+		c.routerOptions = append(c.routerOptions, opts...)
+	}
+}
+
+// New creates a gossipsub router on h and a manager for it. Unless disabled,
+// topic validators are registered and peers are scored with parameters
+// built from the topic configs.
+func New(ctx context.Context, h host.Host, opts ...ManagerOption) (*PubSubManager, error) {
+	cfg := managerConfig{
+		signMessages:    true,
+		validate:        true,
+		peerScoring:     true,
+		thresholds:      DefaultScoreThresholds(),
+		inspectInterval: DefaultScoreInspectInterval,
+		rateLimits:      DefaultRateLimitConfig(),
+		sync:            DefaultSyncConfig(),
+		seenTTL:         DefaultSeenMessagesTTL,
+	}
 	for _, opt := range opts {
-		opt(msg)
+		opt(&cfg)
+	}
+	if cfg.topics == nil {
+		cfg.topics = DefaultTopicConfigs()
+	}
+	if cfg.inspectInterval <= 0 {
+		cfg.inspectInterval = DefaultScoreInspectInterval
+	}
+	if cfg.sync == (SyncConfig{}) {
+		cfg.sync = DefaultSyncConfig()
 	}
 
-	return m.pubsub.Publish(topic, msg)
-}
+	m := NewManager(nil)
+	m.ctx = ctx
+	m.host = h
+	if h != nil {
+		m.self = h.ID()
+	}
+	m.metrics = cfg.metrics
+	m.rateLimits = cfg.rateLimits
+	m.violations = newViolations(cfg.rateLimits.ViolationWindow)
+	m.publishLimiter = newRateLimiter(cfg.rateLimits.Publish)
+	m.signMessages = cfg.signMessages
+	m.syncConfig = cfg.sync
+	if cfg.messageID != nil {
+		m.defaultMessageID = cfg.messageID
+	}
+	for name, topic := range cfg.topics {
+		m.topicConfigs[name] = topic
+		if topic.HistorySize > 0 {
+			m.histories[name] = newTopicHistory(topic.HistorySize, topic.HistoryTTL)
+		}
+		if topic.MessageID != nil {
+			m.messageIDs[name] = topic.MessageID
+		}
+	}
 
-func (m *PubSubManager) Unsubscribe(topic string) error {
-	sub, ok := m.subs[topic]
-	if !ok {
-		return nil
+	routerOptions := []pubsub.Option{
+		pubsub.WithMessageSigning(cfg.signMessages),
+		pubsub.WithStrictSignatureVerification(cfg.signMessages),
 	}
+	if cfg.messageID != nil {
+		routerOptions = append(routerOptions, pubsub.WithMessageIdFn(routerMessageID(cfg.messageID)))
+	}
+	if cfg.seenTTL > 0 {
+		routerOptions = append(routerOptions, pubsub.WithSeenMessagesTTL(cfg.seenTTL))
+	}
+	if cfg.peerScoring {
+		params, err := BuildPeerScoreParams(cfg.topics)
+		if err != nil {
+			return nil, err
+		}
+		params.AppSpecificScore = m.appSpecificScore
+		routerOptions = append(routerOptions,
+			pubsub.WithPeerScore(params, cfg.thresholds.params()),
+			pubsub.WithPeerScoreInspect(pubsub.ExtendedPeerScoreInspectFn(m.inspectScores), cfg.inspectInterval),
+		)
+	}
+	routerOptions = append(routerOptions, cfg.routerOptions...)
 
-	delete(m.subs, topic)
-	delete(m.handlers, topic)
+	ps, err := pubsub.NewGossipSub(ctx, h, routerOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("create gossipsub: %w", err)
+	}
+	m.pubsub = ps
 
-	return sub.Cancel()
+	if cfg.validate {
+		if err := m.RegisterValidators(cfg.topics); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
 }
 
-func (m *PubSubManager) GetTopics() []string {
-	if m.pubsub == nil {
-		return nil
+// join returns the handle for topic, joining it on first use. The caller
+// must hold m.mu.
+func (m *PubSubManager) join(topic string) (*pubsub.Topic, error) {
+	if m.closed {
+		return nil, ErrManagerClosed
 	}
 
-	return m.pubsub.GetTopics()
-}
+	if t, ok := m.topics[topic]; ok {
+		return t, nil
+	}
 
-func (m *PubSubManager) ListPeers(topic string) []string {
-	if m.pubsub == nil {
-		return nil
+	var opts []pubsub.TopicOpt
+	if fn, ok := m.messageIDs[topic]; ok {
+		opts = append(opts, pubsub.WithTopicMessageIdFn(routerMessageID(fn)))
 	}
 
-	return m.pubsub.ListPeers(topic)
+	t, err := m.pubsub.Join(topic, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("join %s: %w", topic, err)
+	}
+	m.topics[topic] = t
+	return t, nil
+}
+
+func (m *PubSubManager) topic(topic string) (*pubsub.Topic, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.join(topic)
 }
 
-func (m *PubSubManager) TopicScore(topic string) (*pubsub.TopicScoreSnapshot, error) {
+// Subscribe subscribes to topic, or adds handler to the existing
+// subscription if the topic is already subscribed. Each message is passed to
+// every handler in the order they were added; opts only apply to a new
+// subscription.
+func (m *PubSubManager) Subscribe(topic string, handler MessageHandler, opts ...SubscribeOption) (*Subscription, error) {
 	if m.pubsub == nil {
 		return nil, nil
 	}
 
-	topicOpts, err := m.pubsub.Topic(topic)
-	if err != nil {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.subs[topic]; ok {
+		s.addHandler(handler)
+		return s, nil
+	}
+	if err := m.ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	return topicOpts.Score(), nil
-}
+	t, err := m.join(topic)
+	if err != nil {
+		return nil, err
+	}
 
-func (m *PubSubManager) SetTopicScore(topic string, params *pubsub.TopicScoreParams) error {
-	if m.pubsub == nil {
-		return nil
+	sub, err := t.Subscribe()
+	if err != nil {
+		return nil, fmt.Errorf("subscribe %s: %w", topic, err)
 	}
 
-	return m.pubsub.SetTopicScore(topic, params)
+	s := newSubscription(m, topic, sub, opts)
+	s.addHandler(handler)
+	m.subs[topic] = s
+	s.start()
+
+	return s, nil
 }
 
-type Subscription struct {
-	topic    string
-	sub      *pubsub.Subscription
-	handler  MessageHandler
-	messages chan *Message
-	ctx      context.Context
-	cancel   context.CancelFunc
+func (m *PubSubManager) Publish(topic string, data []byte) error {
+	return m.PublishWithOptions(context.Background(), topic, data)
 }
 
-func (s *Subscription) readLoop() {
-	s.ctx, s.cancel = context.WithCancel(context.Background())
+func (m *PubSubManager) PublishWithOptions(ctx context.Context, topic string, data []byte, opts ...PublishOption) error {
+	if m.pubsub == nil {
+		return nil
+	}
 
-	for {
-		msg, err := s.sub.Next(s.ctx)
-		if err != nil {
-			if s.ctx.Err() != nil {
-				return
-			}
-			continue
-		}
+	if err := m.allowPublish(topic); err != nil {
+		return fmt.Errorf("publish to %s: %w", topic, err)
+	}
 
-		message := &Message{
-			ID:          msg.ID,
-			Data:        msg.Data,
-			From:        msg.From,
-			Seqno:       msg.Seqno,
-			Topic:       s.topic,
-			Signature:   msg.Signature,
-			Key:         msg.Key,
-			ReceivedAt:  msg.ReceivedAt,
-		}
+	t, err := m.topic(topic)
+	if err != nil {
+		return err
+	}
 
-		if s.handler != nil {
-			if err := s.handler(s.ctx, message); err != nil {
-				continue
-			}
-		}
+	return t.Publish(ctx, data, opts...)
+}
 
-		select {
-		case s.messages <- message:
-		default:
-		}
+// Unsubscribe cancels the subscription to topic and waits for its handlers
+// to return, so it must not be called from one of them; see
+// Subscription.CancelAsync. The topic stays joined for publishing.
+func (m *PubSubManager) Unsubscribe(topic string) error {
+	m.mu.Lock()
+	s, ok := m.subs[topic]
+	if ok {
+		delete(m.subs, topic)
 	}
+	m.mu.Unlock()
+
+	if ok {
+		s.stop()
+	}
+	return nil
 }
 
-func (s *Subscription) Messages() <-chan *Message {
-	return s.messages
+func (m *PubSubManager) remove(s *Subscription) {
+	m.mu.Lock()
+	if m.subs[s.topic] == s {
+		delete(m.subs, s.topic)
+	}
+	m.mu.Unlock()
 }
 
-func (s *Subscription) Cancel() error {
-	if s.cancel != nil {
-		s.cancel()
+// Close cancels every subscription and leaves every joined topic. Subscribe
+// and Publish fail with ErrManagerClosed afterwards.
+func (m *PubSubManager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	subs, topics := m.subs, m.topics
+	m.subs = make(map[string]*Subscription)
+	m.topics = make(map[string]*pubsub.Topic)
+	m.mu.Unlock()
+
+	for _, s := range subs {
+		s.stop()
 	}
 
-	if s.sub != nil {
-		return s.sub.Cancel()
+	var firstErr error
+	for name, t := range topics {
+		if err := t.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("leave %s: %w", name, err)
+		}
 	}
+	return firstErr
+}
 
-	return nil
+func (m *PubSubManager) GetTopics() []string {
+	if m.pubsub == nil {
+		return nil
+	}
+
+	return m.pubsub.GetTopics()
 }
 
-func (s *Subscription) Topic() string {
-	return s.topic
+func (m *PubSubManager) ListPeers(topic string) []peer.ID {
+	if m.pubsub == nil {
+		return nil
+	}
+
+	return m.pubsub.ListPeers(topic)
 }
 
 type Message struct {
@@ -0,0 +1,205 @@
+package pubsub
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var ErrPublishRateLimited = errors.New("publish rate limit exceeded")
+
+// rateLimiterPruneInterval is how often idle buckets are dropped.
+const rateLimiterPruneInterval = time.Minute
+
+// RateLimit is a token bucket allowing Rate messages per second on average
+// and bursts of up to Burst. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per key, such as a peer or a topic.
+type rateLimiter struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &rateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	if l == nil || !l.limit.enabled() {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) >= rateLimiterPruneInterval {
+		l.prune(now)
+	}
+
+	burst := float64(l.limit.Burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.limit.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops buckets that have refilled, which behave like new ones.
+func (l *rateLimiter) prune(now time.Time) {
+	refill := time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// RateLimitConfig limits what the node publishes and how it treats peers
+// exceeding the per-topic limits of their TopicConfig.
+type RateLimitConfig struct {
+	// Publish limits local publishes on each topic.
+	Publish RateLimit
+	// A peer exceeding a limit more than MaxViolations times within
+	// ViolationWindow is disconnected. Zero never disconnects.
+	MaxViolations   int
+	ViolationWindow time.Duration
+	// ViolationPenalty is taken off a peer's application-specific gossipsub
+	// score for each violation in the current window.
+	ViolationPenalty float64
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Publish:          RateLimit{Rate: 100, Burst: 200},
+		MaxViolations:    50,
+		ViolationWindow:  time.Minute,
+		ViolationPenalty: 10,
+	}
+}
+
+type violationWindow struct {
+	count int
+	start time.Time
+}
+
+// violations counts rate limit violations per peer over a fixed window.
+type violations struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	peers map[peer.ID]*violationWindow
+}
+
+func newViolations(window time.Duration) *violations {
+	if window <= 0 {
+		window = DefaultRateLimitConfig().ViolationWindow
+	}
+	return &violations{
+		window: window,
+		peers:  make(map[peer.ID]*violationWindow),
+	}
+}
+
+// add records a violation by p and returns the count in the current window.
+func (v *violations) add(p peer.ID, now time.Time) int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	w, ok := v.peers[p]
+	if !ok || now.Sub(w.start) >= v.window {
+		w = &violationWindow{start: now}
+		v.peers[p] = w
+	}
+	w.count++
+	return w.count
+}
+
+func (v *violations) count(p peer.ID, now time.Time) int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	w, ok := v.peers[p]
+	if !ok {
+		return 0
+	}
+	if now.Sub(w.start) >= v.window {
+		delete(v.peers, p)
+		return 0
+	}
+	return w.count
+}
+
+func (v *violations) reset(p peer.ID) {
+	v.mu.Lock()
+	delete(v.peers, p)
+	v.mu.Unlock()
+}
+
+// recordViolation notes that p exceeded a rate limit and disconnects it once
+// it has done so too often.
+func (m *PubSubManager) recordViolation(p peer.ID) {
+	n := m.violations.add(p, time.Now())
+	if m.rateLimits.MaxViolations <= 0 || n <= m.rateLimits.MaxViolations {
+		return
+	}
+
+	m.violations.reset(p)
+	if m.host != nil {
+		m.host.Network().ClosePeer(p)
+	}
+}
+
+// RateLimitViolations returns how many times p has exceeded a rate limit in
+// the current window.
+func (m *PubSubManager) RateLimitViolations(p peer.ID) int {
+	return m.violations.count(p, time.Now())
+}
+
+// appSpecificScore penalises peers for their rate limit violations.
+func (m *PubSubManager) appSpecificScore(p peer.ID) float64 {
+	return -m.rateLimits.ViolationPenalty * float64(m.violations.count(p, time.Now()))
+}
+
+func (m *PubSubManager) allowPublish(topic string) error {
+	if !m.publishLimiter.allow(topic, time.Now()) {
+		return ErrPublishRateLimited
+	}
+	return nil
+}
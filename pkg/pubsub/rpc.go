@@ -0,0 +1,286 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/your-org/p2p-network/pkg/protocol"
+)
+
+// Requests are published on TopicRequests for every provider to see. A
+// provider answers the requester directly over the request-response
+// protocol when the request names its own origin as ReplyTo and the origin
+// is reachable, and publishes on TopicResponses otherwise.
+
+const DefaultRPCTimeout = 30 * time.Second
+
+var ErrNoResponses = errors.New("no responses before the deadline")
+
+// CollectMode decides when Request stops waiting for responses.
+type CollectMode int
+
+const (
+	// CollectFirst returns once the number of responses given to WithFirst
+	// has arrived.
+	CollectFirst CollectMode = iota
+	// CollectAll returns every response that arrives before the deadline.
+	CollectAll
+)
+
+type requestConfig struct {
+	mode    CollectMode
+	count   int
+	timeout time.Duration
+}
+
+type RequestOption func(*requestConfig)
+
+// WithFirst returns after the first n responses.
+func WithFirst(n int) RequestOption {
+	return func(c *requestConfig) {
+		c.mode = CollectFirst
+		c.count = n
+	}
+}
+
+// WithAll collects responses until the deadline.
+func WithAll() RequestOption {
+	return func(c *requestConfig) {
+		c.mode = CollectAll
+	}
+}
+
+// WithRequestTimeout bounds the wait when the context has no earlier
+// deadline.
+func WithRequestTimeout(timeout time.Duration) RequestOption {
+	return func(c *requestConfig) {
+		c.timeout = timeout
+	}
+}
+
+// RPCHandler answers a request received on TopicRequests. Returning a nil
+// response leaves the request unanswered; an error is sent back as an error
+// response.
+type RPCHandler func(ctx context.Context, from peer.ID, req *RequestMessage) (*ResponseMessage, error)
+
+// RPC correlates requests published on TopicRequests with their responses.
+type RPC struct {
+	self      peer.ID
+	direct    *protocol.Handler
+	requests  *TypedTopic[RequestMessage]
+	responses *TypedTopic[ResponseMessage]
+
+	mu         sync.Mutex
+	subscribed bool
+	pending    map[string]chan *ResponseMessage
+}
+
+// NewRPC creates an RPC helper for the local peer self. direct may be nil,
+// in which case replies always go through TopicResponses.
+func NewRPC(manager *PubSubManager, direct *protocol.Handler, self peer.ID) *RPC {
+	return &RPC{
+		self:      self,
+		direct:    direct,
+		requests:  RequestTopic(manager),
+		responses: ResponseTopic(manager),
+		pending:   make(map[string]chan *ResponseMessage),
+	}
+}
+
+// Request publishes req and waits for responses to it. By default it
+// returns the first response. When the deadline passes it returns the
+// responses received so far, or ErrNoResponses if there are none.
+func (r *RPC) Request(ctx context.Context, req *RequestMessage, opts ...RequestOption) ([]*ResponseMessage, error) {
+	cfg := requestConfig{
+		mode:    CollectFirst,
+		count:   1,
+		timeout: DefaultRPCTimeout,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.count <= 0 {
+		cfg.count = 1
+	}
+
+	if err := r.subscribeResponses(); err != nil {
+		return nil, err
+	}
+
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+
+	if req.RequestID == "" {
+		req.RequestID = newRequestID()
+	}
+	req.Type = TypeRequest
+	if r.direct != nil && r.self != "" {
+		req.ReplyTo = r.self.String()
+	}
+
+	buffer := cfg.count
+	if cfg.mode == CollectAll || buffer < 16 {
+		buffer = 16
+	}
+
+	published := r.expect(req.RequestID, buffer)
+	defer r.forget(req.RequestID)
+
+	var direct <-chan protocol.InboundResponse
+	if req.ReplyTo != "" {
+		var done func()
+		direct, done = r.direct.ExpectResponses(req.RequestID, buffer)
+		defer done()
+	}
+
+	if err := r.requests.Publish(ctx, req); err != nil {
+		return nil, err
+	}
+
+	var responses []*ResponseMessage
+	collect := func(resp *ResponseMessage) bool {
+		responses = append(responses, resp)
+		return cfg.mode == CollectFirst && len(responses) >= cfg.count
+	}
+
+	for {
+		select {
+		case resp := <-published:
+			if collect(resp) {
+				return responses, nil
+			}
+
+		case inbound := <-direct:
+			resp, err := DecodeResponseMessage(inbound.Message.Payload)
+			if err != nil || resp.RequestID != req.RequestID {
+				continue
+			}
+			resp.From = inbound.Peer.String()
+			resp.ReceivedAt = time.Now()
+			if collect(resp) {
+				return responses, nil
+			}
+
+		case <-ctx.Done():
+			if len(responses) == 0 {
+				return nil, fmt.Errorf("request %s: %w", req.RequestID, ErrNoResponses)
+			}
+			return responses, nil
+		}
+	}
+}
+
+func (r *RPC) subscribeResponses() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.subscribed {
+		return nil
+	}
+	if _, err := r.responses.Subscribe(r.handleResponse); err != nil {
+		return fmt.Errorf("subscribe to responses: %w", err)
+	}
+	r.subscribed = true
+	return nil
+}
+
+func (r *RPC) handleResponse(ctx context.Context, from peer.ID, resp *ResponseMessage) error {
+	r.mu.Lock()
+	ch, ok := r.pending[resp.RequestID]
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	resp.From = from.String()
+	resp.ReceivedAt = time.Now()
+	select {
+	case ch <- resp:
+	default:
+	}
+	return nil
+}
+
+func (r *RPC) expect(requestID string, buffer int) <-chan *ResponseMessage {
+	ch := make(chan *ResponseMessage, buffer)
+	r.mu.Lock()
+	r.pending[requestID] = ch
+	r.mu.Unlock()
+	return ch
+}
+
+func (r *RPC) forget(requestID string) {
+	r.mu.Lock()
+	delete(r.pending, requestID)
+	r.mu.Unlock()
+}
+
+// Serve answers requests on TopicRequests with handler. Requests sealed to
+// another peer are skipped.
+func (r *RPC) Serve(handler RPCHandler, opts ...SubscribeOption) (*Subscription, error) {
+	return r.requests.Subscribe(func(ctx context.Context, from peer.ID, req *RequestMessage) error {
+		if req.Recipient != "" && req.Recipient != r.self.String() {
+			return nil
+		}
+
+		req.From = from.String()
+		req.ReceivedAt = time.Now()
+
+		resp, err := handler(ctx, from, req)
+		if err != nil {
+			resp = &ResponseMessage{Error: err.Error()}
+		}
+		if resp == nil {
+			return nil
+		}
+
+		resp.Type = TypeResponse
+		resp.RequestID = req.RequestID
+		return r.reply(ctx, from, req, resp)
+	}, opts...)
+}
+
+// reply sends resp to the requester over a stream if possible, and
+// publishes it on TopicResponses otherwise. Only the verified origin from is
+// replied to directly, so a request cannot point providers at another peer.
+func (r *RPC) reply(ctx context.Context, from peer.ID, req *RequestMessage, resp *ResponseMessage) error {
+	if r.direct != nil && req.ReplyTo != "" && req.ReplyTo == from.String() {
+		if err := r.sendDirect(ctx, from, resp); err == nil {
+			return nil
+		}
+	}
+
+	return r.responses.Publish(ctx, resp)
+}
+
+func (r *RPC) sendDirect(ctx context.Context, to peer.ID, resp *ResponseMessage) error {
+	data, err := EncodeResponseMessage(resp)
+	if err != nil {
+		return err
+	}
+
+	return r.direct.SendMessage(ctx, to, &protocol.Message{
+		Type:      protocol.MsgTypeResponse,
+		RequestID: resp.RequestID,
+		Payload:   data,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+func newRequestID() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("req-%d", time.Now().UnixNano())
+	}
+	return "req-" + hex.EncodeToString(buf)
+}
@@ -0,0 +1,277 @@
+package pubsub
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-pubsub"
+)
+
+const (
+	DefaultScoreInspectInterval = time.Minute
+
+	// topicScoreCap bounds the positive contribution of all topics so that
+	// long mesh membership cannot offset misbehaviour indefinitely.
+	topicScoreCap = 100
+
+	firstDeliveriesCap   = 100
+	meshDeliveriesCap    = 100
+	meshDeliveriesWindow = 10 * time.Millisecond
+	// meshDeliveriesActivation gives a new mesh member time to catch up
+	// before a delivery deficit is penalised.
+	meshDeliveriesActivation = time.Minute
+	retainScore              = 10 * time.Minute
+)
+
+// ScoreThresholds are the peer scores below which gossip, publishing and
+// all RPCs from a peer are ignored, and above which peer exchange and
+// opportunistic grafting are accepted.
+type ScoreThresholds struct {
+	Gossip             float64
+	Publish            float64
+	Graylist           float64
+	AcceptPX           float64
+	OpportunisticGraft float64
+}
+
+// DefaultScoreThresholds are calibrated against the default topic weights:
+// with an invalid message weight of -100, a couple of invalid messages stop
+// gossip to a peer and a handful graylist it.
+func DefaultScoreThresholds() ScoreThresholds {
+	return ScoreThresholds{
+		Gossip:             -100,
+		Publish:            -500,
+		Graylist:           -1000,
+		AcceptPX:           10,
+		OpportunisticGraft: 5,
+	}
+}
+
+func (t ScoreThresholds) params() *pubsub.PeerScoreThresholds {
+	return &pubsub.PeerScoreThresholds{
+		GossipThreshold:             t.Gossip,
+		PublishThreshold:            t.Publish,
+		GraylistThreshold:           t.Graylist,
+		AcceptPXThreshold:           t.AcceptPX,
+		OpportunisticGraftThreshold: t.OpportunisticGraft,
+	}
+}
+
+// TopicScoreParams converts c to gossipsub topic parameters.
+// TimeInMeshQuantum is in seconds. MessageDeliveriesWeight rewards first
+// deliveries when FirstMessageDeliveriesWeight is unset. Penalty weights
+// (mesh and invalid deliveries) may be given with either sign.
+func (c *TopicScoreConfig) TopicScoreParams() (*pubsub.TopicScoreParams, error) {
+	if c.ByTopicScoreWeight < 0 || c.TimeInMeshWeight < 0 || c.FirstMessageDeliveriesWeight < 0 || c.MessageDeliveriesWeight < 0 {
+		return nil, fmt.Errorf("topic score weights other than penalties must not be negative")
+	}
+
+	quantum := time.Duration(c.TimeInMeshQuantum * float64(time.Second))
+	if quantum <= 0 {
+		quantum = time.Second
+	}
+
+	firstDeliveries := c.FirstMessageDeliveriesWeight
+	if firstDeliveries == 0 {
+		firstDeliveries = c.MessageDeliveriesWeight
+	}
+
+	params := &pubsub.TopicScoreParams{
+		TopicWeight: c.ByTopicScoreWeight,
+
+		TimeInMeshWeight:  c.TimeInMeshWeight,
+		TimeInMeshQuantum: quantum,
+		TimeInMeshCap:     float64(time.Hour / quantum),
+
+		FirstMessageDeliveriesWeight: firstDeliveries,
+		FirstMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(10 * time.Minute),
+		FirstMessageDeliveriesCap:    firstDeliveriesCap,
+
+		InvalidMessageDeliveriesWeight: -math.Abs(c.InvalidMessageDeliveriesWeight),
+		InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+	}
+
+	if c.MeshMessageDeliveriesWeight != 0 {
+		weight := -math.Abs(c.MeshMessageDeliveriesWeight)
+		decay := pubsub.ScoreParameterDecay(5 * time.Minute)
+
+		params.MeshMessageDeliveriesWeight = weight
+		params.MeshMessageDeliveriesDecay = decay
+		params.MeshMessageDeliveriesCap = meshDeliveriesCap
+		params.MeshMessageDeliveriesThreshold = 1
+		params.MeshMessageDeliveriesWindow = meshDeliveriesWindow
+		params.MeshMessageDeliveriesActivation = meshDeliveriesActivation
+		params.MeshFailurePenaltyWeight = weight
+		params.MeshFailurePenaltyDecay = decay
+	}
+
+	return params, nil
+}
+
+// BuildPeerScoreParams builds the router's peer score parameters from the
+// score configs of configs. The IP colocation and behaviour penalty settings
+// apply to the peer as a whole, so the strictest value across topics wins.
+func BuildPeerScoreParams(configs map[string]*TopicConfig) (*pubsub.PeerScoreParams, error) {
+	params := &pubsub.PeerScoreParams{
+		Topics:            make(map[string]*pubsub.TopicScoreParams),
+		TopicScoreCap:     topicScoreCap,
+		AppSpecificScore:  func(peer.ID) float64 { return 0 },
+		AppSpecificWeight: 1,
+		DecayInterval:     pubsub.DefaultDecayInterval,
+		DecayToZero:       pubsub.DefaultDecayToZero,
+		RetainScore:       retainScore,
+	}
+
+	for name, cfg := range configs {
+		if cfg.Score == nil {
+			continue
+		}
+
+		topic, err := cfg.Score.TopicScoreParams()
+		if err != nil {
+			return nil, fmt.Errorf("score params for %s: %w", name, err)
+		}
+		params.Topics[name] = topic
+
+		if w := -math.Abs(cfg.Score.IPColocationFactorWeight); w < params.IPColocationFactorWeight {
+			params.IPColocationFactorWeight = w
+		}
+		if t := int(cfg.Score.IPColocationFactorThreshold); t > 0 && (params.IPColocationFactorThreshold == 0 || t < params.IPColocationFactorThreshold) {
+			params.IPColocationFactorThreshold = t
+		}
+		if w := -math.Abs(cfg.Score.BehaviourPenaltyWeight); w < params.BehaviourPenaltyWeight {
+			params.BehaviourPenaltyWeight = w
+		}
+		if t := cfg.Score.BehaviourPenaltyThreshold; t > 0 && (params.BehaviourPenaltyThreshold == 0 || t < params.BehaviourPenaltyThreshold) {
+			params.BehaviourPenaltyThreshold = t
+		}
+	}
+
+	if params.IPColocationFactorWeight != 0 && params.IPColocationFactorThreshold < 1 {
+		params.IPColocationFactorThreshold = 1
+	}
+	if params.BehaviourPenaltyWeight != 0 {
+		params.BehaviourPenaltyDecay = pubsub.ScoreParameterDecay(10 * time.Minute)
+	}
+
+	return params, nil
+}
+
+// TopicScore is one peer's score counters on one topic.
+type TopicScore struct {
+	TimeInMesh               time.Duration
+	FirstMessageDeliveries   float64
+	MeshMessageDeliveries    float64
+	InvalidMessageDeliveries float64
+}
+
+// PeerScore is a snapshot of a peer's gossipsub score and its components.
+type PeerScore struct {
+	Peer               peer.ID
+	Score              float64
+	AppSpecificScore   float64
+	IPColocationFactor float64
+	BehaviourPenalty   float64
+	Topics             map[string]TopicScore
+}
+
+func (m *PubSubManager) inspectScores(snapshots map[peer.ID]*pubsub.PeerScoreSnapshot) {
+	scores := make(map[peer.ID]PeerScore, len(snapshots))
+	gauges := make(map[string]float64, len(snapshots))
+
+	for p, snapshot := range snapshots {
+		score := PeerScore{
+			Peer:               p,
+			Score:              snapshot.Score,
+			AppSpecificScore:   snapshot.AppSpecificScore,
+			IPColocationFactor: snapshot.IPColocationFactor,
+			BehaviourPenalty:   snapshot.BehaviourPenalty,
+			Topics:             make(map[string]TopicScore, len(snapshot.Topics)),
+		}
+		for topic, ts := range snapshot.Topics {
+			score.Topics[topic] = TopicScore{
+				TimeInMesh:               ts.TimeInMesh,
+				FirstMessageDeliveries:   ts.FirstMessageDeliveries,
+				MeshMessageDeliveries:    ts.MeshMessageDeliveries,
+				InvalidMessageDeliveries: ts.InvalidMessageDeliveries,
+			}
+		}
+		scores[p] = score
+		gauges[p.String()] = snapshot.Score
+	}
+
+	m.scoresMu.Lock()
+	m.scores = scores
+	m.scoresMu.Unlock()
+
+	if m.metrics != nil {
+		m.metrics.SetPeerScores(gauges)
+	}
+}
+
+// PeerScores returns the latest score snapshot of every scored peer, lowest
+// score first. Snapshots are refreshed every score inspect interval.
+func (m *PubSubManager) PeerScores() []PeerScore {
+	m.scoresMu.RLock()
+	defer m.scoresMu.RUnlock()
+
+	scores := make([]PeerScore, 0, len(m.scores))
+	for _, score := range m.scores {
+		scores = append(scores, score)
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score < scores[j].Score
+		}
+		return scores[i].Peer < scores[j].Peer
+	})
+	return scores
+}
+
+func (m *PubSubManager) PeerScore(p peer.ID) (PeerScore, bool) {
+	m.scoresMu.RLock()
+	defer m.scoresMu.RUnlock()
+	score, ok := m.scores[p]
+	return score, ok
+}
+
+// TopicScore returns the score config in effect for topic.
+func (m *PubSubManager) TopicScore(topic string) (*TopicScoreConfig, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cfg, ok := m.topicConfigs[topic]
+	if !ok || cfg.Score == nil {
+		return nil, false
+	}
+	return cfg.Score, true
+}
+
+// SetTopicScore replaces the score config of topic, applying it to the
+// router immediately if the topic has been joined.
+func (m *PubSubManager) SetTopicScore(topic string, score *TopicScoreConfig) error {
+	params, err := score.TopicScoreParams()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.topics[topic]; ok {
+		if err := t.SetScoreParams(params); err != nil {
+			return fmt.Errorf("set score params for %s: %w", topic, err)
+		}
+	}
+
+	cfg, ok := m.topicConfigs[topic]
+	if !ok {
+		cfg = &TopicConfig{Name: topic}
+		m.topicConfigs[topic] = cfg
+	}
+	cfg.Score = score
+	return nil
+}
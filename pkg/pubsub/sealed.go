@@ -0,0 +1,95 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/your-org/p2p-network/pkg/protocol"
+)
+
+// Requests published on TopicRequests are readable by every subscriber and
+// every peer relaying the topic. Sealing a request encrypts its payload to
+// the identity key of the chosen provider; the provider seals its response
+// with the returned reply key so only the requester can read it.
+
+var (
+	ErrNotRecipient = errors.New("request is sealed to another peer")
+	ErrNotEncrypted = errors.New("message is not encrypted")
+)
+
+// Seal encrypts the payload to the provider holding recipient.
+func (m *RequestMessage) Seal(recipient crypto.PubKey) (*protocol.ReplyKey, error) {
+	id, err := peer.IDFromPublicKey(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Recipient = id.String()
+	payload, replyKey, err := protocol.SealPayload(recipient, m.Payload, m.aad())
+	if err != nil {
+		return nil, fmt.Errorf("seal request %s: %w", m.RequestID, err)
+	}
+
+	m.Payload = payload
+	m.Encrypted = true
+	return replyKey, nil
+}
+
+// Open decrypts a request sealed to the local peer identified by key.
+func (m *RequestMessage) Open(key crypto.PrivKey) (*protocol.ReplyKey, error) {
+	if !m.Encrypted {
+		return nil, ErrNotEncrypted
+	}
+
+	self, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if m.Recipient != self.String() {
+		return nil, ErrNotRecipient
+	}
+
+	payload, replyKey, err := protocol.OpenPayload(key, m.Payload, m.aad())
+	if err != nil {
+		return nil, fmt.Errorf("open request %s: %w", m.RequestID, err)
+	}
+
+	m.Payload = payload
+	m.Encrypted = false
+	return replyKey, nil
+}
+
+func (m *RequestMessage) aad() []byte {
+	return []byte(m.RequestID + "/" + m.Model + "/" + m.Recipient)
+}
+
+// Seal encrypts the response payload with the reply key of its request. The
+// error string is not covered.
+func (m *ResponseMessage) Seal(key *protocol.ReplyKey) error {
+	payload, err := key.Seal(m.Payload, []byte(m.RequestID))
+	if err != nil {
+		return err
+	}
+
+	m.Payload = payload
+	m.Encrypted = true
+	return nil
+}
+
+func (m *ResponseMessage) Open(key *protocol.ReplyKey) error {
+	if !m.Encrypted {
+		return ErrNotEncrypted
+	}
+
+	payload, err := key.Open(m.Payload, []byte(m.RequestID))
+	if err != nil {
+		return err
+	}
+
+	m.Payload = payload
+	m.Encrypted = false
+	return nil
+}
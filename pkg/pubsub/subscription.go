@@ -0,0 +1,460 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-pubsub"
+)
+
+const (
+	DefaultSubscriptionBuffer  = 100
+	DefaultSubscriptionWorkers = 4
+)
+
+var (
+	ErrSubscriptionOverflow  = errors.New("subscription buffer full")
+	ErrSubscriptionCancelled = errors.New("subscription cancelled")
+)
+
+// OverflowPolicy decides what happens to a message arriving at a full
+// subscription buffer.
+type OverflowPolicy int
+
+const (
+	OverflowDropNewest OverflowPolicy = iota
+	OverflowDropOldest
+	// OverflowBlock stops reading from the router until there is room.
+	// The router then drops messages for the subscription itself once its
+	// own buffer fills, so this only suits handlers that keep up on average.
+	OverflowBlock
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// DeadLetterFunc receives messages that were dropped on overflow, with
+// ErrSubscriptionOverflow, or that a handler failed on, with the handler
+// errors. It is called inline and must not block.
+type DeadLetterFunc func(msg *Message, err error)
+
+type subscribeConfig struct {
+	bufferSize int
+	overflow   OverflowPolicy
+	workers    int
+	deadLetter DeadLetterFunc
+	catchUp    time.Duration
+}
+
+// SubscribeOption configures a new subscription. Options are ignored when
+// Subscribe adds a handler to an existing subscription.
+type SubscribeOption func(*subscribeConfig)
+
+// WithBufferSize sets how many messages may wait for a handler, and for a
+// reader of Messages.
+func WithBufferSize(size int) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.bufferSize = size
+	}
+}
+
+func WithOverflowPolicy(policy OverflowPolicy) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.overflow = policy
+	}
+}
+
+// WithWorkers sets how many messages are handled at once. With more than
+// one worker, handlers may see messages out of order.
+func WithWorkers(workers int) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.workers = workers
+	}
+}
+
+func WithDeadLetter(fn DeadLetterFunc) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.deadLetter = fn
+	}
+}
+
+// WithCatchUp syncs the messages of the last window from peers once the
+// subscription starts, waiting up to SyncConfig.CatchUpWait for peers to
+// appear. It needs EnableSync.
+func WithCatchUp(window time.Duration) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.catchUp = window
+	}
+}
+
+// SubscriptionStats counts what happened to a topic's messages after they
+// passed validation.
+type SubscriptionStats struct {
+	Delivered uint64
+	Failed    uint64
+	Dropped   uint64
+}
+
+type subscriptionCounters struct {
+	delivered uint64
+	failed    uint64
+	dropped   uint64
+}
+
+func (c *subscriptionCounters) stats() SubscriptionStats {
+	return SubscriptionStats{
+		Delivered: atomic.LoadUint64(&c.delivered),
+		Failed:    atomic.LoadUint64(&c.failed),
+		Dropped:   atomic.LoadUint64(&c.dropped),
+	}
+}
+
+func (m *PubSubManager) subscriptionCounters(topic string) *subscriptionCounters {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+
+	counters, ok := m.stats[topic]
+	if !ok {
+		counters = &subscriptionCounters{}
+		m.stats[topic] = counters
+	}
+	return counters
+}
+
+// SubscriptionStats returns the message counts of topic across all of its
+// subscriptions.
+func (m *PubSubManager) SubscriptionStats(topic string) SubscriptionStats {
+	m.statsMu.Lock()
+	counters, ok := m.stats[topic]
+	m.statsMu.Unlock()
+	if !ok {
+		return SubscriptionStats{}
+	}
+	return counters.stats()
+}
+
+// Subscription reads a topic from the router into a bounded buffer that a
+// pool of workers drains through the handlers, so slow handlers do not stall
+// the router. It ends when cancelled or when the manager's context is done,
+// whichever comes first.
+type Subscription struct {
+	topic    string
+	sub      *pubsub.Subscription
+	manager  *PubSubManager
+	config   subscribeConfig
+	counters *subscriptionCounters
+
+	queue    chan *Message
+	messages chan *Message
+	reading  int32
+
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	done       chan struct{}
+	stopOnce   sync.Once
+	cancelOnce sync.Once
+
+	errMu sync.Mutex
+	err   error
+
+	mu       sync.RWMutex
+	handlers []MessageHandler
+}
+
+func newSubscription(m *PubSubManager, topic string, sub *pubsub.Subscription, opts []SubscribeOption) *Subscription {
+	cfg := subscribeConfig{
+		bufferSize: DefaultSubscriptionBuffer,
+		overflow:   OverflowDropNewest,
+		workers:    DefaultSubscriptionWorkers,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.bufferSize <= 0 {
+		cfg.bufferSize = DefaultSubscriptionBuffer
+	}
+	if cfg.workers <= 0 {
+		cfg.workers = DefaultSubscriptionWorkers
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	return &Subscription{
+		topic:    topic,
+		sub:      sub,
+		manager:  m,
+		config:   cfg,
+		counters: m.subscriptionCounters(topic),
+		queue:    make(chan *Message, cfg.bufferSize),
+		messages: make(chan *Message, cfg.bufferSize),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *Subscription) start() {
+	s.wg.Add(1 + s.config.workers)
+	go s.readLoop()
+	for i := 0; i < s.config.workers; i++ {
+		go s.worker()
+	}
+	if s.config.catchUp > 0 {
+		s.wg.Add(1)
+		go s.catchUp(time.Now().Add(-s.config.catchUp))
+	}
+
+	go func() {
+		s.wg.Wait()
+		s.cancelSub()
+		if s.manager != nil {
+			s.manager.remove(s)
+		}
+		close(s.messages)
+		close(s.done)
+	}()
+}
+
+func (s *Subscription) addHandler(handler MessageHandler) {
+	if handler == nil {
+		return
+	}
+	s.mu.Lock()
+	s.handlers = append(s.handlers, handler)
+	s.mu.Unlock()
+}
+
+func (s *Subscription) readLoop() {
+	defer s.wg.Done()
+
+	for {
+		msg, err := s.sub.Next(s.ctx)
+		if err != nil {
+			s.finish(err)
+			return
+		}
+		// The router has already dropped duplicates within its seen TTL.
+		message := fromPubSubMessage(s.topic, msg)
+		s.manager.recordHistory(message, receivedAt(message))
+		s.push(s.queue, message)
+	}
+}
+
+// catchUp syncs the messages received by peers since since, retrying until
+// the topic has peers or CatchUpWait has passed.
+func (s *Subscription) catchUp(since time.Time) {
+	defer s.wg.Done()
+
+	ctx := s.ctx
+	if wait := s.manager.syncConfig.CatchUpWait; wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wait)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(syncRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.manager.sync(ctx, s, since); !errors.Is(err, ErrNoSyncPeers) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Subscription) worker() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case msg := <-s.queue:
+			s.process(msg)
+		}
+	}
+}
+
+func (s *Subscription) process(msg *Message) {
+	if err := s.handle(msg); err != nil {
+		atomic.AddUint64(&s.counters.failed, 1)
+		if metrics := s.manager.metrics; metrics != nil {
+			metrics.IncPubSubHandlerErrors(s.topic)
+		}
+		if s.config.deadLetter != nil {
+			s.config.deadLetter(msg, err)
+		}
+		return
+	}
+
+	atomic.AddUint64(&s.counters.delivered, 1)
+	if atomic.LoadInt32(&s.reading) == 1 {
+		s.push(s.messages, msg)
+	}
+}
+
+// handle runs every handler on msg and returns their joined errors.
+func (s *Subscription) handle(msg *Message) error {
+	s.mu.RLock()
+	handlers := s.handlers
+	s.mu.RUnlock()
+
+	ctx := s.ctx
+	if at := receivedAt(msg); !at.IsZero() {
+		ctx = context.WithValue(ctx, receivedAtKey{}, at)
+	}
+
+	var errs []error
+	for _, handler := range handlers {
+		if err := handler(ctx, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type receivedAtKey struct{}
+
+// ReceivedAtFromContext returns when the message a handler is running for
+// was first received. For messages synced from peers this is when the
+// serving peer received them.
+func ReceivedAtFromContext(ctx context.Context) (time.Time, bool) {
+	at, ok := ctx.Value(receivedAtKey{}).(time.Time)
+	return at, ok
+}
+
+// push adds msg to ch according to the overflow policy.
+func (s *Subscription) push(ch chan *Message, msg *Message) {
+	switch s.config.overflow {
+	case OverflowBlock:
+		select {
+		case ch <- msg:
+		case <-s.ctx.Done():
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case ch <- msg:
+				return
+			default:
+			}
+			select {
+			case oldest := <-ch:
+				s.drop(oldest)
+			default:
+			}
+		}
+
+	default:
+		select {
+		case ch <- msg:
+		default:
+			s.drop(msg)
+		}
+	}
+}
+
+func (s *Subscription) drop(msg *Message) {
+	atomic.AddUint64(&s.counters.dropped, 1)
+	if metrics := s.manager.metrics; metrics != nil {
+		metrics.IncPubSubDropped(s.topic)
+	}
+	if s.config.deadLetter != nil {
+		s.config.deadLetter(msg, ErrSubscriptionOverflow)
+	}
+}
+
+// Messages returns the messages every handler accepted. Messages are only
+// buffered once Messages has been called, and the channel is closed once the
+// subscription is cancelled.
+func (s *Subscription) Messages() <-chan *Message {
+	atomic.StoreInt32(&s.reading, 1)
+	return s.messages
+}
+
+// finish records err as the terminal error unless one is already set, and
+// stops the workers.
+func (s *Subscription) finish(err error) {
+	s.errMu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.errMu.Unlock()
+	s.cancel()
+}
+
+// cancelSub cancels the router subscription, which must happen only once.
+func (s *Subscription) cancelSub() {
+	s.cancelOnce.Do(s.sub.Cancel)
+}
+
+// Done is closed once the subscription has ended and all of its goroutines
+// have exited.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the subscription ended: ErrSubscriptionCancelled after
+// Cancel, Unsubscribe or Close, or the context error if the manager's context
+// ended first. It is nil while the subscription is running.
+func (s *Subscription) Err() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+// Cancel cancels the subscription for all of its handlers and waits for
+// them to return. A handler waiting on itself would never return, so
+// handlers cancel their subscription with CancelAsync instead.
+func (s *Subscription) Cancel() error {
+	s.CancelAsync()
+	<-s.done
+	return nil
+}
+
+// CancelAsync cancels the subscription like Cancel without waiting for the
+// handlers; Done is closed once they have returned.
+func (s *Subscription) CancelAsync() {
+	if s.manager != nil {
+		s.manager.remove(s)
+	}
+	s.halt()
+}
+
+// stop halts the subscription and waits for it to end.
+func (s *Subscription) stop() {
+	s.halt()
+	<-s.done
+}
+
+func (s *Subscription) halt() {
+	s.stopOnce.Do(func() {
+		s.finish(ErrSubscriptionCancelled)
+		s.cancelSub()
+	})
+}
+
+func (s *Subscription) Topic() string {
+	return s.topic
+}
@@ -0,0 +1,381 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/your-org/p2p-network/pkg/protocol"
+	"github.com/your-org/p2p-network/pkg/wire"
+)
+
+// A node that subscribes late asks a few peers of the topic for the messages
+// they received since a time. Peers answer from the topic's history over the
+// request-response protocol. Synced messages keep their origin's signature,
+// which is verified again, pass the topic validator and are deduplicated by
+// message ID before reaching the subscription's handlers.
+
+var (
+	ErrSyncDisabled  = errors.New("history sync is not enabled")
+	ErrNotSubscribed = errors.New("topic is not subscribed")
+	ErrNoSyncPeers   = errors.New("no peers to sync from")
+)
+
+// syncRetryInterval is how often WithCatchUp looks for peers to sync from.
+const syncRetryInterval = 500 * time.Millisecond
+
+// pubsubSignPrefix is prepended to a message before its origin signs it.
+const pubsubSignPrefix = "libp2p-pubsub:"
+
+type SyncConfig struct {
+	// Peers is how many peers of the topic a sync asks.
+	Peers int
+	// Timeout bounds a single sync.
+	Timeout time.Duration
+	// MaxMessages caps the messages served in answer to one request.
+	MaxMessages int
+	// CatchUpWait is how long WithCatchUp waits for peers to sync from.
+	CatchUpWait time.Duration
+}
+
+func DefaultSyncConfig() SyncConfig {
+	return SyncConfig{
+		Peers:       3,
+		Timeout:     5 * time.Second,
+		MaxMessages: 1024,
+		CatchUpWait: 10 * time.Second,
+	}
+}
+
+// EnableSync answers history requests from peers on h and lets Sync send
+// them.
+func (m *PubSubManager) EnableSync(h *protocol.Handler) {
+	m.syncMu.Lock()
+	m.direct = h
+	m.syncMu.Unlock()
+
+	h.RegisterHandler(protocol.MsgTypeSyncRequest, m.handleSyncRequest)
+}
+
+func (m *PubSubManager) syncHandler() *protocol.Handler {
+	m.syncMu.RLock()
+	defer m.syncMu.RUnlock()
+	return m.direct
+}
+
+// Sync asks a few peers of topic for the messages they received after since
+// and passes the ones not yet seen to the topic's subscription, oldest
+// first. It returns how many messages were delivered.
+func (m *PubSubManager) Sync(ctx context.Context, topic string, since time.Time) (int, error) {
+	m.mu.RLock()
+	s, ok := m.subs[topic]
+	m.mu.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("sync %s: %w", topic, ErrNotSubscribed)
+	}
+	return m.sync(ctx, s, since)
+}
+
+func (m *PubSubManager) sync(ctx context.Context, s *Subscription, since time.Time) (int, error) {
+	direct := m.syncHandler()
+	if direct == nil {
+		return 0, ErrSyncDisabled
+	}
+
+	peers := m.syncPeers(s.topic)
+	if len(peers) == 0 {
+		return 0, fmt.Errorf("sync %s: %w", s.topic, ErrNoSyncPeers)
+	}
+
+	if m.syncConfig.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.syncConfig.Timeout)
+		defer cancel()
+	}
+
+	batches := make([][]*Message, len(peers))
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p peer.ID) {
+			defer wg.Done()
+			batches[i], errs[i] = m.fetchHistory(ctx, direct, p, s.topic, since)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("sync %s from %s: %w", s.topic, p, errs[i])
+			}
+		}(i, p)
+	}
+	wg.Wait()
+
+	var messages []syncedMessage
+	failed := 0
+	for i, batch := range batches {
+		if errs[i] != nil {
+			failed++
+		}
+		for _, msg := range batch {
+			messages = append(messages, syncedMessage{msg: msg, server: peers[i]})
+		}
+	}
+	if failed == len(peers) {
+		return 0, errors.Join(errs...)
+	}
+
+	return m.deliverSynced(ctx, s, messages), nil
+}
+
+// syncPeers picks up to SyncConfig.Peers of the peers known to be
+// subscribed to topic.
+func (m *PubSubManager) syncPeers(topic string) []peer.ID {
+	peers := m.ListPeers(topic)
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if n := m.syncConfig.Peers; n > 0 && len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+func (m *PubSubManager) fetchHistory(ctx context.Context, direct *protocol.Handler, p peer.ID, topic string, since time.Time) ([]*Message, error) {
+	payload, err := proto.Marshal(&wire.SyncRequest{
+		Topic:   topic,
+		SinceMs: since.UnixMilli(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := direct.SendRequest(ctx, p, &protocol.Message{
+		Type:      protocol.MsgTypeSyncRequest,
+		RequestID: newRequestID(),
+		Payload:   payload,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type != protocol.MsgTypeSyncResponse {
+		return nil, fmt.Errorf("unexpected reply type %d", resp.Type)
+	}
+
+	var sr wire.SyncResponse
+	if err := proto.Unmarshal(resp.Payload, &sr); err != nil {
+		return nil, fmt.Errorf("decode sync response: %w", err)
+	}
+
+	// The serving peer cannot have kept a message it received more than
+	// the topic's history TTL after since.
+	latest := time.Now()
+	if h := m.histories[topic]; h != nil && h.ttl > 0 && since.Add(h.ttl).Before(latest) {
+		latest = since.Add(h.ttl)
+	}
+
+	messages := make([]*Message, 0, len(sr.Messages))
+	for _, pm := range sr.Messages {
+		messages = append(messages, fromWireMessage(topic, pm, latest))
+	}
+	return messages, nil
+}
+
+// syncedMessage is a message synced from the peer server.
+type syncedMessage struct {
+	msg    *Message
+	server peer.ID
+}
+
+// deliverSynced passes the valid messages not seen before to s, oldest
+// first, and returns how many it passed on.
+func (m *PubSubManager) deliverSynced(ctx context.Context, s *Subscription, messages []syncedMessage) int {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return receivedAt(messages[i].msg).Before(receivedAt(messages[j].msg))
+	})
+
+	delivered := 0
+	seen := make(map[string]struct{}, len(messages))
+	for _, synced := range messages {
+		msg := synced.msg
+		msg.ID = m.messageID(msg)
+		if msg.ID == "" {
+			continue
+		}
+		// Copies from other peers are only validated and counted against
+		// the rate limits once.
+		if _, ok := seen[msg.ID]; ok {
+			continue
+		}
+		if !m.validSynced(ctx, synced.server, msg) {
+			continue
+		}
+		seen[msg.ID] = struct{}{}
+		if !m.recordHistory(msg, receivedAt(msg)) {
+			continue
+		}
+		s.push(s.queue, msg)
+		delivered++
+	}
+	return delivered
+}
+
+// validSynced reports whether msg, synced from server, carries a valid
+// signature, when signing is required or the message is signed, is within
+// the topic's rate limits and passes the topic validator.
+func (m *PubSubManager) validSynced(ctx context.Context, server peer.ID, msg *Message) bool {
+	if len(msg.Signature) > 0 || m.signMessages {
+		if err := verifySignature(msg); err != nil {
+			return false
+		}
+	}
+
+	m.validationMu.RLock()
+	limiters := m.limiters[msg.Topic]
+	m.validationMu.RUnlock()
+	if limiters != nil {
+		origin := server
+		if len(msg.From) > 0 {
+			origin = peer.ID(msg.From)
+		}
+		if _, ok := m.rateLimit(msg.Topic, server, origin, limiters); !ok {
+			return false
+		}
+	}
+
+	m.mu.RLock()
+	var validate MessageValidator
+	if cfg, ok := m.topicConfigs[msg.Topic]; ok {
+		validate = cfg.Validator
+	}
+	m.mu.RUnlock()
+
+	return validate == nil || validate(ctx, msg) == ValidationAccept
+}
+
+func (m *PubSubManager) handleSyncRequest(ctx context.Context, p peer.ID, msg *protocol.Message) (*protocol.Message, error) {
+	var req wire.SyncRequest
+	if err := proto.Unmarshal(msg.Payload, &req); err != nil {
+		return nil, fmt.Errorf("decode sync request: %w", err)
+	}
+
+	limit := int(req.Limit)
+	if max := m.syncConfig.MaxMessages; max > 0 && (limit <= 0 || limit > max) {
+		limit = max
+	}
+
+	var resp wire.SyncResponse
+	for _, e := range m.histories[req.Topic].since(time.UnixMilli(req.SinceMs), limit) {
+		resp.Messages = append(resp.Messages, toWireMessage(e))
+	}
+
+	payload, err := proto.Marshal(&resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocol.Message{
+		Type:      protocol.MsgTypeSyncResponse,
+		RequestID: msg.RequestID,
+		Payload:   payload,
+		Timestamp: time.Now().Unix(),
+	}, nil
+}
+
+func toWireMessage(e historyEntry) *wire.PubSubMessage {
+	return &wire.PubSubMessage{
+		From:         e.msg.From,
+		Data:         e.msg.Data,
+		Seqno:        e.msg.Seqno,
+		Signature:    e.msg.Signature,
+		Key:          e.msg.Key,
+		ReceivedAtMs: e.at.UnixMilli(),
+	}
+}
+
+// fromWireMessage converts a synced message, taking the serving peer's
+// receive time but never one after latest.
+func fromWireMessage(topic string, pm *wire.PubSubMessage, latest time.Time) *Message {
+	at := time.UnixMilli(pm.ReceivedAtMs)
+	if at.After(latest) {
+		at = latest
+	}
+
+	return &Message{
+		Data:       pm.Data,
+		From:       pm.From,
+		Seqno:      pm.Seqno,
+		Topic:      topic,
+		Signature:  pm.Signature,
+		Key:        pm.Key,
+		ReceivedAt: at,
+	}
+}
+
+func receivedAt(msg *Message) time.Time {
+	if t, ok := msg.ReceivedAt.(time.Time); ok {
+		return t
+	}
+	return time.Time{}
+}
+
+// verifySignature checks the origin's signature on msg the way the router
+// does: over the encoded message without its signature and key.
+func verifySignature(msg *Message) error {
+	if len(msg.Signature) == 0 {
+		return errors.New("message is not signed")
+	}
+
+	from, err := peer.IDFromBytes(msg.From)
+	if err != nil {
+		return fmt.Errorf("message origin: %w", err)
+	}
+
+	var key crypto.PubKey
+	if len(msg.Key) > 0 {
+		if key, err = crypto.UnmarshalPublicKey(msg.Key); err != nil {
+			return fmt.Errorf("message key: %w", err)
+		}
+		if !from.MatchesPublicKey(key) {
+			return errors.New("message key does not match its origin")
+		}
+	} else if key, err = from.ExtractPublicKey(); err != nil {
+		return fmt.Errorf("message key: %w", err)
+	}
+
+	ok, err := key.Verify(signedBytes(msg), msg.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("invalid message signature")
+	}
+	return nil
+}
+
+// signedBytes encodes the fields of msg that its origin signed.
+func signedBytes(msg *Message) []byte {
+	b := []byte(pubsubSignPrefix)
+	for _, f := range []struct {
+		num   protowire.Number
+		value []byte
+	}{
+		{1, msg.From},
+		{2, msg.Data},
+		{3, msg.Seqno},
+	} {
+		if len(f.value) > 0 {
+			b = protowire.AppendTag(b, f.num, protowire.BytesType)
+			b = protowire.AppendBytes(b, f.value)
+		}
+	}
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	return protowire.AppendString(b, msg.Topic)
+}
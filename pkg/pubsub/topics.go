@@ -1,11 +1,15 @@
 package pubsub
 
+import "time"
+
 const (
 	TopicProviders  = "llm-share.providers"
 	TopicRequests   = "llm-share.requests"
 	TopicResponses  = "llm-share.responses"
 	TopicHeartbeat  = "llm-share.heartbeat"
 	TopicDiscovery  = "llm-share.discovery"
+	// TopicSync is reserved for history sync, which itself runs over the
+	// request-response protocol with individual peers; see Sync.
 	TopicSync       = "llm-share.sync"
 	TopicBroadcast  = "llm-share.broadcast"
 )
@@ -24,6 +28,23 @@ type TopicConfig struct {
 	Name      string
 	Score     *TopicScoreConfig
 	Validator MessageValidator
+	// ValidatorTimeout bounds a single validation and ValidatorConcurrency
+	// the validations running at once; messages beyond it are dropped.
+	// Zero uses the defaults.
+	ValidatorTimeout     time.Duration
+	ValidatorConcurrency int
+	// PeerRateLimit limits the messages each origin peer may send on the
+	// topic, and TopicRateLimit the messages of all peers together.
+	PeerRateLimit  RateLimit
+	TopicRateLimit RateLimit
+	// HistorySize and HistoryTTL bound the recent messages kept for peers
+	// that sync the topic. A zero HistorySize keeps no history and a zero
+	// HistoryTTL bounds it by count alone.
+	HistorySize int
+	HistoryTTL  time.Duration
+	// MessageID replaces the manager's message ID function for the topic,
+	// for example with ContentMessageID.
+	MessageID MessageIDFunc
 }
 
 type TopicScoreConfig struct {
@@ -43,7 +64,11 @@ type TopicScoreConfig struct {
 func DefaultTopicConfigs() map[string]*TopicConfig {
 	return map[string]*TopicConfig{
 		TopicProviders: {
-			Name: TopicProviders,
+			Name:        TopicProviders,
+			Validator:   ProviderValidator,
+			HistorySize: 1024,
+			HistoryTTL:  DefaultAdvertTTL,
+			MessageID:   ContentMessageID,
 			Score: &TopicScoreConfig{
 				ByTopicScoreWeight:          0.5,
 				TimeInMeshWeight:           0.5,
@@ -52,7 +77,10 @@ func DefaultTopicConfigs() map[string]*TopicConfig {
 			},
 		},
 		TopicRequests: {
-			Name: TopicRequests,
+			Name:           TopicRequests,
+			Validator:      RequestValidator,
+			PeerRateLimit:  RateLimit{Rate: 10, Burst: 20},
+			TopicRateLimit: RateLimit{Rate: 200, Burst: 400},
 			Score: &TopicScoreConfig{
 				ByTopicScoreWeight:            0.3,
 				TimeInMeshWeight:            0.3,
@@ -61,7 +89,8 @@ func DefaultTopicConfigs() map[string]*TopicConfig {
 			},
 		},
 		TopicResponses: {
-			Name: TopicResponses,
+			Name:      TopicResponses,
+			Validator: ResponseValidator,
 			Score: &TopicScoreConfig{
 				ByTopicScoreWeight:            0.3,
 				TimeInMeshWeight:            0.3,
@@ -70,29 +99,22 @@ func DefaultTopicConfigs() map[string]*TopicConfig {
 			},
 		},
 		TopicHeartbeat: {
-			Name: TopicHeartbeat,
+			Name:          TopicHeartbeat,
+			Validator:     HeartbeatValidator,
+			PeerRateLimit: RateLimit{Rate: 1, Burst: 5},
+			MessageID:     ContentMessageID,
 			Score: &TopicScoreConfig{
 				TimeInMeshWeight:            0.1,
 				FirstMessageDeliveriesWeight: 0.5,
 			},
 		},
+		TopicBroadcast: {
+			Name:           TopicBroadcast,
+			Validator:      NoOpValidator,
+			PeerRateLimit:  RateLimit{Rate: 5, Burst: 10},
+			TopicRateLimit: RateLimit{Rate: 50, Burst: 100},
+			HistorySize:    256,
+			HistoryTTL:     10 * time.Minute,
+		},
 	}
 }
-
-type MessageValidator func(msg *Message) bool
-
-func NoOpValidator(msg *Message) bool {
-	return len(msg.Data) > 0
-}
-
-func ProviderValidator(msg *Message) bool {
-	return len(msg.Data) > 0
-}
-
-func RequestValidator(msg *Message) bool {
-	return len(msg.Data) > 0 && len(msg.Data) < 1024*1024
-}
-
-func HeartbeatValidator(msg *Message) bool {
-	return len(msg.Data) > 0 && len(msg.Data) < 1024
-}
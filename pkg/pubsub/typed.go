@@ -0,0 +1,178 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec converts the values published on a topic to and from message data.
+type Codec[T any] interface {
+	Encode(v *T) ([]byte, error)
+	Decode(data []byte) (*T, error)
+}
+
+// CodecFuncs adapts a pair of functions to a Codec.
+type CodecFuncs[T any] struct {
+	EncodeFunc func(v *T) ([]byte, error)
+	DecodeFunc func(data []byte) (*T, error)
+}
+
+func (c CodecFuncs[T]) Encode(v *T) ([]byte, error) {
+	return c.EncodeFunc(v)
+}
+
+func (c CodecFuncs[T]) Decode(data []byte) (*T, error) {
+	return c.DecodeFunc(data)
+}
+
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v *T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (*T, error) {
+	v := new(T)
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ProtoCodec encodes generated protobuf messages, for example
+// ProtoCodec[wire.Heartbeat, *wire.Heartbeat].
+type ProtoCodec[T any, P interface {
+	*T
+	proto.Message
+}] struct{}
+
+func (ProtoCodec[T, P]) Encode(v *T) ([]byte, error) {
+	return proto.Marshal(P(v))
+}
+
+func (ProtoCodec[T, P]) Decode(data []byte) (*T, error) {
+	v := new(T)
+	if err := proto.Unmarshal(data, P(v)); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Codecs for the built-in message types. They write the pkg/wire schema and
+// also accept the legacy JSON encoding.
+var (
+	ProviderCodec  Codec[ProviderMessage]  = CodecFuncs[ProviderMessage]{EncodeProviderMessage, DecodeProviderMessage}
+	RequestCodec   Codec[RequestMessage]   = CodecFuncs[RequestMessage]{EncodeRequestMessage, DecodeRequestMessage}
+	ResponseCodec  Codec[ResponseMessage]  = CodecFuncs[ResponseMessage]{EncodeResponseMessage, DecodeResponseMessage}
+	HeartbeatCodec Codec[HeartbeatMessage] = CodecFuncs[HeartbeatMessage]{EncodeHeartbeatMessage, DecodeHeartbeatMessage}
+)
+
+// TypedHandler receives a decoded message and its sender. from is empty
+// for unsigned messages.
+type TypedHandler[T any] func(ctx context.Context, from peer.ID, msg *T) error
+
+// TypedTopic publishes and subscribes to values of T on one topic.
+type TypedTopic[T any] struct {
+	manager *PubSubManager
+	name    string
+	codec   Codec[T]
+}
+
+func NewTypedTopic[T any](manager *PubSubManager, topic string, codec Codec[T]) *TypedTopic[T] {
+	return &TypedTopic[T]{
+		manager: manager,
+		name:    topic,
+		codec:   codec,
+	}
+}
+
+func ProviderTopic(manager *PubSubManager) *TypedTopic[ProviderMessage] {
+	return NewTypedTopic(manager, TopicProviders, ProviderCodec)
+}
+
+func RequestTopic(manager *PubSubManager) *TypedTopic[RequestMessage] {
+	return NewTypedTopic(manager, TopicRequests, RequestCodec)
+}
+
+func ResponseTopic(manager *PubSubManager) *TypedTopic[ResponseMessage] {
+	return NewTypedTopic(manager, TopicResponses, ResponseCodec)
+}
+
+func HeartbeatTopic(manager *PubSubManager) *TypedTopic[HeartbeatMessage] {
+	return NewTypedTopic(manager, TopicHeartbeat, HeartbeatCodec)
+}
+
+func (t *TypedTopic[T]) Name() string {
+	return t.name
+}
+
+func (t *TypedTopic[T]) Publish(ctx context.Context, msg *T, opts ...PublishOption) error {
+	data, err := t.codec.Encode(msg)
+	if err != nil {
+		return fmt.Errorf("encode %s message: %w", t.name, err)
+	}
+	return t.manager.PublishWithOptions(ctx, t.name, data, opts...)
+}
+
+// Subscribe adds handler to the manager's subscription to the topic.
+func (t *TypedTopic[T]) Subscribe(handler TypedHandler[T], opts ...SubscribeOption) (*Subscription, error) {
+	return t.manager.Subscribe(t.name, t.Handler(handler), opts...)
+}
+
+// Handler adapts handler to a MessageHandler. Messages that fail to decode
+// are counted against the topic and not passed on.
+func (t *TypedTopic[T]) Handler(handler TypedHandler[T]) MessageHandler {
+	return func(ctx context.Context, msg *Message) error {
+		v, err := t.codec.Decode(msg.Data)
+		if err != nil {
+			t.manager.recordDecodeError(t.name)
+			return fmt.Errorf("decode %s message: %w", t.name, err)
+		}
+
+		var from peer.ID
+		if len(msg.From) > 0 {
+			if from, err = peer.IDFromBytes(msg.From); err != nil {
+				t.manager.recordDecodeError(t.name)
+				return fmt.Errorf("%s message sender: %w", t.name, err)
+			}
+		}
+
+		return handler(ctx, from, v)
+	}
+}
+
+func (m *PubSubManager) recordDecodeError(topic string) {
+	if m == nil {
+		return
+	}
+
+	m.decodeMu.Lock()
+	counter, ok := m.decodeErrors[topic]
+	if !ok {
+		counter = new(uint64)
+		m.decodeErrors[topic] = counter
+	}
+	m.decodeMu.Unlock()
+
+	atomic.AddUint64(counter, 1)
+	if m.metrics != nil {
+		m.metrics.IncPubSubDecodeErrors(topic)
+	}
+}
+
+// DecodeErrors returns how many messages on topic typed handlers have
+// failed to decode.
+func (m *PubSubManager) DecodeErrors(topic string) uint64 {
+	m.decodeMu.Lock()
+	counter, ok := m.decodeErrors[topic]
+	m.decodeMu.Unlock()
+	if !ok {
+		return 0
+	}
+	return atomic.LoadUint64(counter)
+}
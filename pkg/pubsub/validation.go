@@ -0,0 +1,355 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-pubsub"
+)
+
+// ValidationResult is a validator's verdict on a message. Rejected messages
+// are dropped and count against the sender's score; ignored messages are
+// dropped without penalty, for messages that are well formed but unwanted,
+// such as stale heartbeats.
+type ValidationResult int
+
+const (
+	ValidationAccept ValidationResult = iota
+	ValidationReject
+	ValidationIgnore
+)
+
+func (r ValidationResult) String() string {
+	switch r {
+	case ValidationAccept:
+		return "accept"
+	case ValidationReject:
+		return "reject"
+	case ValidationIgnore:
+		return "ignore"
+	default:
+		return fmt.Sprintf("ValidationResult(%d)", int(r))
+	}
+}
+
+type MessageValidator func(ctx context.Context, msg *Message) ValidationResult
+
+const (
+	DefaultValidatorTimeout     = 2 * time.Second
+	DefaultValidatorConcurrency = 64
+
+	MaxProviderMessageSize  = 16 * 1024
+	MaxRequestMessageSize   = 1024 * 1024
+	MaxResponseMessageSize  = 1024 * 1024
+	MaxHeartbeatMessageSize = 1024
+
+	// MaxAdvertTTL caps the lifetime a provider may claim for its advert.
+	MaxAdvertTTL = time.Hour
+	// MaxHeartbeatSkew is how far a heartbeat's timestamp may be from the
+	// local clock before the heartbeat is ignored.
+	MaxHeartbeatSkew = 5 * time.Minute
+	// MaxAdvertSkew is how much later than its origin's timestamp an advert
+	// may be dated by the time it was received, allowing for clock skew.
+	MaxAdvertSkew = time.Minute
+)
+
+func NoOpValidator(ctx context.Context, msg *Message) ValidationResult {
+	if len(msg.Data) == 0 {
+		return ValidationReject
+	}
+	return ValidationAccept
+}
+
+func ProviderValidator(ctx context.Context, msg *Message) ValidationResult {
+	if len(msg.Data) == 0 || len(msg.Data) > MaxProviderMessageSize {
+		return ValidationReject
+	}
+
+	advert, err := DecodeProviderMessage(msg.Data)
+	if err != nil || advert.Model == "" {
+		return ValidationReject
+	}
+
+	if advert.Capacity < 0 || advert.Load < 0 || advert.QueueDepth < 0 || advert.QueueWait < 0 ||
+		advert.Price < 0 || advert.TTL < 0 || advert.TTL > MaxAdvertTTL {
+		return ValidationReject
+	}
+
+	return ValidationAccept
+}
+
+func RequestValidator(ctx context.Context, msg *Message) ValidationResult {
+	if len(msg.Data) == 0 || len(msg.Data) > MaxRequestMessageSize {
+		return ValidationReject
+	}
+
+	request, err := DecodeRequestMessage(msg.Data)
+	if err != nil || request.RequestID == "" || request.Model == "" {
+		return ValidationReject
+	}
+
+	if request.Encrypted {
+		if _, err := peer.Decode(request.Recipient); err != nil {
+			return ValidationReject
+		}
+	}
+	// Providers reply directly to ReplyTo, which must be the origin.
+	if request.ReplyTo != "" {
+		replyTo, err := peer.Decode(request.ReplyTo)
+		if err != nil {
+			return ValidationReject
+		}
+		if len(msg.From) > 0 {
+			from, err := peer.IDFromBytes(msg.From)
+			if err != nil || from != replyTo {
+				return ValidationReject
+			}
+		}
+	}
+
+	return ValidationAccept
+}
+
+func ResponseValidator(ctx context.Context, msg *Message) ValidationResult {
+	if len(msg.Data) == 0 || len(msg.Data) > MaxResponseMessageSize {
+		return ValidationReject
+	}
+
+	response, err := DecodeResponseMessage(msg.Data)
+	if err != nil || response.RequestID == "" {
+		return ValidationReject
+	}
+
+	return ValidationAccept
+}
+
+// HeartbeatValidator also rejects heartbeats naming a peer other than their
+// signer, and ignores ones too far from the local clock.
+func HeartbeatValidator(ctx context.Context, msg *Message) ValidationResult {
+	if len(msg.Data) == 0 || len(msg.Data) > MaxHeartbeatMessageSize {
+		return ValidationReject
+	}
+
+	hb, err := DecodeHeartbeatMessage(msg.Data)
+	if err != nil || hb.PeerID == "" {
+		return ValidationReject
+	}
+
+	if len(msg.From) > 0 {
+		from, err := peer.IDFromBytes(msg.From)
+		if err != nil || from.String() != hb.PeerID {
+			return ValidationReject
+		}
+	}
+
+	skew := time.Since(time.Unix(hb.Timestamp, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > MaxHeartbeatSkew {
+		return ValidationIgnore
+	}
+
+	return ValidationAccept
+}
+
+// ValidationStats counts a topic's validation outcomes. RateLimited counts
+// the rejected or ignored messages that exceeded a rate limit.
+type ValidationStats struct {
+	Accepted    uint64
+	Rejected    uint64
+	Ignored     uint64
+	RateLimited uint64
+}
+
+type validationCounters struct {
+	accepted    uint64
+	rejected    uint64
+	ignored     uint64
+	rateLimited uint64
+}
+
+func (c *validationCounters) record(result ValidationResult) {
+	switch result {
+	case ValidationAccept:
+		atomic.AddUint64(&c.accepted, 1)
+	case ValidationReject:
+		atomic.AddUint64(&c.rejected, 1)
+	default:
+		atomic.AddUint64(&c.ignored, 1)
+	}
+}
+
+func (c *validationCounters) stats() ValidationStats {
+	return ValidationStats{
+		Accepted:    atomic.LoadUint64(&c.accepted),
+		Rejected:    atomic.LoadUint64(&c.rejected),
+		Ignored:     atomic.LoadUint64(&c.ignored),
+		RateLimited: atomic.LoadUint64(&c.rateLimited),
+	}
+}
+
+// RegisterValidator registers cfg.Validator and the topic's rate limits with
+// the router for cfg.Name. Validation runs asynchronously; a validation that
+// outlives the timeout is ignored, and messages arriving while the
+// concurrency limit is reached are dropped before validation.
+//
+// A message over its origin's rate limit is rejected, penalising the origin,
+// if the origin delivered it, and ignored if another peer relayed it.
+// Messages over the topic rate limit are ignored.
+func (m *PubSubManager) RegisterValidator(cfg *TopicConfig) error {
+	limited := cfg.PeerRateLimit.enabled() || cfg.TopicRateLimit.enabled()
+	if m.pubsub == nil || (cfg.Validator == nil && !limited) {
+		return nil
+	}
+
+	timeout := cfg.ValidatorTimeout
+	if timeout <= 0 {
+		timeout = DefaultValidatorTimeout
+	}
+	concurrency := cfg.ValidatorConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultValidatorConcurrency
+	}
+
+	counters := &validationCounters{}
+	validate := cfg.Validator
+	if validate == nil {
+		validate = func(context.Context, *Message) ValidationResult { return ValidationAccept }
+	}
+	topic := cfg.Name
+	limiters := &topicLimiters{
+		peer:  newRateLimiter(cfg.PeerRateLimit),
+		topic: newRateLimiter(cfg.TopicRateLimit),
+	}
+
+	err := m.pubsub.RegisterTopicValidator(topic,
+		pubsub.ValidatorEx(func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+			if from != m.self {
+				origin := from
+				if len(msg.GetFrom()) > 0 {
+					origin = peer.ID(msg.GetFrom())
+				}
+				if result, ok := m.rateLimit(topic, from, origin, limiters); !ok {
+					atomic.AddUint64(&counters.rateLimited, 1)
+					counters.record(result)
+					return toPubSubResult(result)
+				}
+			}
+
+			result := validate(ctx, fromPubSubMessage(topic, msg))
+			if ctx.Err() != nil {
+				result = ValidationIgnore
+			}
+			counters.record(result)
+			return toPubSubResult(result)
+		}),
+		pubsub.WithValidatorTimeout(timeout),
+		pubsub.WithValidatorConcurrency(concurrency),
+	)
+	if err != nil {
+		return fmt.Errorf("register validator for %s: %w", topic, err)
+	}
+
+	m.validationMu.Lock()
+	m.validation[topic] = counters
+	m.limiters[topic] = limiters
+	m.validationMu.Unlock()
+	return nil
+}
+
+// topicLimiters are the rate limiters of a topic's validator. Messages
+// synced from peers are counted against them too.
+type topicLimiters struct {
+	peer  *rateLimiter
+	topic *rateLimiter
+}
+
+// rateLimit checks a message of origin, received from the peer from,
+// against the limits of topic and reports whether it may proceed to
+// validation.
+func (m *PubSubManager) rateLimit(topic string, from, origin peer.ID, limiters *topicLimiters) (ValidationResult, bool) {
+	now := time.Now()
+
+	if !limiters.peer.allow(string(origin), now) {
+		if m.metrics != nil {
+			m.metrics.IncPubSubRateLimited(topic)
+		}
+		if origin != from {
+			return ValidationIgnore, false
+		}
+		m.recordViolation(origin)
+		return ValidationReject, false
+	}
+
+	if !limiters.topic.allow(topic, now) {
+		if m.metrics != nil {
+			m.metrics.IncPubSubRateLimited(topic)
+		}
+		return ValidationIgnore, false
+	}
+
+	return ValidationAccept, true
+}
+
+// RegisterValidators registers the validator of every config that has one.
+func (m *PubSubManager) RegisterValidators(configs map[string]*TopicConfig) error {
+	for _, cfg := range configs {
+		if err := m.RegisterValidator(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *PubSubManager) UnregisterValidator(topic string) error {
+	if m.pubsub == nil {
+		return nil
+	}
+
+	m.validationMu.Lock()
+	delete(m.validation, topic)
+	delete(m.limiters, topic)
+	m.validationMu.Unlock()
+
+	return m.pubsub.UnregisterTopicValidator(topic)
+}
+
+// ValidationStats returns the validation outcomes counted for topic since
+// its validator was registered.
+func (m *PubSubManager) ValidationStats(topic string) ValidationStats {
+	m.validationMu.RLock()
+	counters, ok := m.validation[topic]
+	m.validationMu.RUnlock()
+	if !ok {
+		return ValidationStats{}
+	}
+	return counters.stats()
+}
+
+func fromPubSubMessage(topic string, msg *pubsub.Message) *Message {
+	return &Message{
+		ID:         msg.ID,
+		Data:       msg.GetData(),
+		From:       []byte(msg.GetFrom()),
+		Seqno:      msg.GetSeqno(),
+		Topic:      topic,
+		Signature:  msg.GetSignature(),
+		Key:        msg.GetKey(),
+		ReceivedAt: time.Now(),
+	}
+}
+
+func toPubSubResult(result ValidationResult) pubsub.ValidationResult {
+	switch result {
+	case ValidationAccept:
+		return pubsub.ValidationAccept
+	case ValidationIgnore:
+		return pubsub.ValidationIgnore
+	default:
+		return pubsub.ValidationReject
+	}
+}
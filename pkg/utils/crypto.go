@@ -1,13 +1,20 @@
 package utils
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"math/big"
 
 	"github.com/ethereum/go-ethereum/crypto"
 )
@@ -87,3 +94,127 @@ func VerifyHash(data, hash []byte) bool {
 	computed := sha256.Sum256(data)
 	return string(computed[:]) == string(hash)
 }
+
+// ed25519P is the field prime 2^255 - 19 shared by Ed25519 and X25519.
+var ed25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// Ed25519PrivateKeyToX25519 derives the X25519 key that corresponds to an
+// Ed25519 signing key, so an Ed25519 identity can also take part in ECDH.
+func Ed25519PrivateKeyToX25519(key ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid ed25519 private key length %d", len(key))
+	}
+	h := sha512.Sum512(key.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+// Ed25519PublicKeyToX25519 maps an Ed25519 public key to its Montgomery
+// form, u = (1 + y) / (1 - y) mod p.
+func Ed25519PublicKeyToX25519(key ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key length %d", len(key))
+	}
+
+	le := make([]byte, len(key))
+	copy(le, key)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+	if y.Cmp(ed25519P) >= 0 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, ed25519P)
+	if den.Sign() == 0 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, ed25519P))
+	u.Mod(u, ed25519P)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	return ecdh.X25519().NewPublicKey(reverse(out))
+}
+
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
+// SharedSecretSecp256k1 returns the x coordinate of priv * pub on
+// secp256k1, which crypto/ecdh does not support.
+func SharedSecretSecp256k1(priv *ecdsa.PrivateKey, pub *ecdsa.PublicKey) ([]byte, error) {
+	curve := crypto.S256()
+	if !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("public key is not on secp256k1")
+	}
+
+	x, _ := curve.ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	secret := make([]byte, 32)
+	x.FillBytes(secret)
+	return secret, nil
+}
+
+// DeriveKey expands secret into a size-byte key with HKDF-SHA256.
+func DeriveKey(secret, salt, info []byte, size int) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	key := make([]byte, 0, size+sha256.Size)
+	var block []byte
+	for counter := byte(1); len(key) < size; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		key = append(key, block...)
+	}
+	return key[:size]
+}
+
+// Seal encrypts plaintext with AES-256-GCM under key, authenticating aad,
+// and returns the random nonce followed by the ciphertext.
+func Seal(key, plaintext, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// Open reverses Seal.
+func Open(key, sealed, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -25,6 +25,19 @@ type Metrics struct {
 	requestsDuration *prometheus.HistogramVec
 	errorsTotal      prometheus.Counter
 
+	verificationFailures prometheus.Counter
+
+	streamResets      *prometheus.CounterVec
+	streamRejections  *prometheus.CounterVec
+	handlerQueueDepth prometheus.Gauge
+	handlersInFlight  prometheus.Gauge
+
+	pubsubPeerScores   *prometheus.GaugeVec
+	pubsubDecodeErrors *prometheus.CounterVec
+	pubsubDropped      *prometheus.CounterVec
+	pubsubHandlerErrs  *prometheus.CounterVec
+	pubsubRateLimited  *prometheus.CounterVec
+
 	mu sync.RWMutex
 }
 
@@ -71,6 +84,56 @@ func NewMetrics(name string) (*Metrics, error) {
 		Help: "Total number of errors",
 	})
 
+	m.verificationFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_verification_failures_total", name),
+		Help: "Total number of messages that failed signature, timestamp or replay checks",
+	})
+
+	m.streamResets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_stream_resets_total", name),
+		Help: "Total number of inbound protocol streams reset, by reason",
+	}, []string{"reason"})
+
+	m.streamRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_stream_rejections_total", name),
+		Help: "Total number of inbound messages rejected by concurrency limits, by limit",
+	}, []string{"reason"})
+
+	m.handlerQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_handler_queue_depth", name),
+		Help: "Number of inbound messages waiting for a handler slot",
+	})
+
+	m.handlersInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_handlers_in_flight", name),
+		Help: "Number of protocol handlers currently executing",
+	})
+
+	m.pubsubPeerScores = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_pubsub_peer_score", name),
+		Help: "Gossipsub score of each scored peer",
+	}, []string{"peer"})
+
+	m.pubsubDecodeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_pubsub_decode_errors_total", name),
+		Help: "Total number of pubsub messages that failed to decode, by topic",
+	}, []string{"topic"})
+
+	m.pubsubDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_pubsub_messages_dropped_total", name),
+		Help: "Total number of pubsub messages dropped by full subscription buffers, by topic",
+	}, []string{"topic"})
+
+	m.pubsubHandlerErrs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_pubsub_handler_errors_total", name),
+		Help: "Total number of pubsub messages a subscription handler failed on, by topic",
+	}, []string{"topic"})
+
+	m.pubsubRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_pubsub_rate_limited_total", name),
+		Help: "Total number of inbound pubsub messages over a rate limit, by topic",
+	}, []string{"topic"})
+
 	registry.MustRegister(
 		m.peersTotal,
 		m.peersCurrent,
@@ -79,6 +142,16 @@ func NewMetrics(name string) (*Metrics, error) {
 		m.requestsTotal,
 		m.requestsDuration,
 		m.errorsTotal,
+		m.verificationFailures,
+		m.streamResets,
+		m.streamRejections,
+		m.handlerQueueDepth,
+		m.handlersInFlight,
+		m.pubsubPeerScores,
+		m.pubsubDecodeErrors,
+		m.pubsubDropped,
+		m.pubsubHandlerErrs,
+		m.pubsubRateLimited,
 	)
 
 	mux := http.NewServeMux()
@@ -145,6 +218,51 @@ func (m *Metrics) IncErrors() {
 	m.errorsTotal.Inc()
 }
 
+func (m *Metrics) IncVerificationFailures() {
+	m.verificationFailures.Inc()
+}
+
+func (m *Metrics) IncStreamResets(reason string) {
+	m.streamResets.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) IncStreamRejections(reason string) {
+	m.streamRejections.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) AddHandlerQueueDepth(delta int) {
+	m.handlerQueueDepth.Add(float64(delta))
+}
+
+func (m *Metrics) AddHandlersInFlight(delta int) {
+	m.handlersInFlight.Add(float64(delta))
+}
+
+// SetPeerScores replaces the exported peer scores, dropping peers that are
+// no longer scored.
+func (m *Metrics) SetPeerScores(scores map[string]float64) {
+	m.pubsubPeerScores.Reset()
+	for p, score := range scores {
+		m.pubsubPeerScores.WithLabelValues(p).Set(score)
+	}
+}
+
+func (m *Metrics) IncPubSubDecodeErrors(topic string) {
+	m.pubsubDecodeErrors.WithLabelValues(topic).Inc()
+}
+
+func (m *Metrics) IncPubSubDropped(topic string) {
+	m.pubsubDropped.WithLabelValues(topic).Inc()
+}
+
+func (m *Metrics) IncPubSubHandlerErrors(topic string) {
+	m.pubsubHandlerErrs.WithLabelValues(topic).Inc()
+}
+
+func (m *Metrics) IncPubSubRateLimited(topic string) {
+	m.pubsubRateLimited.WithLabelValues(topic).Inc()
+}
+
 func (m *Metrics) SetPeers(count int) {
 	m.peersCurrent.Set(float64(count))
 }
@@ -0,0 +1,50 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// WriteFrame writes m prefixed with its length as a varint, in one write.
+func WriteFrame(w io.Writer, m proto.Message) error {
+	size := proto.Size(m)
+	buf := make([]byte, 0, protowire.SizeVarint(uint64(size))+size)
+	buf = protowire.AppendVarint(buf, uint64(size))
+
+	buf, err := proto.MarshalOptions{UseCachedSize: true}.MarshalAppend(buf, m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a frame written by WriteFrame into m. It returns io.EOF
+// only if r ended before the frame started, and rejects frames larger than
+// maxSize when maxSize is positive.
+func ReadFrame(r *bufio.Reader, m proto.Message, maxSize int) error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && size > uint64(maxSize) {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return proto.Unmarshal(buf, m)
+}
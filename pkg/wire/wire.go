@@ -0,0 +1,45 @@
+// Package wire holds the protobuf schema shared by the /llm-share stream
+// protocol and the llm-share.* pubsub topics.
+package wire
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative wire.proto
+
+// SchemaVersion is the version of wire.proto. Version 0 was the ad-hoc JSON
+// encoding of the Go structs in pkg/protocol and pkg/pubsub.
+const SchemaVersion = 1
+
+// IsJSON reports whether data is a JSON object rather than a protobuf
+// message. Protobuf never starts with '{' since that would be a group start
+// for field 15, which the schema does not use.
+func IsJSON(data []byte) bool {
+	return len(data) > 0 && data[0] == '{'
+}
+
+// Decode decodes data into pb, or into legacy if data is JSON, and reports
+// whether it was JSON.
+func Decode(data []byte, legacy interface{}, pb proto.Message) (bool, error) {
+	if IsJSON(data) {
+		if err := json.Unmarshal(data, legacy); err != nil {
+			return true, fmt.Errorf("decode legacy JSON: %w", err)
+		}
+		return true, nil
+	}
+
+	if err := proto.Unmarshal(data, pb); err != nil {
+		return false, fmt.Errorf("decode protobuf: %w", err)
+	}
+	return false, nil
+}
+
+// EncodeJSON encodes v as indented JSON, the encoding used before the
+// schema existed. It is kept for debugging.
+func EncodeJSON(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
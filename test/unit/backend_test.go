@@ -0,0 +1,357 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/your-org/p2p-network/pkg/openai"
+	"github.com/your-org/p2p-network/pkg/protocol"
+)
+
+func chatRequest(model string) *protocol.Request {
+	return &protocol.Request{
+		Method: protocol.MethodChatCompletions,
+		Model:  model,
+		Params: json.RawMessage(`{"model":"` + model + `","stream":true,"temperature":0.5,"messages":[{"role":"user","content":"hi"}]}`),
+		ID:     "req-1",
+	}
+}
+
+func TestOpenAIBackendRewritesModel(t *testing.T) {
+	var upstream map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		json.NewDecoder(r.Body).Decode(&upstream)
+		w.Write([]byte(`{"id":"x","object":"chat.completion","model":"Meta-Llama-3-8B","choices":[{"index":0,"message":{"role":"assistant","content":"hello"}}]}`))
+	}))
+	defer server.Close()
+
+	b, err := New(Config{Model: "llama-3-8b", Type: TypeOpenAI, URL: server.URL, UpstreamModel: "Meta-Llama-3-8B", APIKey: "secret"})
+	require.NoError(t, err)
+
+	result, err := b.Generate(context.Background(), chatRequest("llama-3-8b"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "Meta-Llama-3-8B", upstream["model"])
+	assert.Equal(t, false, upstream["stream"])
+	assert.Equal(t, 0.5, upstream["temperature"])
+
+	var resp openai.ChatCompletionResponse
+	require.NoError(t, json.Unmarshal(result, &resp))
+	assert.Equal(t, "llama-3-8b", resp.Model)
+	assert.Equal(t, "hello", resp.Choices[0].Message.Content)
+}
+
+func TestOllamaBackendTranslatesChat(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/chat", r.URL.Path)
+
+		var req struct {
+			Model    string                 `json:"model"`
+			Stream   bool                   `json:"stream"`
+			Options  map[string]interface{} `json:"options"`
+			Messages []openai.ChatMessage   `json:"messages"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "llama3", req.Model)
+		assert.False(t, req.Stream)
+		assert.Equal(t, 0.5, req.Options["temperature"])
+		assert.Equal(t, "hi", req.Messages[0].Content)
+
+		w.Write([]byte(`{"model":"llama3","message":{"role":"assistant","content":"hello"},"done":true,"prompt_eval_count":3,"eval_count":2}`))
+	}))
+	defer server.Close()
+
+	b, err := New(Config{Model: "llama-3-8b", Type: TypeOllama, URL: server.URL, UpstreamModel: "llama3"})
+	require.NoError(t, err)
+
+	result, err := b.Generate(context.Background(), chatRequest("llama-3-8b"))
+	require.NoError(t, err)
+
+	var resp openai.ChatCompletionResponse
+	require.NoError(t, json.Unmarshal(result, &resp))
+	assert.Equal(t, "chat.completion", resp.Object)
+	assert.Equal(t, "hello", resp.Choices[0].Message.Content)
+	assert.Equal(t, 5, resp.Usage.TotalTokens)
+}
+
+func TestOpenAIBackendStreamsChunks(t *testing.T) {
+	var upstream map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstream)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, content := range []string{"hel", "lo"} {
+			fmt.Fprintf(w, "data: {\"object\":\"chat.completion.chunk\",\"model\":\"Meta-Llama-3-8B\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", content)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	b, err := New(Config{Model: "llama-3-8b", Type: TypeOpenAI, URL: server.URL, UpstreamModel: "Meta-Llama-3-8B"})
+	require.NoError(t, err)
+	streaming, ok := b.(StreamingBackend)
+	require.True(t, ok)
+
+	var chunks []openai.ChatCompletionResponse
+	err = streaming.GenerateStream(context.Background(), chatRequest("llama-3-8b"), func(data json.RawMessage) error {
+		var chunk openai.ChatCompletionResponse
+		require.NoError(t, json.Unmarshal(data, &chunk))
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, true, upstream["stream"])
+	require.Len(t, chunks, 2)
+	assert.Equal(t, "llama-3-8b", chunks[0].Model)
+	assert.Equal(t, "hel", chunks[0].Choices[0].Delta.Content)
+	assert.Equal(t, "lo", chunks[1].Choices[0].Delta.Content)
+}
+
+func TestOllamaBackendStreamsChat(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Stream bool `json:"stream"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.True(t, req.Stream)
+
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"hel"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"lo"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":3,"eval_count":2}`)
+	}))
+	defer server.Close()
+
+	b, err := New(Config{Model: "llama-3-8b", Type: TypeOllama, URL: server.URL, UpstreamModel: "llama3"})
+	require.NoError(t, err)
+
+	var chunks []openai.ChatCompletionResponse
+	err = b.(StreamingBackend).GenerateStream(context.Background(), chatRequest("llama-3-8b"), func(data json.RawMessage) error {
+		var chunk openai.ChatCompletionResponse
+		require.NoError(t, json.Unmarshal(data, &chunk))
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Len(t, chunks, 3)
+	assert.Equal(t, "chat.completion.chunk", chunks[0].Object)
+	assert.Equal(t, "hel", chunks[0].Choices[0].Delta.Content)
+	assert.Nil(t, chunks[1].Choices[0].FinishReason)
+	require.NotNil(t, chunks[2].Choices[0].FinishReason)
+	assert.Equal(t, "stop", *chunks[2].Choices[0].FinishReason)
+	assert.Equal(t, 5, chunks[2].Usage.TotalTokens)
+}
+
+func TestToProtocolError(t *testing.T) {
+	tests := []struct {
+		status int
+		code   int
+	}{
+		{http.StatusBadRequest, protocol.ErrCodeInvalidRequest},
+		{http.StatusNotFound, protocol.ErrCodeNotFound},
+		{http.StatusTooManyRequests, protocol.ErrCodeBusy},
+		{http.StatusServiceUnavailable, protocol.ErrCodeUnavailable},
+		{http.StatusGatewayTimeout, protocol.ErrCodeTimeout},
+		{http.StatusInternalServerError, protocol.ErrCodeInternal},
+	}
+
+	for _, tt := range tests {
+		err := ToProtocolError(&UpstreamError{Status: tt.status, Message: "boom"})
+		assert.Equal(t, tt.code, err.Code, "status %d", tt.status)
+	}
+
+	assert.Equal(t, protocol.ErrCodeTimeout, ToProtocolError(context.DeadlineExceeded).Code)
+}
+
+func TestRegistryUpstreamErrorMessage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"message":"slow down","type":"rate_limit_error"}}`))
+	}))
+	defer server.Close()
+
+	registry, err := NewRegistry([]Config{{Model: "m", URL: server.URL}}, 0)
+	require.NoError(t, err)
+
+	resp := registry.Serve(context.Background(), chatRequest("m"))
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, protocol.ErrCodeBusy, resp.Error.Code)
+	assert.Equal(t, "slow down", resp.Error.Message)
+	assert.True(t, resp.Error.Retryable())
+}
+
+func TestRegistryConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	registry, err := NewRegistry([]Config{{Model: "m", URL: server.URL, MaxConcurrency: 1, QueueDepth: -1}}, 0)
+	require.NoError(t, err)
+
+	go registry.Serve(context.Background(), chatRequest("m"))
+	require.Eventually(t, func() bool {
+		status, _ := registry.Status("m")
+		return status.InFlight == 1
+	}, time.Second, 5*time.Millisecond)
+
+	resp := registry.Serve(context.Background(), chatRequest("m"))
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, protocol.ErrCodeBusy, resp.Error.Code)
+}
+
+func TestRegistryHealthCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	registry, err := NewRegistry([]Config{{Model: "m", Type: TypeOllama, URL: server.URL}}, 0)
+	require.NoError(t, err)
+
+	registry.CheckHealth(context.Background())
+	status, ok := registry.Status("m")
+	require.True(t, ok)
+	assert.False(t, status.Healthy)
+
+	resp := registry.Serve(context.Background(), chatRequest("m"))
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, protocol.ErrCodeUnavailable, resp.Error.Code)
+
+	resp = registry.Serve(context.Background(), chatRequest("other"))
+	assert.Equal(t, protocol.ErrCodeNotFound, resp.Error.Code)
+}
+
+func TestAdmissionQueuePriorityOrder(t *testing.T) {
+	queue := newAdmissionQueue(1, 8, time.Second)
+	ctx := context.Background()
+	require.NoError(t, queue.acquire(ctx, protocol.PriorityNormal, nil))
+
+	admitted := make(chan int, 3)
+	for i, priority := range []int{protocol.PriorityLow, protocol.PriorityNormal, protocol.PriorityHigh} {
+		go func(priority int) {
+			if queue.acquire(ctx, priority, nil) == nil {
+				admitted <- priority
+			}
+		}(priority)
+		require.Eventually(t, func() bool { return queue.Stats().Queued == i+1 }, time.Second, time.Millisecond)
+	}
+
+	var order []int
+	for i := 0; i < 3; i++ {
+		queue.release(10 * time.Millisecond)
+		order = append(order, <-admitted)
+	}
+	assert.Equal(t, []int{protocol.PriorityHigh, protocol.PriorityNormal, protocol.PriorityLow}, order)
+	assert.Equal(t, 1, queue.Stats().InFlight)
+}
+
+func TestAdmissionQueueRejectsWhenFull(t *testing.T) {
+	queue := newAdmissionQueue(1, 1, time.Second)
+	ctx := context.Background()
+	require.NoError(t, queue.acquire(ctx, protocol.PriorityNormal, nil))
+	queue.release(100 * time.Millisecond)
+	require.NoError(t, queue.acquire(ctx, protocol.PriorityNormal, nil))
+
+	go queue.acquire(ctx, protocol.PriorityNormal, nil)
+	require.Eventually(t, func() bool { return queue.Stats().Queued == 1 }, time.Second, time.Millisecond)
+
+	err := queue.acquire(ctx, protocol.PriorityNormal, nil)
+	wait, ok := protocol.RetryAfter(err)
+	require.True(t, ok)
+	assert.Equal(t, 200*time.Millisecond, wait)
+}
+
+func TestAdmissionQueueTimeout(t *testing.T) {
+	queue := newAdmissionQueue(1, 4, 20*time.Millisecond)
+	ctx := context.Background()
+	require.NoError(t, queue.acquire(ctx, protocol.PriorityNormal, nil))
+
+	err := queue.acquire(ctx, protocol.PriorityNormal, nil)
+	var protoErr *protocol.Error
+	require.ErrorAs(t, err, &protoErr)
+	assert.Equal(t, protocol.ErrCodeBusy, protoErr.Code)
+	assert.Equal(t, 0, queue.Stats().Queued)
+
+	queue.release(0)
+	assert.Equal(t, 0, queue.Stats().InFlight)
+}
+
+func TestAdmissionQueueReportsPosition(t *testing.T) {
+	queue := newAdmissionQueue(1, 4, time.Second)
+	ctx := context.Background()
+	require.NoError(t, queue.acquire(ctx, protocol.PriorityNormal, nil))
+
+	positions := make(chan int, 10)
+	report := func(position, depth int, wait time.Duration) {
+		positions <- position
+	}
+	next := func() int {
+		select {
+		case p := <-positions:
+			return p
+		case <-time.After(time.Second):
+			t.Fatal("no position reported")
+			return 0
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- queue.acquire(ctx, protocol.PriorityLow, report) }()
+	assert.Equal(t, 1, next())
+
+	go queue.acquire(ctx, protocol.PriorityHigh, nil)
+	assert.Equal(t, 2, next(), "a higher priority request moves ahead")
+
+	queue.release(0)
+	assert.Equal(t, 1, next())
+
+	queue.release(0)
+	require.NoError(t, <-done)
+}
+
+func TestAdmissionQueueSlowReportDoesNotBlockRelease(t *testing.T) {
+	queue := newAdmissionQueue(1, 4, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, queue.acquire(ctx, protocol.PriorityNormal, nil))
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	slow := func(position, depth int, wait time.Duration) {
+		<-unblock
+	}
+
+	go queue.acquire(ctx, protocol.PriorityLow, slow)
+	require.Eventually(t, func() bool { return queue.Stats().Queued == 1 }, time.Second, time.Millisecond)
+
+	admitted := make(chan error, 1)
+	go func() { admitted <- queue.acquire(ctx, protocol.PriorityHigh, nil) }()
+	require.Eventually(t, func() bool { return queue.Stats().Queued == 2 }, time.Second, time.Millisecond)
+
+	released := make(chan struct{})
+	go func() {
+		queue.release(0)
+		close(released)
+	}()
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("release waited for a position report")
+	}
+	require.NoError(t, <-admitted)
+}
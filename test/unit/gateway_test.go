@@ -0,0 +1,365 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/your-org/p2p-network/pkg/backend"
+	"github.com/your-org/p2p-network/pkg/openai"
+	"github.com/your-org/p2p-network/pkg/protocol"
+)
+
+// fakeNetwork stands in for the P2P network with a single in-process
+// provider serving "echo" by replying with the last user message.
+type fakeNetwork struct {
+	provider peer.ID
+	requests []*protocol.Request
+	sessions []string
+	err      error
+}
+
+func (f *fakeNetwork) Models(ctx context.Context) []ModelInfo {
+	return []ModelInfo{{ID: "echo", Providers: 1}}
+}
+
+func (f *fakeNetwork) Providers(ctx context.Context, model string) ([]protocol.ProviderCandidate, error) {
+	if model != "echo" {
+		return nil, nil
+	}
+	return []protocol.ProviderCandidate{{Peer: f.provider}}, nil
+}
+
+func (f *fakeNetwork) Request(ctx context.Context, providers []protocol.ProviderCandidate, session string, req *protocol.Request) (*protocol.Response, peer.ID, error) {
+	f.requests = append(f.requests, req)
+	f.sessions = append(f.sessions, session)
+	if f.err != nil {
+		return nil, providers[0].Peer, f.err
+	}
+
+	stop := "stop"
+	var result interface{}
+	switch req.Method {
+	case protocol.MethodChatCompletions:
+		var body openai.ChatCompletionRequest
+		if err := json.Unmarshal(req.Params, &body); err != nil {
+			return nil, providers[0].Peer, err
+		}
+		last := body.Messages[len(body.Messages)-1]
+		result = openai.ChatCompletionResponse{
+			ID:      req.ID,
+			Object:  "chat.completion",
+			Created: req.Timestamp,
+			Model:   req.Model,
+			Choices: []openai.ChatChoice{{
+				Message:      &openai.ChatMessage{Role: "assistant", Content: last.Content},
+				FinishReason: &stop,
+			}},
+		}
+	case protocol.MethodCompletions:
+		var body openai.CompletionRequest
+		if err := json.Unmarshal(req.Params, &body); err != nil {
+			return nil, providers[0].Peer, err
+		}
+		var prompt string
+		json.Unmarshal(body.Prompt, &prompt)
+		result = openai.CompletionResponse{
+			ID:      req.ID,
+			Object:  "text_completion",
+			Model:   req.Model,
+			Choices: []openai.CompletionChoice{{Text: prompt, FinishReason: &stop}},
+		}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, providers[0].Peer, err
+	}
+	return &protocol.Response{ID: req.ID, Result: data, Timestamp: time.Now().Unix()}, providers[0].Peer, nil
+}
+
+// clientNetwork sends requests through a protocol client, as NodeNetwork
+// does, to a fixed set of providers.
+type clientNetwork struct {
+	client    *protocol.Client
+	providers []protocol.ProviderCandidate
+}
+
+func (c *clientNetwork) Models(ctx context.Context) []ModelInfo {
+	return nil
+}
+
+func (c *clientNetwork) Providers(ctx context.Context, model string) ([]protocol.ProviderCandidate, error) {
+	return c.providers, nil
+}
+
+func (c *clientNetwork) Request(ctx context.Context, providers []protocol.ProviderCandidate, session string, req *protocol.Request) (*protocol.Response, peer.ID, error) {
+	return c.client.DoSelect(ctx, providers, session, req)
+}
+
+// newProviderNetwork connects a requester to a provider node answering
+// requests with handler over a mock network.
+func newProviderNetwork(t *testing.T, handler protocol.MessageHandler) *clientNetwork {
+	t.Helper()
+
+	mn, err := mocknet.FullMeshConnected(2)
+	require.NoError(t, err)
+	t.Cleanup(func() { mn.Close() })
+
+	hosts := mn.Hosts()
+	for _, host := range hosts {
+		for _, other := range hosts {
+			require.NoError(t, host.Peerstore().AddPubKey(other.ID(), other.Peerstore().PubKey(other.ID())))
+		}
+	}
+
+	requester := protocol.NewHandler(nil)
+	requester.SetHost(hosts[0])
+	requester.Register()
+
+	provider := protocol.NewHandler(nil)
+	provider.SetHost(hosts[1])
+	provider.Register()
+	provider.RegisterHandler(protocol.MsgTypeRequest, handler)
+
+	client := protocol.NewClient(requester, protocol.DefaultRetryPolicy(), protocol.NewCircuitBreakers(protocol.DefaultBreakerConfig()))
+	client.SetSelector(protocol.NewSelector(&protocol.RoundRobin{}, nil, 0))
+	return &clientNetwork{client: client, providers: []protocol.ProviderCandidate{{Peer: hosts[1].ID()}}}
+}
+
+func nextEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: "); ok {
+			return data
+		}
+	}
+}
+
+func newTestGateway(t *testing.T, network Network) *httptest.Server {
+	cfg := DefaultConfig()
+	cfg.RequestTimeout = 5 * time.Second
+	server := httptest.NewServer(New(network, cfg).Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGatewayModels(t *testing.T) {
+	server := newTestGateway(t, &fakeNetwork{provider: "provider-a"})
+
+	resp, err := http.Get(server.URL + "/v1/models")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var list openai.ModelList
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	assert.Equal(t, "list", list.Object)
+	require.Len(t, list.Data, 1)
+	assert.Equal(t, "echo", list.Data[0].ID)
+}
+
+func TestGatewayChatCompletion(t *testing.T) {
+	network := &fakeNetwork{provider: "provider-a"}
+	server := newTestGateway(t, network)
+
+	resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"echo","messages":[{"role":"user","content":"hello"}],"temperature":0.2}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var completion openai.ChatCompletionResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&completion))
+	require.Len(t, completion.Choices, 1)
+	assert.Equal(t, "hello", completion.Choices[0].Message.Content)
+
+	require.Len(t, network.requests, 1)
+	assert.Equal(t, protocol.MethodChatCompletions, network.requests[0].Method)
+	assert.Contains(t, string(network.requests[0].Params), `"temperature":0.2`)
+	assert.NotEmpty(t, network.requests[0].ID)
+}
+
+func TestGatewaySessionHeader(t *testing.T) {
+	network := &fakeNetwork{provider: "provider-a"}
+	server := newTestGateway(t, network)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model":"echo","messages":[{"role":"user","content":"hi"}]}`))
+	require.NoError(t, err)
+	req.Header.Set(SessionHeader, "conversation-1")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Equal(t, []string{"conversation-1"}, network.sessions)
+}
+
+func TestGatewayChatCompletionStream(t *testing.T) {
+	server := newTestGateway(t, &fakeNetwork{provider: "provider-a"})
+
+	resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"echo","stream":true,"messages":[{"role":"user","content":"hello"}]}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			events = append(events, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	require.Len(t, events, 3)
+	assert.Equal(t, "[DONE]", events[2])
+
+	var first openai.ChatCompletionResponse
+	require.NoError(t, json.Unmarshal([]byte(events[0]), &first))
+	assert.Equal(t, "chat.completion.chunk", first.Object)
+	assert.Equal(t, "hello", first.Choices[0].Delta.Content)
+}
+
+func TestGatewayRelaysStreamChunks(t *testing.T) {
+	release := make(chan struct{})
+	var once sync.Once
+	finish := func() { once.Do(func() { close(release) }) }
+	defer finish()
+
+	network := newProviderNetwork(t, func(ctx context.Context, p peer.ID, msg *protocol.Message) (*protocol.Message, error) {
+		chunk := `{"object":"chat.completion.chunk","model":"echo","choices":[{"index":0,"delta":{"role":"assistant","content":"hel"}}]}`
+		if err := protocol.SendStreamChunk(ctx, []byte(chunk)); err != nil {
+			return nil, err
+		}
+
+		<-release
+		chunk = `{"object":"chat.completion.chunk","model":"echo","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`
+		if err := protocol.SendStreamChunk(ctx, []byte(chunk)); err != nil {
+			return nil, err
+		}
+		payload, err := protocol.EncodeResponse(&protocol.Response{ID: "req", Timestamp: time.Now().Unix()})
+		if err != nil {
+			return nil, err
+		}
+		return protocol.NewResponse(msg.RequestID, payload), nil
+	})
+	server := newTestGateway(t, network)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(server.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"echo","stream":true,"messages":[{"role":"user","content":"hello"}]}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// The provider holds back the rest of the completion until the first
+	// chunk has reached the HTTP client.
+	body := bufio.NewReader(resp.Body)
+	var first openai.ChatCompletionResponse
+	require.NoError(t, json.Unmarshal([]byte(nextEvent(t, body)), &first))
+	assert.Equal(t, "hel", first.Choices[0].Delta.Content)
+
+	finish()
+	var second openai.ChatCompletionResponse
+	require.NoError(t, json.Unmarshal([]byte(nextEvent(t, body)), &second))
+	assert.Equal(t, "lo", second.Choices[0].Delta.Content)
+	assert.Equal(t, "[DONE]", nextEvent(t, body))
+}
+
+func TestGatewayRelaysProviderStream(t *testing.T) {
+	release := make(chan struct{})
+	var once sync.Once
+	finish := func() { once.Do(func() { close(release) }) }
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"object":"chat.completion.chunk","model":"upstream","choices":[{"index":0,"delta":{"role":"assistant","content":"hel"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+
+		<-release
+		fmt.Fprint(w, `data: {"object":"chat.completion.chunk","model":"upstream","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+	defer finish()
+
+	registry, err := backend.NewRegistry([]backend.Config{{Model: "echo", Type: backend.TypeOpenAI, URL: upstream.URL}}, 0)
+	require.NoError(t, err)
+	server := newTestGateway(t, newProviderNetwork(t, registry.HandleRequest))
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(server.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"echo","stream":true,"messages":[{"role":"user","content":"hello"}]}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The upstream holds back the rest of the completion until the first
+	// chunk has reached the HTTP client.
+	body := bufio.NewReader(resp.Body)
+	var first openai.ChatCompletionResponse
+	require.NoError(t, json.Unmarshal([]byte(nextEvent(t, body)), &first))
+	assert.Equal(t, "echo", first.Model)
+	assert.Equal(t, "hel", first.Choices[0].Delta.Content)
+
+	finish()
+	var second openai.ChatCompletionResponse
+	require.NoError(t, json.Unmarshal([]byte(nextEvent(t, body)), &second))
+	assert.Equal(t, "lo", second.Choices[0].Delta.Content)
+	assert.Equal(t, "[DONE]", nextEvent(t, body))
+}
+
+func TestGatewayCompletion(t *testing.T) {
+	server := newTestGateway(t, &fakeNetwork{provider: "provider-a"})
+
+	resp, err := http.Post(server.URL+"/v1/completions", "application/json",
+		strings.NewReader(`{"model":"echo","prompt":"once upon a time"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var completion openai.CompletionResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&completion))
+	require.Len(t, completion.Choices, 1)
+	assert.Equal(t, "once upon a time", completion.Choices[0].Text)
+}
+
+func TestGatewayErrors(t *testing.T) {
+	server := newTestGateway(t, &fakeNetwork{provider: "provider-a"})
+
+	resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"missing","messages":[{"role":"user","content":"hi"}]}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	busy := newTestGateway(t, &fakeNetwork{
+		provider: "provider-a",
+		err:      &protocol.Error{Code: protocol.ErrCodeBusy, Message: "queue full"},
+	})
+	resp, err = http.Post(busy.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"echo","messages":[{"role":"user","content":"hi"}]}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	var body openai.ErrorResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "rate_limit_error", body.Error.Type)
+}
@@ -1,10 +1,29 @@
 package protocol
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	coreprotocol "github.com/libp2p/go-libp2p-core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/your-org/p2p-network/pkg/utils"
+	"github.com/your-org/p2p-network/pkg/wire"
 )
 
 func TestMessageTypes(t *testing.T) {
@@ -58,6 +77,19 @@ func TestMessageEncodeDecode(t *testing.T) {
 	assert.Equal(t, original.Payload, decoded.Payload)
 }
 
+func TestMessageEncodeDecodeFlags(t *testing.T) {
+	original := NewRequest("test-id", []byte("test payload"))
+	original.Flags = FlagCompressedZstd
+
+	encoded, err := original.Encode()
+	require.NoError(t, err)
+
+	decoded, err := DecodeMessage(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, FlagCompressedZstd, decoded.Flags)
+	assert.Equal(t, original.Timestamp, decoded.Timestamp)
+}
+
 func TestMessageEncodeTooShort(t *testing.T) {
 	_, err := DecodeMessage([]byte{})
 	assert.Error(t, err)
@@ -66,3 +98,1360 @@ func TestMessageEncodeTooShort(t *testing.T) {
 func TestProtocolID(t *testing.T) {
 	assert.Equal(t, ProtocolIDStr, ProtocolID)
 }
+
+func TestMessageSignVerify(t *testing.T) {
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	msg := NewRequest("test-id", []byte("test payload"))
+	require.NoError(t, msg.Sign(priv))
+	assert.NotEmpty(t, msg.Signature)
+	assert.NoError(t, msg.Verify(pub))
+
+	msg.Payload = []byte("tampered payload")
+	assert.ErrorIs(t, msg.Verify(pub), ErrInvalidSignature)
+
+	msg.Signature = nil
+	assert.ErrorIs(t, msg.Verify(pub), ErrMissingSignature)
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	now := time.Now()
+
+	assert.NoError(t, CheckTimestamp(now.Unix(), now, 30*time.Second))
+	assert.ErrorIs(t, CheckTimestamp(now.Add(-time.Minute).Unix(), now, 30*time.Second), ErrStaleMessage)
+	assert.ErrorIs(t, CheckTimestamp(now.Add(time.Minute).Unix(), now, 30*time.Second), ErrStaleMessage)
+}
+
+func TestReplayCache(t *testing.T) {
+	cache := NewReplayCache(time.Minute)
+	p := peer.ID("peer-a")
+	msg := NewRequest("test-id", nil)
+	now := time.Now()
+
+	assert.True(t, cache.Check(p, msg, now))
+	assert.False(t, cache.Check(p, msg, now.Add(time.Second)))
+	assert.True(t, cache.Check(peer.ID("peer-b"), msg, now))
+	assert.True(t, cache.Check(p, NewResponse("test-id", nil), now))
+	assert.True(t, cache.Check(p, msg, now.Add(2*time.Minute)))
+}
+
+func TestNegotiateVersionPrefersHighest(t *testing.T) {
+	version, err := NegotiateVersion([]string{"1.0.0", "1.1.0", "2.0.0"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.1.0", version)
+
+	_, err = NegotiateVersion([]string{"0.9.0", "2.0.0"})
+	assert.Error(t, err)
+}
+
+func TestSupportedProtocolIDs(t *testing.T) {
+	ids := SupportedProtocolIDs()
+
+	require.Len(t, ids, len(SupportedVersions))
+	assert.Equal(t, "/llm-share/1.2.0", ids[0])
+	assert.Equal(t, "/llm-share/1.0.0", ids[len(ids)-1])
+}
+
+func TestVersionContext(t *testing.T) {
+	assert.Equal(t, "", VersionFromContext(context.Background()))
+
+	ctx := ContextWithVersion(context.Background(), "1.1.0")
+	assert.Equal(t, "1.1.0", VersionFromContext(ctx))
+}
+
+func TestNewStreamHandshakesWithPeerThatDialledFirst(t *testing.T) {
+	handlers := newTestHandlers(t, 2)
+	a, b := handlers[0], handlers[1]
+	ctx := context.Background()
+
+	// b reaches a without a handshake, as a peer that already knows our
+	// version would.
+	stream, err := b.host.NewStream(ctx, a.host.ID(), coreprotocol.ID(ProtocolIDForVersion(CurrentVersion)))
+	require.NoError(t, err)
+	resp, err := b.roundTrip(ctx, stream, a.host.ID(), &Message{Type: MsgTypePing, RequestID: "ping-1"})
+	require.NoError(t, err)
+	assert.Equal(t, MsgTypePong, resp.Type)
+	stream.Close()
+
+	_, known := a.PeerVersion(b.host.ID())
+	require.True(t, known)
+	assert.False(t, a.versions.Negotiated(b.host.ID()))
+	assert.Equal(t, CompressionNone, a.versions.Compression(b.host.ID()))
+
+	stream, err = a.NewStream(ctx, b.host.ID())
+	require.NoError(t, err)
+	stream.Close()
+
+	assert.True(t, a.versions.Negotiated(b.host.ID()))
+	assert.Equal(t, CompressionZstd, a.versions.Compression(b.host.ID()))
+}
+
+func TestFramesRoundTrip(t *testing.T) {
+	msg := &Message{Type: MsgTypeRequest, Flags: FlagEncrypted, RequestID: "req-1", Payload: []byte("hello"), Signature: []byte("sig"), Timestamp: 1700000000}
+
+	for _, version := range []string{"1.1.0", FramingVersion} {
+		var buf bytes.Buffer
+		decoder, encoder := newFrames(&buf, version)
+		require.NoError(t, encoder.Encode(msg))
+		require.NoError(t, encoder.Encode(msg))
+		assert.Equal(t, CompareVersions(version, FramingVersion) < 0, wire.IsJSON(buf.Bytes()), version)
+
+		for i := 0; i < 2; i++ {
+			var got Message
+			require.NoError(t, decoder.Decode(&got), version)
+			assert.Equal(t, *msg, got, version)
+		}
+		var got Message
+		assert.ErrorIs(t, decoder.Decode(&got), io.EOF, version)
+	}
+}
+
+func TestReadFrameRejectsOversizedFrames(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, wire.WriteFrame(&buf, (&Message{Payload: make([]byte, 64)}).ToWire()))
+
+	var env wire.Envelope
+	assert.ErrorIs(t, wire.ReadFrame(bufio.NewReader(&buf), &env, 32), wire.ErrFrameTooLarge)
+	assert.ErrorIs(t, wire.ReadFrame(bufio.NewReader(bytes.NewReader([]byte{10, 1})), &env, 0), io.ErrUnexpectedEOF)
+}
+
+func TestLegacyVersionStreamUsesJSONFrames(t *testing.T) {
+	handlers := newTestHandlers(t, 2)
+	a, b := handlers[0], handlers[1]
+	ctx := context.Background()
+
+	stream, err := a.host.NewStream(ctx, b.host.ID(), coreprotocol.ID(ProtocolIDForVersion("1.1.0")))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	resp, err := a.roundTrip(ctx, stream, b.host.ID(), &Message{Type: MsgTypePing, RequestID: "ping-1"})
+	require.NoError(t, err)
+	assert.Equal(t, MsgTypePong, resp.Type)
+}
+
+func TestTransferManifestChunks(t *testing.T) {
+	payload := make([]byte, 2500)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	msg := NewRequest("test-id", payload)
+	manifest := NewTransferManifest("transfer-1", msg, 1000)
+
+	assert.Equal(t, 3, manifest.ChunkCount)
+	assert.Equal(t, int64(2500), manifest.TotalSize)
+	assert.Equal(t, MsgTypeRequest, manifest.Type)
+	assert.Equal(t, "test-id", manifest.RequestID)
+
+	var reassembled []byte
+	for i := 0; i < manifest.ChunkCount; i++ {
+		chunk := manifest.Chunk(payload, i)
+		assert.Equal(t, i, chunk.Index)
+		assert.True(t, utils.VerifyHash(chunk.Data, chunk.Hash))
+		reassembled = append(reassembled, chunk.Data...)
+	}
+
+	assert.Len(t, manifest.Chunk(payload, 2).Data, 500)
+	assert.Equal(t, payload, reassembled)
+	assert.True(t, utils.VerifyHash(reassembled, manifest.Hash))
+}
+
+type recordingEncoder struct {
+	msgs []*Message
+}
+
+func (e *recordingEncoder) Encode(msg *Message) error {
+	e.msgs = append(e.msgs, msg)
+	return nil
+}
+
+func (e *recordingEncoder) acks(t *testing.T) []*TransferAck {
+	t.Helper()
+
+	acks := make([]*TransferAck, 0, len(e.msgs))
+	for _, msg := range e.msgs {
+		require.Equal(t, MsgTypeTransferAck, msg.Type)
+		ack, err := DecodeTransferAck(msg.Payload)
+		require.NoError(t, err)
+		acks = append(acks, ack)
+	}
+	return acks
+}
+
+// chunkSource yields the chunk frames at indexes and then fails as a reset
+// stream would.
+func chunkSource(t *testing.T, manifest *TransferManifest, payload []byte, indexes ...int) frameSource {
+	t.Helper()
+
+	var frames []*Message
+	for _, i := range indexes {
+		data, err := EncodeChunk(manifest.Chunk(payload, i))
+		require.NoError(t, err)
+		frames = append(frames, &Message{Type: MsgTypeChunk, Payload: data})
+	}
+	return func() (*Message, error) {
+		if len(frames) == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		msg := frames[0]
+		frames = frames[1:]
+		return msg, nil
+	}
+}
+
+func transferStart(t *testing.T, manifest *TransferManifest) *Message {
+	t.Helper()
+
+	data, err := EncodeTransferManifest(manifest)
+	require.NoError(t, err)
+	return &Message{Type: MsgTypeTransferStart, Payload: data}
+}
+
+func TestReceiveTransfer(t *testing.T) {
+	h := NewHandler(nil)
+	payload := bytes.Repeat([]byte("0123456789"), 250)
+	manifest := NewTransferManifest("t-1", NewRequest("req-1", payload), 1000)
+
+	enc := &recordingEncoder{}
+	msg, err := h.receiveTransfer("peer-a", transferStart(t, manifest), chunkSource(t, manifest, payload, 0, 1, 2), enc)
+	require.NoError(t, err)
+	assert.Equal(t, MsgTypeRequest, msg.Type)
+	assert.Equal(t, "req-1", msg.RequestID)
+	assert.Equal(t, payload, msg.Payload)
+
+	acks := enc.acks(t)
+	require.Len(t, acks, 4)
+	assert.Equal(t, 0, acks[0].NextChunk)
+	assert.True(t, acks[3].Complete)
+}
+
+func TestReceiveTransferResumesAfterReset(t *testing.T) {
+	h := NewHandler(nil)
+	payload := bytes.Repeat([]byte("0123456789"), 250)
+	manifest := NewTransferManifest("t-1", NewRequest("req-1", payload), 1000)
+
+	_, err := h.receiveTransfer("peer-a", transferStart(t, manifest), chunkSource(t, manifest, payload, 0, 1), &recordingEncoder{})
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	enc := &recordingEncoder{}
+	msg, err := h.receiveTransfer("peer-a", transferStart(t, manifest), chunkSource(t, manifest, payload, 2), enc)
+	require.NoError(t, err)
+	assert.Equal(t, payload, msg.Payload)
+
+	acks := enc.acks(t)
+	require.Len(t, acks, 2)
+	assert.Equal(t, 2, acks[0].NextChunk, "resumes after the chunks already received")
+	assert.True(t, acks[1].Complete)
+}
+
+func TestReceiveTransferRejectsCorruptChunk(t *testing.T) {
+	h := NewHandler(nil)
+	payload := bytes.Repeat([]byte("0123456789"), 250)
+	manifest := NewTransferManifest("t-1", NewRequest("req-1", payload), 1000)
+
+	chunk := manifest.Chunk(payload, 0)
+	chunk.Data = bytes.Repeat([]byte("x"), len(chunk.Data))
+	data, err := EncodeChunk(chunk)
+	require.NoError(t, err)
+	corrupt := func() (*Message, error) {
+		return &Message{Type: MsgTypeChunk, Payload: data}, nil
+	}
+
+	enc := &recordingEncoder{}
+	_, err = h.receiveTransfer("peer-a", transferStart(t, manifest), corrupt, enc)
+	require.ErrorIs(t, err, ErrChunkHashMismatch)
+
+	acks := enc.acks(t)
+	require.Len(t, acks, 2)
+	assert.NotEmpty(t, acks[1].Error)
+
+	enc = &recordingEncoder{}
+	_, err = h.receiveTransfer("peer-a", transferStart(t, manifest), chunkSource(t, manifest, payload), enc)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, 0, enc.acks(t)[0].NextChunk, "the corrupt transfer is discarded")
+}
+
+func TestTransferTableLimits(t *testing.T) {
+	cfg := DefaultTransferConfig()
+	cfg.MaxPartialPerPeer = 2
+	cfg.MaxPartial = 3
+	cfg.MaxPartialBytes = 5000
+	table := newTransferTable(cfg)
+
+	manifest := func(id string, size int) *TransferManifest {
+		return NewTransferManifest(id, NewRequest(id, make([]byte, size)), 1000)
+	}
+
+	_, err := table.begin("peer-a", manifest("t-1", 1000), 0)
+	require.NoError(t, err)
+	_, err = table.begin("peer-a", manifest("t-2", 1000), 0)
+	require.NoError(t, err)
+	_, err = table.begin("peer-a", manifest("t-3", 1000), 0)
+	assert.ErrorIs(t, err, ErrTooManyTransfers)
+
+	_, err = table.begin("peer-a", manifest("t-1", 1000), 0)
+	assert.NoError(t, err, "resuming does not count against the limits")
+
+	_, err = table.begin("peer-b", manifest("t-4", 4000), 0)
+	assert.ErrorIs(t, err, ErrTransferBufferFull)
+	_, err = table.begin("peer-b", manifest("t-4", 1000), 0)
+	require.NoError(t, err)
+	_, err = table.begin("peer-c", manifest("t-5", 1000), 0)
+	assert.ErrorIs(t, err, ErrTooManyTransfers)
+
+	table.remove("peer-a", "t-1")
+	_, err = table.begin("peer-a", manifest("t-3", 2000), 0)
+	assert.NoError(t, err)
+}
+
+func TestSendLargeOverStream(t *testing.T) {
+	cfg := DefaultTransferConfig()
+	cfg.ChunkSize = 512
+	cfg.ChunkThreshold = 1024
+	// Mock streams are unbuffered, so the sender must wait for each ack.
+	cfg.Window = 1
+	handlers := newTestHandlers(t, 2, WithTransferConfig(cfg))
+	client, server := handlers[0], handlers[1]
+
+	server.RegisterHandler(MsgTypeRequest, func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		return NewResponse(msg.RequestID, bytes.ToUpper(msg.Payload)), nil
+	})
+
+	payload := bytes.Repeat([]byte("abcdefgh"), 1000)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.SendRequest(ctx, server.host.ID(), NewRequest("req-1", payload))
+	require.NoError(t, err)
+	assert.Equal(t, bytes.ToUpper(payload), resp.Payload)
+}
+
+func TestCompressDecompress(t *testing.T) {
+	payload := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 100))
+
+	for _, algorithm := range SupportedCompression {
+		compressed, flag, err := Compress(algorithm, payload)
+		require.NoError(t, err)
+		assert.Less(t, len(compressed), len(payload))
+
+		decompressed, err := Decompress(flag, compressed, int64(len(payload)))
+		require.NoError(t, err)
+		assert.Equal(t, payload, decompressed)
+
+		_, err = Decompress(flag, compressed, int64(len(payload)-1))
+		assert.ErrorIs(t, err, ErrDecompressedTooLarge)
+	}
+
+	_, _, err := Compress("lz4", payload)
+	assert.Error(t, err)
+}
+
+func TestCompressMessageSkipsEncryptedPayloads(t *testing.T) {
+	h := NewHandler(nil)
+	p := peer.ID("peer")
+	h.versions.SetCompression(p, CompressionZstd)
+	payload := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 100))
+
+	plain := &Message{Type: MsgTypeResponse, Payload: payload}
+	require.NoError(t, h.compressMessage(p, plain))
+	assert.Equal(t, FlagCompressedZstd, plain.Flags)
+
+	sealed := &Message{Type: MsgTypeResponse, Flags: FlagEncrypted, Payload: payload}
+	require.NoError(t, h.compressMessage(p, sealed))
+	assert.Equal(t, FlagEncrypted, sealed.Flags)
+	assert.Equal(t, payload, sealed.Payload)
+}
+
+func TestDecompressZstdStreamFrames(t *testing.T) {
+	payload := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 100))
+
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = w.Write(payload)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			decompressed, err := Decompress(FlagCompressedZstd, buf.Bytes(), int64(len(payload)))
+			assert.NoError(t, err)
+			assert.Equal(t, payload, decompressed)
+		}()
+	}
+	wg.Wait()
+
+	_, err = Decompress(FlagCompressedZstd, buf.Bytes(), int64(len(payload)-1))
+	assert.ErrorIs(t, err, ErrDecompressedTooLarge)
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	cfg := DefaultCompressionConfig()
+
+	assert.Equal(t, CompressionGzip, cfg.NegotiateCompression([]string{"lz4", CompressionGzip, CompressionZstd}))
+	assert.Equal(t, CompressionNone, cfg.NegotiateCompression([]string{"lz4"}))
+
+	cfg.Enabled = false
+	assert.Equal(t, CompressionNone, cfg.NegotiateCompression([]string{CompressionZstd}))
+}
+
+func TestLatencyTableTransitions(t *testing.T) {
+	table := NewLatencyTable()
+	p := peer.ID("peer-a")
+	now := time.Now()
+
+	assert.True(t, table.RecordRTT(p, 100*time.Millisecond, now))
+	assert.False(t, table.RecordRTT(p, 200*time.Millisecond, now))
+
+	entry, ok := table.Get(p)
+	require.True(t, ok)
+	assert.True(t, entry.Healthy)
+	assert.Equal(t, 200*time.Millisecond, entry.LastRTT)
+	assert.Equal(t, 120*time.Millisecond, entry.RTT)
+
+	assert.False(t, table.RecordMiss(p, 2))
+	assert.True(t, table.RecordMiss(p, 2))
+	assert.False(t, table.RecordMiss(p, 2))
+
+	entry, _ = table.Get(p)
+	assert.False(t, entry.Healthy)
+
+	assert.True(t, table.RecordRTT(p, 50*time.Millisecond, now))
+	entry, _ = table.Get(p)
+	assert.Equal(t, 0, entry.Missed)
+}
+
+func TestLatencyTableSnapshotOrder(t *testing.T) {
+	table := NewLatencyTable()
+	now := time.Now()
+
+	table.RecordRTT(peer.ID("slow"), 300*time.Millisecond, now)
+	table.RecordRTT(peer.ID("fast"), 10*time.Millisecond, now)
+	table.RecordRTT(peer.ID("down"), time.Millisecond, now)
+	table.RecordMiss(peer.ID("down"), 1)
+
+	snapshot := table.Snapshot()
+	require.Len(t, snapshot, 3)
+	assert.Equal(t, peer.ID("fast"), snapshot[0].Peer)
+	assert.Equal(t, peer.ID("slow"), snapshot[1].Peer)
+	assert.Equal(t, peer.ID("down"), snapshot[2].Peer)
+}
+
+func TestLivenessServiceTracksPeers(t *testing.T) {
+	handlers := newTestHandlers(t, 2)
+	a, b := handlers[0], handlers[1]
+
+	service := NewLivenessService(a, LivenessConfig{Interval: 20 * time.Millisecond, Timeout: 200 * time.Millisecond, MaxMissed: 1})
+	service.Start(context.Background())
+	defer service.Stop()
+
+	select {
+	case event := <-service.Events():
+		assert.Equal(t, b.host.ID(), event.Peer)
+		assert.True(t, event.Healthy)
+		assert.Positive(t, event.RTT)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer never became healthy")
+	}
+
+	latency, ok := a.Latency().Get(b.host.ID())
+	require.True(t, ok)
+	assert.Positive(t, latency.RTT)
+
+	// b stops answering pings.
+	b.RegisterHandler(MsgTypePing, func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		return nil, nil
+	})
+	select {
+	case event := <-service.Events():
+		assert.Equal(t, b.host.ID(), event.Peer)
+		assert.False(t, event.Healthy)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer never became unhealthy")
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.Jitter = 0
+
+	assert.Equal(t, time.Duration(0), policy.Backoff(0))
+	assert.Equal(t, 200*time.Millisecond, policy.Backoff(1))
+	assert.Equal(t, 400*time.Millisecond, policy.Backoff(2))
+	assert.Equal(t, 5*time.Second, policy.Backoff(10))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(1)
+		assert.GreaterOrEqual(t, backoff, 100*time.Millisecond)
+		assert.LessOrEqual(t, backoff, 300*time.Millisecond)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.False(t, IsRetryable(nil))
+	assert.False(t, IsRetryable(context.Canceled))
+	assert.True(t, IsRetryable(context.DeadlineExceeded))
+	assert.True(t, IsRetryable(&Error{Code: ErrCodeBusy}))
+	assert.True(t, IsRetryable(&Error{Code: ErrCodeUnavailable}))
+	assert.False(t, IsRetryable(&Error{Code: ErrCodeInvalidRequest}))
+	assert.False(t, IsRetryable(&TransferError{TransferID: "t", Reason: "too large"}))
+}
+
+func TestCircuitBreakers(t *testing.T) {
+	breakers := NewCircuitBreakers(BreakerConfig{FailureThreshold: 2, Cooldown: 50 * time.Millisecond})
+	p := peer.ID("provider")
+
+	assert.True(t, breakers.Allow(p))
+	breakers.Failure(p)
+	assert.Equal(t, BreakerClosed, breakers.State(p))
+	breakers.Failure(p)
+	assert.Equal(t, BreakerOpen, breakers.State(p))
+	assert.False(t, breakers.Allow(p))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, breakers.Allow(p))
+	assert.Equal(t, BreakerHalfOpen, breakers.State(p))
+	assert.False(t, breakers.Allow(p))
+
+	breakers.Failure(p)
+	assert.Equal(t, BreakerOpen, breakers.State(p))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, breakers.Allow(p))
+	breakers.Success(p)
+	assert.Equal(t, BreakerClosed, breakers.State(p))
+}
+
+func TestClientRequiresIdempotencyKey(t *testing.T) {
+	client := NewClient(NewHandler(nil), DefaultRetryPolicy(), NewCircuitBreakers(DefaultBreakerConfig()))
+
+	_, _, err := client.Do(context.Background(), []peer.ID{"provider"}, &Request{Method: "generate"})
+	assert.ErrorIs(t, err, ErrNotIdempotent)
+
+	_, _, err = client.Do(context.Background(), nil, &Request{ID: "req-1"})
+	assert.ErrorIs(t, err, ErrNoProviders)
+}
+
+func TestIdempotentRetryWaitsForFirstAttempt(t *testing.T) {
+	h := NewHandler(nil)
+
+	var mu sync.Mutex
+	calls := 0
+	release := make(chan struct{})
+	h.RegisterHandler(MsgTypeRequest, func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+
+		payload, err := EncodeResponse(&Response{ID: "req-1", Result: []byte(`"done"`)})
+		if err != nil {
+			return nil, err
+		}
+		return NewResponse(msg.RequestID, payload), nil
+	})
+	handler := h.handlers[MsgTypeRequest]
+
+	payload, err := EncodeRequest(&Request{ID: "req-1", Method: "generate"})
+	require.NoError(t, err)
+
+	results := make(chan *Message, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			resp, err := handler(context.Background(), "requester", NewRequest("attempt", payload))
+			assert.NoError(t, err)
+			results <- resp
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 3; i++ {
+		resp := <-results
+		decoded, err := DecodeResponse(resp.Payload)
+		require.NoError(t, err)
+		assert.JSONEq(t, `"done"`, string(decoded.Result))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, calls)
+}
+
+func TestIdempotentRetryRunsAgainAfterRetryableError(t *testing.T) {
+	h := NewHandler(nil)
+
+	calls := 0
+	h.RegisterHandler(MsgTypeRequest, func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		calls++
+		resp := &Response{ID: "req-1"}
+		if calls == 1 {
+			resp = NewErrorResponse("req-1", ErrCodeUnavailable, "down")
+		}
+		payload, err := EncodeResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+		return NewResponse(msg.RequestID, payload), nil
+	})
+	handler := h.handlers[MsgTypeRequest]
+
+	payload, err := EncodeRequest(&Request{ID: "req-1", Method: "generate"})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := handler(context.Background(), "requester", NewRequest("attempt", payload))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, calls, "only the successful response is replayed")
+}
+
+// newTestHandlers returns n handlers on connected mock hosts.
+func newTestHandlers(t *testing.T, n int, opts ...HandlerOption) []*Handler {
+	t.Helper()
+
+	mn, err := mocknet.FullMeshConnected(n)
+	require.NoError(t, err)
+	t.Cleanup(func() { mn.Close() })
+
+	// A secure transport stores the remote key on connect. Mock connections
+	// don't, and mock ECDSA keys can't be recovered from peer IDs, so share
+	// them up front rather than wait for identify.
+	for _, host := range mn.Hosts() {
+		for _, other := range mn.Hosts() {
+			require.NoError(t, host.Peerstore().AddPubKey(other.ID(), other.Peerstore().PubKey(other.ID())))
+		}
+	}
+
+	handlers := make([]*Handler, 0, n)
+	for _, host := range mn.Hosts() {
+		h := NewHandler(nil, opts...)
+		h.SetHost(host)
+		h.Register()
+		handlers = append(handlers, h)
+	}
+	return handlers
+}
+
+// replyWith makes h answer requests with the error code returned by code, or
+// with a result when it returns 0.
+func replyWith(h *Handler, code func() int) {
+	h.RegisterHandler(MsgTypeRequest, func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		req, err := DecodeRequest(msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := &Response{ID: req.ID}
+		if c := code(); c != 0 {
+			resp = NewErrorResponse(req.ID, c, "failed")
+		}
+		payload, err := EncodeResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+		return NewResponse(msg.RequestID, payload), nil
+	})
+}
+
+func TestClientBreakerRecoversThroughHalfOpen(t *testing.T) {
+	handlers := newTestHandlers(t, 3)
+	client, flaky, stable := handlers[0], handlers[1], handlers[2]
+
+	var mu sync.Mutex
+	code := ErrCodeUnavailable
+	replyWith(flaky, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return code
+	})
+	replyWith(stable, func() int { return 0 })
+
+	c := NewClient(client, RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, Multiplier: 1},
+		NewCircuitBreakers(BreakerConfig{FailureThreshold: 1, Cooldown: 50 * time.Millisecond}))
+	providers := []peer.ID{flaky.host.ID(), stable.host.ID()}
+	ctx := context.Background()
+
+	_, p, err := c.Do(ctx, providers, &Request{ID: "req-1", Method: "generate"})
+	require.NoError(t, err)
+	assert.Equal(t, stable.host.ID(), p)
+	assert.Equal(t, BreakerOpen, c.Breakers().State(flaky.host.ID()))
+
+	_, p, err = c.Do(ctx, providers, &Request{ID: "req-2", Method: "generate"})
+	require.NoError(t, err)
+	assert.Equal(t, stable.host.ID(), p)
+
+	// The half-open probe gets a client error: the provider answered, so
+	// its breaker closes.
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	code = ErrCodeInvalidRequest
+	mu.Unlock()
+
+	_, p, err = c.Do(ctx, providers, &Request{ID: "req-3", Method: "generate"})
+	var protoErr *Error
+	require.ErrorAs(t, err, &protoErr)
+	assert.Equal(t, ErrCodeInvalidRequest, protoErr.Code)
+	assert.Equal(t, flaky.host.ID(), p)
+	assert.Equal(t, BreakerClosed, c.Breakers().State(flaky.host.ID()))
+}
+
+func TestClientBusyProbeClosesBreaker(t *testing.T) {
+	handlers := newTestHandlers(t, 3)
+	client, busy, stable := handlers[0], handlers[1], handlers[2]
+
+	var mu sync.Mutex
+	code := ErrCodeUnavailable
+	replyWith(busy, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return code
+	})
+	replyWith(stable, func() int { return 0 })
+
+	c := NewClient(client, RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, Multiplier: 1},
+		NewCircuitBreakers(BreakerConfig{FailureThreshold: 1, Cooldown: 50 * time.Millisecond}))
+	providers := []peer.ID{busy.host.ID(), stable.host.ID()}
+	ctx := context.Background()
+
+	_, _, err := c.Do(ctx, providers, &Request{ID: "req-1", Method: "generate"})
+	require.NoError(t, err)
+	assert.Equal(t, BreakerOpen, c.Breakers().State(busy.host.ID()))
+
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	code = ErrCodeBusy
+	mu.Unlock()
+
+	_, p, err := c.Do(ctx, providers, &Request{ID: "req-2", Method: "generate"})
+	require.NoError(t, err)
+	assert.Equal(t, stable.host.ID(), p)
+	assert.Equal(t, BreakerClosed, c.Breakers().State(busy.host.ID()))
+}
+
+func TestFanOutBoundedParallelism(t *testing.T) {
+	h := NewHandler(nil)
+	peers := []peer.ID{"a", "b", "c", "d", "e", "f"}
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	send := func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		if p == "c" {
+			return nil, errors.New("unreachable")
+		}
+		return NewResponse(msg.RequestID, nil), nil
+	}
+
+	results := h.fanOut(context.Background(), peers, NewRequest("req", nil), FanOutOptions{Parallelism: 2}, send, 0)
+
+	require.Len(t, results, len(peers))
+	assert.LessOrEqual(t, maxInFlight, 2)
+	assert.False(t, results["c"].OK())
+	assert.True(t, results["a"].OK())
+	assert.Greater(t, results["a"].Latency, time.Duration(0))
+}
+
+func TestFanOutPeerTimeout(t *testing.T) {
+	h := NewHandler(nil)
+	send := func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		if p == "slow" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return NewResponse(msg.RequestID, nil), nil
+	}
+
+	opts := FanOutOptions{Parallelism: 4, PeerTimeout: 20 * time.Millisecond}
+	results := h.fanOut(context.Background(), []peer.ID{"fast", "slow"}, NewRequest("req", nil), opts, send, 0)
+
+	assert.True(t, results["fast"].OK())
+	assert.ErrorIs(t, results["slow"].Err, context.DeadlineExceeded)
+}
+
+func TestFanOutQuorumStopsEarly(t *testing.T) {
+	h := NewHandler(nil)
+	peers := []peer.ID{"a", "b", "c", "d"}
+	send := func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		if p == "a" || p == "b" {
+			return NewResponse(msg.RequestID, nil), nil
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	results := h.fanOut(context.Background(), peers, NewRequest("req", nil), FanOutOptions{Parallelism: 4}, send, 2)
+
+	succeeded := 0
+	for _, r := range results {
+		if r.OK() {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 2, succeeded)
+}
+
+func TestRequestCodecRoundTrip(t *testing.T) {
+	req := &Request{
+		Method:    "generate",
+		Model:     "llama-3-8b",
+		Params:    []byte(`{"prompt":"hello"}`),
+		ID:        "req-1",
+		Timestamp: 1700000000,
+		Priority:  PriorityHigh,
+	}
+
+	data, err := EncodeRequest(req)
+	require.NoError(t, err)
+	assert.NotEqual(t, byte('{'), data[0])
+
+	decoded, err := DecodeRequest(data)
+	require.NoError(t, err)
+	assert.Equal(t, req, decoded)
+}
+
+func TestResponseCodecRoundTrip(t *testing.T) {
+	resp := &Response{
+		ID:        "req-1",
+		Error:     &Error{Code: ErrCodeBusy, Message: "queue full"},
+		Timestamp: 1700000000,
+	}
+
+	data, err := EncodeResponse(resp)
+	require.NoError(t, err)
+
+	decoded, err := DecodeResponse(data)
+	require.NoError(t, err)
+	assert.Equal(t, resp.ID, decoded.ID)
+	assert.Equal(t, resp.Error, decoded.Error)
+	assert.Equal(t, resp.Timestamp, decoded.Timestamp)
+}
+
+func TestProviderInfoCodecRoundTrip(t *testing.T) {
+	info := &ProviderInfo{
+		PeerID:    "peer-a",
+		Model:     "llama-3-8b",
+		Address:   "/ip4/127.0.0.1/tcp/4001",
+		Protocols: []string{"/llm-share/1.1.0"},
+		Metadata:  map[string]interface{}{"gpu": "a100", "vram_gb": 80.0},
+		LastSeen:  1700000000,
+		Capacity:  8,
+		Load:      3,
+		Price:     0.002,
+	}
+
+	data, err := EncodeProviderInfo(info)
+	require.NoError(t, err)
+
+	decoded, err := DecodeProviderInfo(data)
+	require.NoError(t, err)
+	assert.Equal(t, info, decoded)
+}
+
+// Payloads below were produced by the JSON encoding used before the
+// protobuf schema (schema version 0).
+func TestDecodeLegacyJSONPayloads(t *testing.T) {
+	req, err := DecodeRequest([]byte(`{"method":"generate","model":"llama-3-8b","params":{"prompt":"hello"},"id":"req-1","timestamp":1700000000}`))
+	require.NoError(t, err)
+	assert.Equal(t, "generate", req.Method)
+	assert.Equal(t, "req-1", req.ID)
+	assert.JSONEq(t, `{"prompt":"hello"}`, string(req.Params))
+
+	resp, err := DecodeResponse([]byte(`{"id":"req-1","error":{"code":503,"message":"unavailable"},"timestamp":1700000000}`))
+	require.NoError(t, err)
+	assert.Equal(t, ErrCodeUnavailable, resp.Error.Code)
+
+	hb, err := DecodeHeartbeat([]byte(`{"peer_id":"peer-a","timestamp":1700000000,"address":"/ip4/127.0.0.1/tcp/4001"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "peer-a", hb.PeerID)
+
+	info, err := DecodeProviderInfo([]byte(`{"peer_id":"peer-a","model":"llama-3-8b","address":"","protocols":["/llm-share/1.0.0"],"last_seen":1700000000}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/llm-share/1.0.0"}, info.Protocols)
+
+	vr, err := DecodeVersionRequest([]byte(`{"protocols":["1.0.0","1.1.0"]}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.0.0", "1.1.0"}, vr.Protocols)
+}
+
+func TestHandlerLimiterPerPeer(t *testing.T) {
+	limiter := newHandlerLimiter(StreamConfig{MaxInFlightPerPeer: 2, MaxConcurrentHandlers: 10})
+	a, b := peer.ID("peer-a"), peer.ID("peer-b")
+
+	assert.True(t, limiter.acquirePeer(a))
+	assert.True(t, limiter.acquirePeer(a))
+	assert.False(t, limiter.acquirePeer(a))
+	assert.True(t, limiter.acquirePeer(b))
+
+	limiter.releasePeer(a)
+	assert.True(t, limiter.acquirePeer(a))
+}
+
+func TestHandlerLimiterGlobalCap(t *testing.T) {
+	limiter := newHandlerLimiter(StreamConfig{MaxConcurrentHandlers: 1})
+	ctx := context.Background()
+
+	require.NoError(t, limiter.acquire(ctx, 10*time.Millisecond))
+	assert.ErrorIs(t, limiter.acquire(ctx, 10*time.Millisecond), ErrHandlerBusy)
+
+	released := make(chan error, 1)
+	go func() {
+		released <- limiter.acquire(ctx, time.Second)
+	}()
+	limiter.release()
+	assert.NoError(t, <-released)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, limiter.acquire(cancelled, time.Second), context.Canceled)
+}
+
+func TestStreamChunksPrecedeResponse(t *testing.T) {
+	handlers := newTestHandlers(t, 2)
+	client, server := handlers[0], handlers[1]
+
+	server.RegisterHandler(MsgTypeRequest, func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		if !CanStream(ctx) {
+			return nil, ErrStreamingUnavailable
+		}
+		for _, chunk := range []string{"a", "b", "c"} {
+			if err := SendStreamChunk(ctx, []byte(chunk)); err != nil {
+				return nil, err
+			}
+		}
+		return NewResponse(msg.RequestID, []byte("done")), nil
+	})
+
+	var chunks []string
+	ctx := ContextWithStreamObserver(context.Background(), func(data []byte) {
+		chunks = append(chunks, string(data))
+	})
+	resp, err := client.SendRequest(ctx, server.host.ID(), NewRequest("req-1", []byte("work")))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"a", "b", "c"}, chunks)
+	assert.Equal(t, []byte("done"), resp.Payload)
+}
+
+func TestStreamChunksPrecedeSealedResponse(t *testing.T) {
+	handlers := newTestHandlers(t, 2, WithEncryptionConfig(EncryptionConfig{Enabled: true, Required: true}))
+	client, server := handlers[0], handlers[1]
+
+	server.RegisterHandler(MsgTypeRequest, func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		for _, chunk := range []string{"a", "b", "c"} {
+			if err := SendStreamChunk(ctx, []byte(chunk)); err != nil {
+				return nil, err
+			}
+		}
+		return NewResponse(msg.RequestID, []byte("done")), nil
+	})
+
+	var chunks []string
+	ctx := ContextWithStreamObserver(context.Background(), func(data []byte) {
+		chunks = append(chunks, string(data))
+	})
+	resp, err := client.SendRequest(ctx, server.host.ID(), NewRequest("req-1", []byte("work")))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"a", "b", "c"}, chunks)
+	assert.Equal(t, []byte("done"), resp.Payload)
+}
+
+func TestClientDoesNotRetryAfterStreaming(t *testing.T) {
+	handlers := newTestHandlers(t, 2)
+	client, server := handlers[0], handlers[1]
+
+	var calls int32
+	server.RegisterHandler(MsgTypeRequest, func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		atomic.AddInt32(&calls, 1)
+		if err := SendStreamChunk(ctx, []byte("partial")); err != nil {
+			return nil, err
+		}
+		payload, err := EncodeResponse(NewErrorResponse("req-1", ErrCodeUnavailable, "backend went away"))
+		if err != nil {
+			return nil, err
+		}
+		return NewResponse(msg.RequestID, payload), nil
+	})
+
+	c := NewClient(client, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 1},
+		NewCircuitBreakers(DefaultBreakerConfig()))
+	var chunks int
+	ctx := ContextWithStreamObserver(context.Background(), func(data []byte) { chunks++ })
+
+	_, _, err := c.Do(ctx, []peer.ID{server.host.ID()}, &Request{ID: "req-1", Method: "generate", Stream: true})
+	var protoErr *Error
+	require.ErrorAs(t, err, &protoErr)
+	assert.Equal(t, ErrCodeUnavailable, protoErr.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, 1, chunks)
+}
+
+func testCandidates(ids ...string) []ProviderCandidate {
+	candidates := make([]ProviderCandidate, len(ids))
+	for i, id := range ids {
+		candidates[i] = ProviderCandidate{Peer: peer.ID(id)}
+	}
+	return candidates
+}
+
+func TestSelectorRoundRobin(t *testing.T) {
+	sel := NewSelector(&RoundRobin{}, nil, 0)
+	candidates := testCandidates("a", "b", "c")
+
+	var firsts []peer.ID
+	for i := 0; i < 4; i++ {
+		order := sel.Order(candidates, "")
+		require.Len(t, order, 3)
+		firsts = append(firsts, order[0])
+	}
+	assert.Equal(t, []peer.ID{"a", "b", "c", "a"}, firsts)
+}
+
+func TestSelectorLeastOutstanding(t *testing.T) {
+	sel := NewSelector(LeastOutstanding{}, nil, 0)
+	sel.begin("a")
+	sel.begin("a")
+	sel.begin("b")
+
+	assert.Equal(t, []peer.ID{"c", "b", "a"}, sel.Order(testCandidates("a", "b", "c"), ""))
+
+	sel.end("a")
+	sel.end("a")
+	assert.Equal(t, 0, sel.Outstanding("a"))
+}
+
+func TestSelectorLowestRTT(t *testing.T) {
+	latency := NewLatencyTable()
+	now := time.Now()
+	latency.RecordRTT("a", 80*time.Millisecond, now)
+	latency.RecordRTT("b", 20*time.Millisecond, now)
+
+	sel := NewSelector(LowestRTT{}, latency, 0)
+	assert.Equal(t, []peer.ID{"b", "a", "c"}, sel.Order(testCandidates("a", "b", "c"), ""))
+}
+
+// countingStats reports each peer's outstanding count and RTT as its
+// position in order and counts the lookups.
+type countingStats struct {
+	order   []peer.ID
+	lookups int
+}
+
+func (s *countingStats) Outstanding(p peer.ID) int {
+	s.lookups++
+	for i, id := range s.order {
+		if id == p {
+			return i
+		}
+	}
+	return len(s.order)
+}
+
+func (s *countingStats) RTT(p peer.ID) (time.Duration, bool) {
+	return time.Duration(s.Outstanding(p)) * time.Millisecond, true
+}
+
+func TestSelectorLooksUpStatsOncePerCandidate(t *testing.T) {
+	candidates := testCandidates("a", "b", "c", "d", "e", "f", "g", "h")
+
+	for _, strategy := range []SelectionStrategy{LeastOutstanding{}, LowestRTT{}} {
+		stats := &countingStats{order: []peer.ID{"h", "g", "f", "e", "d", "c", "b", "a"}}
+
+		ordered := strategy.Order(candidates, stats)
+		require.Len(t, ordered, len(candidates))
+		for i, c := range ordered {
+			assert.Equal(t, stats.order[i], c.Peer, strategy.Name())
+		}
+		assert.Equal(t, len(candidates), stats.lookups, strategy.Name())
+	}
+}
+
+func TestSelectorWeightedCapacity(t *testing.T) {
+	sel := NewSelector(WeightedCapacity{}, nil, 0)
+	candidates := []ProviderCandidate{
+		{Peer: "big", Capacity: 90},
+		{Peer: "small", Capacity: 10},
+	}
+
+	wins := 0
+	for i := 0; i < 1000; i++ {
+		if sel.Order(candidates, "")[0] == "big" {
+			wins++
+		}
+	}
+	assert.Greater(t, wins, 800)
+}
+
+func TestSelectorPowerOfTwo(t *testing.T) {
+	sel := NewSelector(PowerOfTwo{}, nil, 0)
+	sel.begin("busy")
+
+	for i := 0; i < 20; i++ {
+		order := sel.Order(testCandidates("busy", "idle"), "")
+		assert.Equal(t, []peer.ID{"idle", "busy"}, order)
+	}
+}
+
+func TestSelectorStickySession(t *testing.T) {
+	sel := NewSelector(&RoundRobin{}, nil, time.Minute)
+	candidates := testCandidates("a", "b", "c")
+
+	sel.Bind("conv-1", "b")
+	for i := 0; i < 3; i++ {
+		order := sel.Order(candidates, "conv-1")
+		assert.Equal(t, peer.ID("b"), order[0])
+		assert.Len(t, order, 3)
+	}
+
+	order := sel.Order(testCandidates("a", "c"), "conv-1")
+	assert.NotContains(t, order, peer.ID("b"))
+}
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range []string{StrategyRoundRobin, StrategyLeastOutstanding, StrategyLowestRTT, StrategyWeightedCapacity, StrategyPowerOfTwo} {
+		strategy, err := NewStrategy(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, strategy.Name())
+	}
+
+	_, err := NewStrategy("random")
+	assert.Error(t, err)
+}
+
+func TestQueueStatusRoundTrip(t *testing.T) {
+	var sent []QueueStatus
+	ctx := contextWithQueueReporter(context.Background(), func(status QueueStatus) error {
+		sent = append(sent, status)
+		return nil
+	})
+	require.NoError(t, ReportQueueStatus(ctx, QueueStatus{RequestID: "req-1", Position: 2, Depth: 3, EstimatedWait: 1500 * time.Millisecond}))
+	require.Len(t, sent, 1)
+	assert.NoError(t, ReportQueueStatus(context.Background(), sent[0]))
+
+	payload, err := EncodeQueueStatus(&sent[0])
+	require.NoError(t, err)
+
+	var observed []QueueStatus
+	observer := ContextWithQueueObserver(context.Background(), func(status QueueStatus) {
+		observed = append(observed, status)
+	})
+	require.NoError(t, observeQueueStatus(observer, &Message{Type: MsgTypeQueueStatus, Payload: payload}))
+	assert.Equal(t, sent, observed)
+}
+
+func TestQueueStatusFramesPassReplayChecks(t *testing.T) {
+	handlers := newTestHandlers(t, 2)
+	client, server := handlers[0], handlers[1]
+	require.True(t, client.security.SignMessages)
+
+	const requests = 4
+	var arrived int32
+	server.RegisterHandler(MsgTypeRequest, func(ctx context.Context, p peer.ID, msg *Message) (*Message, error) {
+		ahead := int(atomic.AddInt32(&arrived, 1))
+		for position := ahead; position >= 1; position-- {
+			if err := ReportQueueStatus(ctx, QueueStatus{RequestID: msg.RequestID, Position: position, Depth: ahead}); err != nil {
+				return nil, err
+			}
+		}
+		return NewResponse(msg.RequestID, []byte("done")), nil
+	})
+
+	var mu sync.Mutex
+	observed := make(map[string][]int)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			ctx := ContextWithQueueObserver(context.Background(), func(status QueueStatus) {
+				mu.Lock()
+				defer mu.Unlock()
+				observed[status.RequestID] = append(observed[status.RequestID], status.Position)
+			})
+			resp, err := client.SendRequest(ctx, server.host.ID(), NewRequest(id, []byte("work")))
+			if assert.NoError(t, err) {
+				assert.Equal(t, []byte("done"), resp.Payload)
+			}
+		}(fmt.Sprintf("req-%d", i))
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	frames := 0
+	for _, positions := range observed {
+		frames += len(positions)
+		assert.Equal(t, 1, positions[len(positions)-1])
+	}
+	assert.Equal(t, requests*(requests+1)/2, frames)
+}
+
+func TestBusyErrorCarriesRetryAfter(t *testing.T) {
+	resp := &Response{
+		ID:    "req-1",
+		Error: &Error{Code: ErrCodeBusy, Message: "queue full", RetryAfter: 2 * time.Second},
+	}
+
+	data, err := EncodeResponse(resp)
+	require.NoError(t, err)
+	decoded, err := DecodeResponse(data)
+	require.NoError(t, err)
+
+	wait, ok := RetryAfter(decoded.Error)
+	require.True(t, ok)
+	assert.Equal(t, 2*time.Second, wait)
+
+	_, ok = RetryAfter(&Error{Code: ErrCodeUnavailable, RetryAfter: time.Second})
+	assert.False(t, ok)
+}
+
+func TestParsePriority(t *testing.T) {
+	for input, want := range map[string]int{"": PriorityNormal, "low": PriorityLow, "HIGH": PriorityHigh} {
+		got, err := ParsePriority(input)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	_, err := ParsePriority("urgent")
+	assert.Error(t, err)
+}
+
+func TestSealPayloadRoundTrip(t *testing.T) {
+	keyTypes := map[string]int{
+		"ed25519":   crypto.Ed25519,
+		"secp256k1": crypto.Secp256k1,
+		"ecdsa":     crypto.ECDSA,
+	}
+
+	for name, keyType := range keyTypes {
+		t.Run(name, func(t *testing.T) {
+			priv, pub, err := crypto.GenerateKeyPairWithReader(keyType, 256, rand.Reader)
+			require.NoError(t, err)
+
+			aad := []byte("req-1")
+			sealed, replyKey, err := SealPayload(pub, []byte("secret prompt"), aad)
+			require.NoError(t, err)
+			assert.NotContains(t, string(sealed), "secret prompt")
+
+			payload, serverReplyKey, err := OpenPayload(priv, sealed, aad)
+			require.NoError(t, err)
+			assert.Equal(t, "secret prompt", string(payload))
+
+			reply, err := serverReplyKey.Seal([]byte("answer"), aad)
+			require.NoError(t, err)
+			opened, err := replyKey.Open(reply, aad)
+			require.NoError(t, err)
+			assert.Equal(t, "answer", string(opened))
+		})
+	}
+}
+
+func TestOpenPayloadRejectsWrongKey(t *testing.T) {
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	sealed, _, err := SealPayload(pub, []byte("secret prompt"), []byte("req-1"))
+	require.NoError(t, err)
+
+	_, _, err = OpenPayload(other, sealed, []byte("req-1"))
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+}
+
+func TestSealPayloadBindsAAD(t *testing.T) {
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	sealed, _, err := SealPayload(pub, []byte("secret prompt"), []byte("req-1"))
+	require.NoError(t, err)
+
+	_, _, err = OpenPayload(priv, sealed, []byte("req-2"))
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+}
+
+func TestSealPayloadUnsupportedKey(t *testing.T) {
+	_, pub, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+	require.NoError(t, err)
+
+	_, _, err = SealPayload(pub, []byte("prompt"), nil)
+	assert.ErrorIs(t, err, ErrUnsupportedKeyType)
+}
+
+func TestEd25519ToX25519Agreement(t *testing.T) {
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	rawPriv, err := priv.Raw()
+	require.NoError(t, err)
+	rawPub, err := pub.Raw()
+	require.NoError(t, err)
+
+	xPriv, err := utils.Ed25519PrivateKeyToX25519(rawPriv)
+	require.NoError(t, err)
+	xPub, err := utils.Ed25519PublicKeyToX25519(rawPub)
+	require.NoError(t, err)
+
+	assert.Equal(t, xPriv.PublicKey().Bytes(), xPub.Bytes())
+}
+
+func TestTransferManifestKeepsFlags(t *testing.T) {
+	msg := &Message{
+		Type:      MsgTypeRequest,
+		Flags:     FlagEncrypted | FlagCompressedGzip,
+		RequestID: "req-1",
+		Payload:   []byte("sealed"),
+	}
+
+	data, err := EncodeTransferManifest(NewTransferManifest("t-1", msg, 4))
+	require.NoError(t, err)
+	manifest, err := DecodeTransferManifest(data)
+	require.NoError(t, err)
+
+	assert.Equal(t, FlagEncrypted, manifest.Flags)
+}
+
+func TestExpectResponsesRoutesUnpromptedResponses(t *testing.T) {
+	h := NewHandler(nil)
+	from := peer.ID("provider")
+
+	responses, done := h.ExpectResponses("req-1", 1)
+
+	_, err := h.handleResponse(context.Background(), from, &Message{Type: MsgTypeResponse, RequestID: "req-1", Payload: []byte("ok")})
+	require.NoError(t, err)
+	_, err = h.handleResponse(context.Background(), from, &Message{Type: MsgTypeResponse, RequestID: "req-2"})
+	require.NoError(t, err)
+
+	select {
+	case resp := <-responses:
+		assert.Equal(t, from, resp.Peer)
+		assert.Equal(t, []byte("ok"), resp.Message.Payload)
+	default:
+		t.Fatal("response not routed")
+	}
+	assert.Empty(t, responses)
+
+	done()
+	_, err = h.handleResponse(context.Background(), from, &Message{Type: MsgTypeResponse, RequestID: "req-1"})
+	require.NoError(t, err)
+	assert.Empty(t, responses)
+}
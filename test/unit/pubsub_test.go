@@ -0,0 +1,1108 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-pubsub"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/your-org/p2p-network/pkg/protocol"
+	"github.com/your-org/p2p-network/pkg/wire"
+)
+
+func TestProviderMessageCodecRoundTrip(t *testing.T) {
+	msg := &ProviderMessage{
+		Model:     "llama-3-8b",
+		Address:   "/ip4/127.0.0.1/tcp/4001",
+		Port:      4001,
+		Protocols: []string{"/llm-share/1.1.0"},
+		Metadata:  map[string]interface{}{"gpu": "a100"},
+		Capacity:  4,
+		Load:      1,
+		Price:     0.5,
+		TTL:       90 * time.Second,
+		Timestamp: 1700000000,
+	}
+
+	data, err := EncodeProviderMessage(msg)
+	require.NoError(t, err)
+
+	decoded, err := DecodeProviderMessage(data)
+	require.NoError(t, err)
+	assert.Equal(t, TypeProvider, decoded.Type)
+	assert.Equal(t, msg.Model, decoded.Model)
+	assert.Equal(t, msg.Port, decoded.Port)
+	assert.Equal(t, msg.Protocols, decoded.Protocols)
+	assert.Equal(t, msg.Metadata, decoded.Metadata)
+	assert.Equal(t, msg.Capacity, decoded.Capacity)
+	assert.Equal(t, msg.Load, decoded.Load)
+	assert.Equal(t, msg.Price, decoded.Price)
+	assert.Equal(t, msg.TTL, decoded.TTL)
+	assert.Equal(t, msg.Timestamp, decoded.Timestamp)
+}
+
+func TestRequestResponseMessageCodecRoundTrip(t *testing.T) {
+	data, err := EncodeRequestMessage(&RequestMessage{RequestID: "req-1", Model: "llama-3-8b", Payload: []byte("hello")})
+	require.NoError(t, err)
+
+	req, err := DecodeRequestMessage(data)
+	require.NoError(t, err)
+	assert.Equal(t, "req-1", req.RequestID)
+	assert.Equal(t, []byte("hello"), req.Payload)
+
+	data, err = EncodeResponseMessage(&ResponseMessage{RequestID: "req-1", Error: "model not loaded"})
+	require.NoError(t, err)
+
+	resp, err := DecodeResponseMessage(data)
+	require.NoError(t, err)
+	assert.Equal(t, "req-1", resp.RequestID)
+	assert.Equal(t, "model not loaded", resp.Error)
+}
+
+// Payloads below were produced by the JSON encoding used before the
+// protobuf schema (schema version 0).
+func TestDecodeLegacyJSONMessages(t *testing.T) {
+	provider, err := DecodeProviderMessage([]byte(`{"type":"provider","model":"llama-3-8b","address":"10.0.0.1","port":4001,"protocols":["/llm-share/1.0.0"]}`))
+	require.NoError(t, err)
+	assert.Equal(t, "llama-3-8b", provider.Model)
+	assert.Equal(t, 4001, provider.Port)
+
+	req, err := DecodeRequestMessage([]byte(`{"type":"request","request_id":"req-1","model":"llama-3-8b","payload":"aGVsbG8="}`))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), req.Payload)
+
+	resp, err := DecodeResponseMessage([]byte(`{"type":"response","request_id":"req-1","payload":null,"error":"boom"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "boom", resp.Error)
+
+	hb, err := DecodeHeartbeatMessage([]byte(`{"type":"heartbeat","peer_id":"peer-a","timestamp":1700000000}`))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700000000), hb.Timestamp)
+}
+
+func newTestPeerID(t *testing.T) peer.ID {
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	id, err := peer.IDFromPublicKey(pub)
+	require.NoError(t, err)
+	return id
+}
+
+func TestProviderTableUpdateAndExpiry(t *testing.T) {
+	table := NewProviderTable(time.Minute)
+	now := time.Now()
+
+	table.Update("peer-a", &ProviderMessage{Model: "llama-3-8b", Capacity: 4, Load: 1, Price: 0.2}, now)
+	table.Update("peer-b", &ProviderMessage{Model: "llama-3-8b", TTL: time.Millisecond}, now.Add(-time.Second))
+	table.Update("peer-a", &ProviderMessage{Model: "mistral-7b"}, now)
+
+	providers := table.Providers("llama-3-8b")
+	require.Len(t, providers, 1)
+	assert.Equal(t, peer.ID("peer-a"), providers[0].Peer)
+	assert.Equal(t, 4, providers[0].Capacity)
+	assert.Equal(t, 0.2, providers[0].Price)
+	assert.Equal(t, now.Add(time.Minute), providers[0].ExpiresAt)
+
+	assert.Equal(t, map[string]int{"llama-3-8b": 1, "mistral-7b": 1}, table.Models())
+
+	assert.Equal(t, 1, table.Prune(now))
+	assert.Equal(t, 2, table.Prune(now.Add(2*time.Minute)))
+	assert.Empty(t, table.Models())
+}
+
+func TestProviderTableRefreshAndRemove(t *testing.T) {
+	table := NewProviderTable(time.Minute)
+	now := time.Now()
+
+	table.Update("peer-a", &ProviderMessage{Model: "llama-3-8b", Load: 1}, now.Add(-50*time.Second))
+	table.Update("peer-a", &ProviderMessage{Model: "llama-3-8b", Load: 3}, now)
+
+	assert.Equal(t, 0, table.Prune(now.Add(30*time.Second)))
+	providers := table.Providers("llama-3-8b")
+	require.Len(t, providers, 1)
+	assert.Equal(t, 3, providers[0].Load)
+
+	table.Remove("peer-a")
+	assert.Empty(t, table.Providers("llama-3-8b"))
+}
+
+func TestProviderTableHandler(t *testing.T) {
+	table := NewProviderTable(time.Minute)
+	from := newTestPeerID(t)
+
+	data, err := EncodeProviderMessage(&ProviderMessage{Model: "llama-3-8b", Capacity: 2, TTL: 10 * time.Second})
+	require.NoError(t, err)
+	require.NoError(t, table.Handler()(context.Background(), &Message{Data: data, From: []byte(from)}))
+
+	providers := table.Providers("llama-3-8b")
+	require.Len(t, providers, 1)
+	assert.Equal(t, from, providers[0].Peer)
+	assert.Equal(t, 2, providers[0].Capacity)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), providers[0].ExpiresAt, time.Second)
+
+	assert.Error(t, table.Handler()(context.Background(), &Message{Data: data, From: []byte("bogus")}))
+}
+
+func TestSealedRequestMessage(t *testing.T) {
+	providerKey, providerPub, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	otherKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	req := &RequestMessage{Type: TypeRequest, RequestID: "req-1", Model: "llama-3-8b", Payload: []byte("secret prompt")}
+	replyKey, err := req.Seal(providerPub)
+	require.NoError(t, err)
+
+	data, err := EncodeRequestMessage(req)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "secret prompt")
+
+	received, err := DecodeRequestMessage(data)
+	require.NoError(t, err)
+	assert.True(t, received.Encrypted)
+
+	eavesdropped := *received
+	_, err = eavesdropped.Open(otherKey)
+	assert.ErrorIs(t, err, ErrNotRecipient)
+
+	providerReplyKey, err := received.Open(providerKey)
+	require.NoError(t, err)
+	assert.Equal(t, "secret prompt", string(received.Payload))
+
+	resp := &ResponseMessage{Type: TypeResponse, RequestID: "req-1", Payload: []byte("answer")}
+	require.NoError(t, resp.Seal(providerReplyKey))
+	data, err = EncodeResponseMessage(resp)
+	require.NoError(t, err)
+
+	decoded, err := DecodeResponseMessage(data)
+	require.NoError(t, err)
+	require.NoError(t, decoded.Open(replyKey))
+	assert.Equal(t, "answer", string(decoded.Payload))
+}
+
+func TestProviderValidator(t *testing.T) {
+	ctx := context.Background()
+	valid, err := EncodeProviderMessage(&ProviderMessage{Model: "llama-3-8b", Capacity: 4, TTL: time.Minute})
+	require.NoError(t, err)
+	noModel, err := EncodeProviderMessage(&ProviderMessage{Capacity: 4})
+	require.NoError(t, err)
+	longTTL, err := EncodeProviderMessage(&ProviderMessage{Model: "llama-3-8b", TTL: 2 * MaxAdvertTTL})
+	require.NoError(t, err)
+
+	assert.Equal(t, ValidationAccept, ProviderValidator(ctx, &Message{Data: valid}))
+	assert.Equal(t, ValidationReject, ProviderValidator(ctx, &Message{Data: noModel}))
+	assert.Equal(t, ValidationReject, ProviderValidator(ctx, &Message{Data: longTTL}))
+	assert.Equal(t, ValidationReject, ProviderValidator(ctx, &Message{Data: []byte{0xff, 0xff, 0xff}}))
+	assert.Equal(t, ValidationReject, ProviderValidator(ctx, &Message{Data: make([]byte, MaxProviderMessageSize+1)}))
+	assert.Equal(t, ValidationReject, ProviderValidator(ctx, &Message{}))
+}
+
+func TestRequestValidator(t *testing.T) {
+	ctx := context.Background()
+	valid, err := EncodeRequestMessage(&RequestMessage{RequestID: "req-1", Model: "llama-3-8b", Payload: []byte("hi")})
+	require.NoError(t, err)
+	noID, err := EncodeRequestMessage(&RequestMessage{Model: "llama-3-8b"})
+	require.NoError(t, err)
+	badRecipient, err := EncodeRequestMessage(&RequestMessage{RequestID: "req-1", Model: "llama-3-8b", Encrypted: true, Recipient: "nobody"})
+	require.NoError(t, err)
+
+	assert.Equal(t, ValidationAccept, RequestValidator(ctx, &Message{Data: valid}))
+	assert.Equal(t, ValidationReject, RequestValidator(ctx, &Message{Data: noID}))
+	assert.Equal(t, ValidationReject, RequestValidator(ctx, &Message{Data: badRecipient}))
+	assert.Equal(t, ValidationReject, RequestValidator(ctx, &Message{Data: make([]byte, MaxRequestMessageSize+1)}))
+}
+
+func TestRequestValidatorReplyToMustBeOrigin(t *testing.T) {
+	ctx := context.Background()
+	origin, other := newTestPeerID(t), newTestPeerID(t)
+	data, err := EncodeRequestMessage(&RequestMessage{RequestID: "req-1", Model: "llama-3-8b", ReplyTo: origin.String()})
+	require.NoError(t, err)
+
+	assert.Equal(t, ValidationAccept, RequestValidator(ctx, &Message{Data: data, From: []byte(origin)}))
+	assert.Equal(t, ValidationReject, RequestValidator(ctx, &Message{Data: data, From: []byte(other)}))
+}
+
+func TestHeartbeatValidator(t *testing.T) {
+	ctx := context.Background()
+	self := newTestPeerID(t)
+	other := newTestPeerID(t)
+
+	encode := func(id peer.ID, ts time.Time) []byte {
+		data, err := EncodeHeartbeatMessage(&HeartbeatMessage{PeerID: id.String(), Timestamp: ts.Unix()})
+		require.NoError(t, err)
+		return data
+	}
+
+	now := time.Now()
+	assert.Equal(t, ValidationAccept, HeartbeatValidator(ctx, &Message{From: []byte(self), Data: encode(self, now)}))
+	assert.Equal(t, ValidationReject, HeartbeatValidator(ctx, &Message{From: []byte(self), Data: encode(other, now)}))
+	assert.Equal(t, ValidationIgnore, HeartbeatValidator(ctx, &Message{From: []byte(self), Data: encode(self, now.Add(-time.Hour))}))
+}
+
+func TestDefaultTopicConfigsHaveValidators(t *testing.T) {
+	for _, topic := range []string{TopicProviders, TopicRequests, TopicResponses, TopicHeartbeat} {
+		cfg := DefaultTopicConfigs()[topic]
+		require.NotNil(t, cfg, topic)
+		assert.NotNil(t, cfg.Validator, topic)
+	}
+}
+
+func TestBuildPeerScoreParamsFromDefaults(t *testing.T) {
+	params, err := BuildPeerScoreParams(DefaultTopicConfigs())
+	require.NoError(t, err)
+
+	require.Len(t, params.Topics, 4)
+	providers := params.Topics[TopicProviders]
+	assert.Equal(t, 0.5, providers.TopicWeight)
+	assert.Equal(t, -100.0, providers.InvalidMessageDeliveriesWeight)
+	assert.Equal(t, 1.0, params.Topics[TopicRequests].FirstMessageDeliveriesWeight)
+
+	for name, topic := range params.Topics {
+		assert.Positive(t, topic.TimeInMeshQuantum, name)
+		assert.LessOrEqual(t, topic.InvalidMessageDeliveriesWeight, 0.0, name)
+		assert.Greater(t, topic.InvalidMessageDeliveriesDecay, 0.0, name)
+		assert.Less(t, topic.InvalidMessageDeliveriesDecay, 1.0, name)
+	}
+	assert.NotNil(t, params.AppSpecificScore)
+	assert.GreaterOrEqual(t, params.DecayInterval, time.Second)
+}
+
+func TestTopicScoreParamsPenaltySign(t *testing.T) {
+	params, err := (&TopicScoreConfig{MeshMessageDeliveriesWeight: 2, InvalidMessageDeliveriesWeight: 50}).TopicScoreParams()
+	require.NoError(t, err)
+
+	assert.Equal(t, -2.0, params.MeshMessageDeliveriesWeight)
+	assert.Equal(t, -2.0, params.MeshFailurePenaltyWeight)
+	assert.Positive(t, params.MeshMessageDeliveriesThreshold)
+	assert.GreaterOrEqual(t, params.MeshMessageDeliveriesActivation, time.Second)
+	assert.Equal(t, -50.0, params.InvalidMessageDeliveriesWeight)
+
+	_, err = (&TopicScoreConfig{TimeInMeshWeight: -1}).TopicScoreParams()
+	assert.Error(t, err)
+}
+
+func TestBuildPeerScoreParamsStrictestPeerPenalty(t *testing.T) {
+	params, err := BuildPeerScoreParams(map[string]*TopicConfig{
+		"a": {Name: "a", Score: &TopicScoreConfig{IPColocationFactorWeight: -10, IPColocationFactorThreshold: 5, BehaviourPenaltyWeight: -1}},
+		"b": {Name: "b", Score: &TopicScoreConfig{IPColocationFactorWeight: -20, IPColocationFactorThreshold: 3}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, -20.0, params.IPColocationFactorWeight)
+	assert.Equal(t, 3, params.IPColocationFactorThreshold)
+	assert.Equal(t, -1.0, params.BehaviourPenaltyWeight)
+	assert.Greater(t, params.BehaviourPenaltyDecay, 0.0)
+}
+
+func TestSetTopicScoreOverride(t *testing.T) {
+	m := NewManager(nil)
+
+	_, ok := m.TopicScore(TopicSync)
+	assert.False(t, ok)
+
+	require.NoError(t, m.SetTopicScore(TopicSync, &TopicScoreConfig{ByTopicScoreWeight: 0.2}))
+	score, ok := m.TopicScore(TopicSync)
+	require.True(t, ok)
+	assert.Equal(t, 0.2, score.ByTopicScoreWeight)
+
+	assert.Error(t, m.SetTopicScore(TopicSync, &TopicScoreConfig{ByTopicScoreWeight: -1}))
+}
+
+func TestPeerScoreSnapshots(t *testing.T) {
+	m := NewManager(nil)
+	a, b := newTestPeerID(t), newTestPeerID(t)
+
+	m.inspectScores(map[peer.ID]*pubsub.PeerScoreSnapshot{
+		a: {Score: 12, Topics: map[string]*pubsub.TopicScoreSnapshot{TopicProviders: {TimeInMesh: time.Minute}}},
+		b: {Score: -40, BehaviourPenalty: 2},
+	})
+
+	scores := m.PeerScores()
+	require.Len(t, scores, 2)
+	assert.Equal(t, b, scores[0].Peer)
+	assert.Equal(t, -40.0, scores[0].Score)
+
+	score, ok := m.PeerScore(a)
+	require.True(t, ok)
+	assert.Equal(t, time.Minute, score.Topics[TopicProviders].TimeInMesh)
+}
+
+func newTestManager(t *testing.T, opts ...ManagerOption) *PubSubManager {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return newTestManagerWithContext(t, ctx, opts...)
+}
+
+func newTestManagerWithContext(t *testing.T, ctx context.Context, opts ...ManagerOption) *PubSubManager {
+	t.Helper()
+
+	h, err := mocknet.New().GenPeer()
+	require.NoError(t, err)
+
+	m, err := New(ctx, h, append([]ManagerOption{WithValidation(false)}, opts...)...)
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestManagerSubscribeSharesSubscription(t *testing.T) {
+	m := newTestManager(t)
+
+	var mu sync.Mutex
+	var got []string
+	handler := func(name string) MessageHandler {
+		return func(ctx context.Context, msg *Message) error {
+			mu.Lock()
+			got = append(got, name+":"+string(msg.Data))
+			mu.Unlock()
+			return nil
+		}
+	}
+
+	first, err := m.Subscribe("test", handler("a"))
+	require.NoError(t, err)
+	second, err := m.Subscribe("test", handler("b"))
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+
+	require.NoError(t, m.Publish("test", []byte("hello")))
+
+	select {
+	case msg := <-first.Messages():
+		assert.Equal(t, "hello", string(msg.Data))
+		assert.Equal(t, "test", msg.Topic)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+
+	mu.Lock()
+	assert.Equal(t, []string{"a:hello", "b:hello"}, got)
+	mu.Unlock()
+}
+
+func TestManagerClose(t *testing.T) {
+	m := newTestManager(t)
+
+	sub, err := m.Subscribe("test", nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Publish("other", []byte("x")))
+
+	require.NoError(t, m.Close())
+
+	select {
+	case _, ok := <-sub.Messages():
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages channel not closed")
+	}
+
+	_, err = m.Subscribe("test", nil)
+	assert.ErrorIs(t, err, ErrManagerClosed)
+	assert.ErrorIs(t, m.Publish("test", []byte("x")), ErrManagerClosed)
+	assert.NoError(t, m.Close())
+}
+
+func TestManagerConcurrentSubscribePublishUnsubscribe(t *testing.T) {
+	m := newTestManager(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		topic := fmt.Sprintf("topic-%d", i%3)
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				sub, err := m.Subscribe(topic, func(ctx context.Context, msg *Message) error { return nil })
+				if assert.NoError(t, err) && j%10 == 0 {
+					sub.Cancel()
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.NoError(t, m.Publish(topic, []byte("data")))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.NoError(t, m.Unsubscribe(topic))
+				m.GetTopics()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.NoError(t, m.Close())
+}
+
+func TestTypedTopicPublishSubscribe(t *testing.T) {
+	m := newTestManager(t)
+	topic := RequestTopic(m)
+
+	received := make(chan *RequestMessage, 1)
+	_, err := topic.Subscribe(func(ctx context.Context, from peer.ID, msg *RequestMessage) error {
+		received <- msg
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, topic.Publish(context.Background(), &RequestMessage{RequestID: "req-1", Model: "llama-3-8b", Payload: []byte("hi")}))
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "req-1", msg.RequestID)
+		assert.Equal(t, "llama-3-8b", msg.Model)
+		assert.Equal(t, []byte("hi"), msg.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+}
+
+func TestTypedTopicCodecs(t *testing.T) {
+	type note struct {
+		Text string `json:"text"`
+	}
+
+	jsonCodec := JSONCodec[note]{}
+	data, err := jsonCodec.Encode(&note{Text: "hello"})
+	require.NoError(t, err)
+	decoded, err := jsonCodec.Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", decoded.Text)
+
+	protoCodec := ProtoCodec[wire.Heartbeat, *wire.Heartbeat]{}
+	data, err = protoCodec.Encode(&wire.Heartbeat{PeerId: "peer-a", Timestamp: 42})
+	require.NoError(t, err)
+	hb, err := protoCodec.Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, "peer-a", hb.GetPeerId())
+	assert.Equal(t, int64(42), hb.GetTimestamp())
+}
+
+func TestTypedTopicCountsDecodeErrors(t *testing.T) {
+	m := NewManager(nil)
+	from := newTestPeerID(t)
+
+	var got peer.ID
+	handler := HeartbeatTopic(m).Handler(func(ctx context.Context, sender peer.ID, msg *HeartbeatMessage) error {
+		got = sender
+		return nil
+	})
+
+	data, err := EncodeHeartbeatMessage(&HeartbeatMessage{PeerID: from.String(), Timestamp: 1})
+	require.NoError(t, err)
+	require.NoError(t, handler(context.Background(), &Message{Data: data, From: []byte(from)}))
+	assert.Equal(t, from, got)
+
+	assert.Error(t, handler(context.Background(), &Message{Data: []byte{0xff, 0xff}}))
+	assert.Error(t, handler(context.Background(), &Message{Data: data, From: []byte("bogus")}))
+	assert.Equal(t, uint64(2), m.DecodeErrors(TopicHeartbeat))
+	assert.Zero(t, m.DecodeErrors(TopicRequests))
+}
+
+func TestSubscriptionDropNewestOnOverflow(t *testing.T) {
+	m := newTestManager(t)
+
+	started := make(chan struct{}, 5)
+	release := make(chan struct{})
+	var dead sync.Map
+	_, err := m.Subscribe("test", func(ctx context.Context, msg *Message) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}, WithBufferSize(1), WithWorkers(1), WithDeadLetter(func(msg *Message, err error) {
+		assert.ErrorIs(t, err, ErrSubscriptionOverflow)
+		dead.Store(string(msg.Data), true)
+	}))
+	require.NoError(t, err)
+
+	// Once the only worker is busy with the first message, the buffer holds
+	// one more and the rest overflow.
+	require.NoError(t, m.Publish("test", []byte("0")))
+	<-started
+	for i := 1; i < 5; i++ {
+		require.NoError(t, m.Publish("test", []byte(fmt.Sprint(i))))
+	}
+
+	assert.Eventually(t, func() bool { return m.SubscriptionStats("test").Dropped == 3 }, 5*time.Second, 10*time.Millisecond)
+	_, lastDropped := dead.Load("4")
+	assert.True(t, lastDropped)
+
+	close(release)
+	assert.Eventually(t, func() bool { return m.SubscriptionStats("test").Delivered == 2 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSubscriptionDropOldestOnOverflow(t *testing.T) {
+	m := newTestManager(t)
+
+	started := make(chan struct{}, 5)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var handled []string
+	_, err := m.Subscribe("test", func(ctx context.Context, msg *Message) error {
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		handled = append(handled, string(msg.Data))
+		mu.Unlock()
+		return nil
+	}, WithBufferSize(1), WithWorkers(1), WithOverflowPolicy(OverflowDropOldest))
+	require.NoError(t, err)
+
+	// Once the only worker is busy with the first message, the buffer holds
+	// one more and the rest overflow.
+	require.NoError(t, m.Publish("test", []byte("0")))
+	<-started
+	for i := 1; i < 5; i++ {
+		require.NoError(t, m.Publish("test", []byte(fmt.Sprint(i))))
+	}
+
+	assert.Eventually(t, func() bool { return m.SubscriptionStats("test").Dropped == 3 }, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	assert.Eventually(t, func() bool { return m.SubscriptionStats("test").Delivered == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	assert.Contains(t, handled, "4")
+	mu.Unlock()
+}
+
+func TestSubscriptionBlockDoesNotDrop(t *testing.T) {
+	m := newTestManager(t)
+
+	_, err := m.Subscribe("test", func(ctx context.Context, msg *Message) error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}, WithBufferSize(1), WithWorkers(1), WithOverflowPolicy(OverflowBlock))
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, m.Publish("test", []byte(fmt.Sprint(i))))
+	}
+
+	assert.Eventually(t, func() bool { return m.SubscriptionStats("test").Delivered == 10 }, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, m.SubscriptionStats("test").Dropped)
+}
+
+func TestSubscriptionHandlerFailuresGoToDeadLetter(t *testing.T) {
+	m := newTestManager(t)
+
+	failure := fmt.Errorf("boom")
+	dead := make(chan error, 1)
+	sub, err := m.Subscribe("test", func(ctx context.Context, msg *Message) error {
+		return failure
+	}, WithDeadLetter(func(msg *Message, err error) {
+		dead <- err
+	}))
+	require.NoError(t, err)
+	messages := sub.Messages()
+
+	require.NoError(t, m.Publish("test", []byte("x")))
+
+	select {
+	case err := <-dead:
+		assert.ErrorIs(t, err, failure)
+	case <-time.After(5 * time.Second):
+		t.Fatal("failure not dead-lettered")
+	}
+	assert.Equal(t, SubscriptionStats{Failed: 1}, m.SubscriptionStats("test"))
+	assert.Empty(t, messages)
+}
+
+func TestSubscriptionEndsWithManagerContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := newTestManagerWithContext(t, ctx)
+
+	sub, err := m.Subscribe("test", nil)
+	require.NoError(t, err)
+	assert.NoError(t, sub.Err())
+
+	cancel()
+
+	select {
+	case <-sub.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription did not end with the context")
+	}
+	assert.ErrorIs(t, sub.Err(), context.Canceled)
+
+	_, err = m.Subscribe("test", nil)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestSubscriptionCancelSetsTerminalError(t *testing.T) {
+	m := newTestManager(t)
+
+	sub, err := m.Subscribe("test", nil)
+	require.NoError(t, err)
+	require.NoError(t, sub.Cancel())
+
+	select {
+	case <-sub.Done():
+	default:
+		t.Fatal("Cancel returned before the subscription ended")
+	}
+	assert.ErrorIs(t, sub.Err(), ErrSubscriptionCancelled)
+}
+
+func TestSubscriptionCancelAsyncFromHandler(t *testing.T) {
+	m := newTestManager(t)
+
+	var sub *Subscription
+	ready := make(chan struct{})
+	sub, err := m.Subscribe("test", func(ctx context.Context, msg *Message) error {
+		<-ready
+		sub.CancelAsync()
+		return nil
+	})
+	require.NoError(t, err)
+	close(ready)
+
+	require.NoError(t, m.Publish("test", []byte("x")))
+
+	select {
+	case <-sub.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription did not end")
+	}
+	assert.ErrorIs(t, sub.Err(), ErrSubscriptionCancelled)
+}
+
+func TestSubscriptionsDoNotLeakGoroutines(t *testing.T) {
+	m := newTestManager(t)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		_, err := m.Subscribe(fmt.Sprintf("topic-%d", i), func(ctx context.Context, msg *Message) error { return nil })
+		require.NoError(t, err)
+		require.NoError(t, m.Publish(fmt.Sprintf("topic-%d", i), []byte("x")))
+	}
+	assert.Greater(t, runtime.NumGoroutine(), before)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, m.Unsubscribe(fmt.Sprintf("topic-%d", i)))
+	}
+	require.NoError(t, m.Close())
+
+	// Not assert.Eventually, which checks its condition on a goroutine of
+	// its own.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+func TestRPCRequestFirstResponse(t *testing.T) {
+	m := newTestManager(t)
+	rpc := NewRPC(m, nil, "")
+
+	_, err := rpc.Serve(func(ctx context.Context, from peer.ID, req *RequestMessage) (*ResponseMessage, error) {
+		return &ResponseMessage{Payload: append([]byte("re: "), req.Payload...)}, nil
+	})
+	require.NoError(t, err)
+
+	responses, err := rpc.Request(context.Background(), &RequestMessage{Model: "llama-3-8b", Payload: []byte("hi")}, WithRequestTimeout(5*time.Second))
+	require.NoError(t, err)
+	require.Len(t, responses, 1)
+	assert.NotEmpty(t, responses[0].RequestID)
+	assert.Equal(t, []byte("re: hi"), responses[0].Payload)
+}
+
+func TestRPCRequestCollectsAllUntilDeadline(t *testing.T) {
+	m := newTestManager(t)
+	rpc := NewRPC(m, nil, "")
+
+	for _, name := range []string{"a", "b"} {
+		name := name
+		_, err := rpc.Serve(func(ctx context.Context, from peer.ID, req *RequestMessage) (*ResponseMessage, error) {
+			if name == "b" {
+				return nil, fmt.Errorf("model not served")
+			}
+			return &ResponseMessage{Payload: []byte(name)}, nil
+		})
+		require.NoError(t, err)
+	}
+
+	start := time.Now()
+	responses, err := rpc.Request(context.Background(), &RequestMessage{Model: "llama-3-8b"}, WithAll(), WithRequestTimeout(300*time.Millisecond))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+	require.Len(t, responses, 2)
+
+	var errs []string
+	for _, resp := range responses {
+		errs = append(errs, resp.Error)
+	}
+	assert.ElementsMatch(t, []string{"", "model not served"}, errs)
+}
+
+func TestRPCRequestWithoutResponses(t *testing.T) {
+	m := newTestManager(t)
+	rpc := NewRPC(m, nil, "")
+
+	_, err := rpc.Serve(func(ctx context.Context, from peer.ID, req *RequestMessage) (*ResponseMessage, error) {
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	_, err = rpc.Request(context.Background(), &RequestMessage{Model: "llama-3-8b"}, WithFirst(2), WithRequestTimeout(100*time.Millisecond))
+	assert.ErrorIs(t, err, ErrNoResponses)
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 10, Burst: 2})
+	now := time.Now()
+
+	assert.True(t, limiter.allow("a", now))
+	assert.True(t, limiter.allow("a", now))
+	assert.False(t, limiter.allow("a", now))
+	assert.True(t, limiter.allow("b", now))
+
+	assert.True(t, limiter.allow("a", now.Add(100*time.Millisecond)))
+	assert.False(t, limiter.allow("a", now.Add(100*time.Millisecond)))
+
+	assert.True(t, newRateLimiter(RateLimit{}).allow("a", now))
+}
+
+func TestPublishRateLimited(t *testing.T) {
+	m := newTestManager(t, WithRateLimits(RateLimitConfig{Publish: RateLimit{Rate: 0.001, Burst: 2}}))
+
+	require.NoError(t, m.Publish("test", []byte("1")))
+	require.NoError(t, m.Publish("test", []byte("2")))
+	assert.ErrorIs(t, m.Publish("test", []byte("3")), ErrPublishRateLimited)
+	assert.NoError(t, m.Publish("other", []byte("1")))
+}
+
+func TestRateLimitRejectsOriginAndIgnoresRelays(t *testing.T) {
+	m := NewManager(nil)
+	m.rateLimits = RateLimitConfig{MaxViolations: 3, ViolationWindow: time.Minute, ViolationPenalty: 10}
+	m.violations = newViolations(time.Minute)
+
+	origin := newTestPeerID(t)
+	relay := newTestPeerID(t)
+	limiters := &topicLimiters{peer: newRateLimiter(RateLimit{Rate: 0.001, Burst: 1}), topic: newRateLimiter(RateLimit{})}
+
+	_, ok := m.rateLimit(TopicRequests, relay, origin, limiters)
+	assert.True(t, ok)
+
+	result, ok := m.rateLimit(TopicRequests, relay, origin, limiters)
+	assert.False(t, ok)
+	assert.Equal(t, ValidationIgnore, result)
+	assert.Zero(t, m.RateLimitViolations(relay))
+	assert.Zero(t, m.RateLimitViolations(origin))
+
+	result, ok = m.rateLimit(TopicRequests, origin, origin, limiters)
+	assert.False(t, ok)
+	assert.Equal(t, ValidationReject, result)
+	assert.Equal(t, 1, m.RateLimitViolations(origin))
+	assert.Equal(t, -10.0, m.appSpecificScore(origin))
+
+	for i := 0; i < 3; i++ {
+		m.rateLimit(TopicRequests, origin, origin, limiters)
+	}
+	assert.Zero(t, m.RateLimitViolations(origin), "violations reset once the peer is disconnected")
+}
+
+func TestRateLimitTopicLimitIgnores(t *testing.T) {
+	m := NewManager(nil)
+	from := newTestPeerID(t)
+	limiters := &topicLimiters{peer: newRateLimiter(RateLimit{}), topic: newRateLimiter(RateLimit{Rate: 0.001, Burst: 1})}
+
+	_, ok := m.rateLimit(TopicBroadcast, from, from, limiters)
+	assert.True(t, ok)
+
+	result, ok := m.rateLimit(TopicBroadcast, from, from, limiters)
+	assert.False(t, ok)
+	assert.Equal(t, ValidationIgnore, result)
+	assert.Zero(t, m.RateLimitViolations(from))
+}
+
+func TestTopicHistoryBounds(t *testing.T) {
+	h := newTopicHistory(3, time.Minute)
+	now := time.Now()
+
+	assert.True(t, h.add(&Message{ID: "a"}, now.Add(-2*time.Minute)), "too old to keep is still new")
+	assert.True(t, h.add(&Message{ID: "b"}, now.Add(-30*time.Second)))
+	assert.True(t, h.add(&Message{ID: "d"}, now))
+	assert.True(t, h.add(&Message{ID: "c"}, now.Add(-10*time.Second)))
+	assert.False(t, h.add(&Message{ID: "c"}, now.Add(-10*time.Second)))
+	assert.True(t, h.add(&Message{}, now), "messages without an ID are not deduplicated")
+
+	ids := func(entries []historyEntry) []string {
+		var ids []string
+		for _, e := range entries {
+			ids = append(ids, e.msg.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"b", "c", "d"}, ids(h.since(time.Time{}, 0)))
+	assert.Equal(t, []string{"c", "d"}, ids(h.since(now.Add(-20*time.Second), 0)))
+	assert.Equal(t, []string{"d"}, ids(h.since(time.Time{}, 1)))
+
+	assert.True(t, h.add(&Message{ID: "e"}, now))
+	assert.Equal(t, []string{"c", "d", "e"}, ids(h.since(time.Time{}, 0)))
+	assert.True(t, h.add(&Message{ID: "b"}, now), "dropped messages are forgotten")
+}
+
+func TestSyncServesTopicHistory(t *testing.T) {
+	m := newTestManager(t)
+
+	sub, err := m.Subscribe(TopicBroadcast, nil)
+	require.NoError(t, err)
+	messages := sub.Messages()
+
+	start := time.Now()
+	require.NoError(t, m.Publish(TopicBroadcast, []byte("hello")))
+	select {
+	case <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	assert.Equal(t, 1, m.HistoryLen(TopicBroadcast))
+
+	request := func(req *wire.SyncRequest) *wire.SyncResponse {
+		payload, err := proto.Marshal(req)
+		require.NoError(t, err)
+		reply, err := m.handleSyncRequest(context.Background(), "", &protocol.Message{Type: protocol.MsgTypeSyncRequest, RequestID: "sync-1", Payload: payload})
+		require.NoError(t, err)
+		assert.Equal(t, protocol.MsgTypeSyncResponse, reply.Type)
+		assert.Equal(t, "sync-1", reply.RequestID)
+
+		var resp wire.SyncResponse
+		require.NoError(t, proto.Unmarshal(reply.Payload, &resp))
+		return &resp
+	}
+
+	resp := request(&wire.SyncRequest{Topic: TopicBroadcast, SinceMs: start.Add(-time.Second).UnixMilli()})
+	require.Len(t, resp.Messages, 1)
+	assert.Equal(t, []byte("hello"), resp.Messages[0].Data)
+
+	assert.Empty(t, request(&wire.SyncRequest{Topic: TopicBroadcast, SinceMs: time.Now().Add(time.Second).UnixMilli()}).Messages)
+	assert.Empty(t, request(&wire.SyncRequest{Topic: TopicRequests}).Messages, "topics without history serve nothing")
+}
+
+func newSignedTestMessage(t *testing.T, topic string, data []byte) *Message {
+	t.Helper()
+
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	from, err := peer.IDFromPublicKey(pub)
+	require.NoError(t, err)
+
+	msg := &Message{From: []byte(from), Data: data, Seqno: []byte{0, 0, 0, 1}, Topic: topic}
+	msg.Signature, err = priv.Sign(signedBytes(msg))
+	require.NoError(t, err)
+	return msg
+}
+
+func syncedFrom(server peer.ID, messages ...*Message) []syncedMessage {
+	synced := make([]syncedMessage, 0, len(messages))
+	for _, msg := range messages {
+		synced = append(synced, syncedMessage{msg: msg, server: server})
+	}
+	return synced
+}
+
+func TestDeliverSyncedVerifiesAndDeduplicates(t *testing.T) {
+	m := newTestManager(t)
+
+	received := make(chan time.Time, 10)
+	sub, err := m.Subscribe(TopicBroadcast, func(ctx context.Context, msg *Message) error {
+		at, _ := ReceivedAtFromContext(ctx)
+		received <- at
+		return nil
+	})
+	require.NoError(t, err)
+
+	at := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	signed := newSignedTestMessage(t, TopicBroadcast, []byte("hello"))
+	signed.ReceivedAt = at
+
+	duplicate := *signed
+	tampered := *newSignedTestMessage(t, TopicBroadcast, []byte("hello"))
+	tampered.Data = []byte("changed")
+	unsigned := &Message{From: signed.From, Data: []byte("unsigned"), Seqno: []byte{0, 0, 0, 2}, Topic: TopicBroadcast}
+	empty := newSignedTestMessage(t, TopicBroadcast, nil)
+
+	server := newTestPeerID(t)
+	delivered := m.deliverSynced(context.Background(), sub, syncedFrom(server, signed, &duplicate, &tampered, unsigned, empty))
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, 1, m.HistoryLen(TopicBroadcast))
+
+	select {
+	case got := <-received:
+		assert.True(t, at.Equal(got), "handlers see when the message was first received")
+	case <-time.After(5 * time.Second):
+		t.Fatal("synced message not delivered")
+	}
+}
+
+func TestDeliverSyncedRateLimited(t *testing.T) {
+	m := newTestManager(t)
+	m.limiters[TopicBroadcast] = &topicLimiters{
+		peer:  newRateLimiter(RateLimit{Rate: 0.001, Burst: 1}),
+		topic: newRateLimiter(RateLimit{}),
+	}
+
+	sub, err := m.Subscribe(TopicBroadcast, nil)
+	require.NoError(t, err)
+
+	first := newSignedTestMessage(t, TopicBroadcast, []byte("first"))
+	second := newSignedTestMessage(t, TopicBroadcast, []byte("second"))
+	second.From = first.From
+	second.Seqno = []byte{0, 0, 0, 2}
+
+	server := newTestPeerID(t)
+	assert.Equal(t, 1, m.deliverSynced(context.Background(), sub, syncedFrom(server, first, first)), "copies count once")
+	assert.Zero(t, m.deliverSynced(context.Background(), sub, syncedFrom(server, second)))
+	assert.Zero(t, m.RateLimitViolations(server), "the server only relayed the message")
+}
+
+func TestFromWireMessageClampsReceivedAt(t *testing.T) {
+	latest := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+
+	msg := fromWireMessage(TopicBroadcast, &wire.PubSubMessage{ReceivedAtMs: time.Now().Add(time.Hour).UnixMilli()}, latest)
+	assert.True(t, latest.Equal(receivedAt(msg)))
+
+	earlier := latest.Add(-time.Second)
+	msg = fromWireMessage(TopicBroadcast, &wire.PubSubMessage{ReceivedAtMs: earlier.UnixMilli()}, latest)
+	assert.True(t, earlier.Equal(receivedAt(msg)))
+}
+
+func TestSyncErrors(t *testing.T) {
+	m := newTestManager(t)
+
+	_, err := m.Sync(context.Background(), TopicProviders, time.Time{})
+	assert.ErrorIs(t, err, ErrNotSubscribed)
+
+	_, err = m.Subscribe(TopicProviders, nil)
+	require.NoError(t, err)
+	_, err = m.Sync(context.Background(), TopicProviders, time.Time{})
+	assert.ErrorIs(t, err, ErrSyncDisabled)
+
+	m.EnableSync(protocol.NewHandler(nil))
+	_, err = m.Sync(context.Background(), TopicProviders, time.Time{})
+	assert.ErrorIs(t, err, ErrNoSyncPeers)
+}
+
+func TestProviderTableKeepsNewerAdvert(t *testing.T) {
+	table := NewProviderTable(time.Minute)
+	from := newTestPeerID(t)
+	now := time.Now()
+
+	table.Update(from, &ProviderMessage{Model: "llama-3-8b", Load: 3}, now)
+
+	data, err := EncodeProviderMessage(&ProviderMessage{Model: "llama-3-8b", Load: 1})
+	require.NoError(t, err)
+	ctx := context.WithValue(context.Background(), receivedAtKey{}, now.Add(-30*time.Second))
+	require.NoError(t, table.Handler()(ctx, &Message{Data: data, From: []byte(from)}))
+
+	providers := table.Providers("llama-3-8b")
+	require.Len(t, providers, 1)
+	assert.Equal(t, 3, providers[0].Load)
+}
+
+func TestProviderTableDatesAdvertFromOriginTimestamp(t *testing.T) {
+	table := NewProviderTable(time.Hour)
+	from := newTestPeerID(t)
+	published := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+
+	data, err := EncodeProviderMessage(&ProviderMessage{Model: "llama-3-8b", Timestamp: published.Unix()})
+	require.NoError(t, err)
+	ctx := context.WithValue(context.Background(), receivedAtKey{}, time.Now())
+	require.NoError(t, table.Handler()(ctx, &Message{Data: data, From: []byte(from)}))
+
+	providers := table.Providers("llama-3-8b")
+	require.Len(t, providers, 1)
+	assert.True(t, published.Add(MaxAdvertSkew).Equal(providers[0].LastSeen), "a synced advert is no fresher than its origin signed")
+}
+
+func TestMessageIDFuncs(t *testing.T) {
+	a := newTestPeerID(t)
+	b := newTestPeerID(t)
+
+	first := &Message{From: []byte(a), Seqno: []byte{1}, Data: []byte("advert")}
+	again := &Message{From: []byte(a), Seqno: []byte{2}, Data: []byte("advert")}
+	other := &Message{From: []byte(b), Seqno: []byte{1}, Data: []byte("advert")}
+
+	assert.NotEqual(t, DefaultMessageID(first), DefaultMessageID(again))
+	assert.Equal(t, ContentMessageID(first), ContentMessageID(again))
+	assert.NotEqual(t, ContentMessageID(first), ContentMessageID(other))
+	assert.Empty(t, DefaultMessageID(&Message{Data: []byte("advert")}))
+
+	m := newTestManager(t, WithTopicConfigs(map[string]*TopicConfig{
+		"idempotent": {Name: "idempotent", MessageID: ContentMessageID},
+	}))
+	assert.Equal(t, ContentMessageID(first), m.messageID(&Message{From: first.From, Seqno: first.Seqno, Data: first.Data, Topic: "idempotent"}))
+	assert.Equal(t, DefaultMessageID(first), m.messageID(first))
+}
+
+func TestContentMessageIDDeduplicatesRepublishes(t *testing.T) {
+	count := func(t *testing.T, m *PubSubManager, topic string) int {
+		t.Helper()
+
+		received := make(chan string, 10)
+		_, err := m.Subscribe(topic, func(ctx context.Context, msg *Message) error {
+			received <- string(msg.Data)
+			return nil
+		}, WithWorkers(1))
+		require.NoError(t, err)
+
+		require.NoError(t, m.Publish(topic, []byte("advert")))
+		require.NoError(t, m.Publish(topic, []byte("advert")))
+		require.NoError(t, m.Publish(topic, []byte("done")))
+
+		n := 0
+		for {
+			select {
+			case data := <-received:
+				n++
+				if data == "done" {
+					return n
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("messages not delivered")
+			}
+		}
+	}
+
+	m := newTestManager(t, WithTopicConfigs(map[string]*TopicConfig{
+		"idempotent": {Name: "idempotent", MessageID: ContentMessageID},
+	}))
+	assert.Equal(t, 2, count(t, m, "idempotent"))
+	assert.Equal(t, 3, count(t, m, "plain"))
+
+	m = newTestManager(t, WithMessageIDFunc(ContentMessageID))
+	assert.Equal(t, 2, count(t, m, "plain"))
+}
+
+func TestTopicHistoryRefreshesRepeatedMessage(t *testing.T) {
+	h := newTopicHistory(10, time.Minute)
+	now := time.Now()
+
+	assert.True(t, h.add(&Message{ID: "a"}, now.Add(-30*time.Second)))
+	assert.True(t, h.add(&Message{ID: "b"}, now.Add(-20*time.Second)))
+	assert.False(t, h.add(&Message{ID: "a"}, now))
+	assert.False(t, h.add(&Message{ID: "b"}, now.Add(-40*time.Second)), "older copies do not move the entry")
+
+	entries := h.since(time.Time{}, 0)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "b", entries[0].msg.ID)
+	assert.Equal(t, "a", entries[1].msg.ID)
+	assert.True(t, now.Equal(entries[1].at))
+}